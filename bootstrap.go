@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm/params"
+
+	"garm-test-client/fakeprovider"
+	"garm-test-client/fakerunner"
+)
+
+// providerStateFile is the state file of the fake provider GARM runs, where
+// the bootstrap params of its instances, tokens included, are read from.
+var providerStateFile = os.Getenv("GARM_FAKE_PROVIDER_STATE")
+
+// bootstrapProvider is the provider the bootstrap pool is created with. It
+// must leave the runners of its instances to call back, as the fake provider
+// does.
+var bootstrapProvider = envOrDefault("GARM_BOOTSTRAP_PROVIDER", "fake")
+
+// bootstrapSource returns the bootstrap params GARM created the named
+// instance with. When set, it is used instead of providerStateFile.
+var bootstrapSource func(name string) (commonParams.BootstrapInstance, error)
+
+// bootstrapPoolID is the pool whose runners the bootstrap steps play.
+var bootstrapPoolID string
+
+// bootstrapped are the instances whose runners were already played.
+var bootstrapped = map[string]bool{}
+
+func envOrDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+func canBootstrap() bool {
+	return bootstrapSource != nil || providerStateFile != ""
+}
+
+func instanceBootstrap(name string) (commonParams.BootstrapInstance, error) {
+	bootstrap, err := readBootstrap(name)
+	if err != nil {
+		return commonParams.BootstrapInstance{}, err
+	}
+	recorder.addBootstrap(name, bootstrap)
+	return bootstrap, nil
+}
+
+func readBootstrap(name string) (commonParams.BootstrapInstance, error) {
+	if bootstrapSource != nil {
+		return bootstrapSource(name)
+	}
+	if providerStateFile == "" {
+		return commonParams.BootstrapInstance{}, fmt.Errorf("the state file of the fake provider is needed to play runners, set --provider-state")
+	}
+	// The provider takes a missing state file for one without instances.
+	if _, err := os.Stat(providerStateFile); err != nil {
+		return commonParams.BootstrapInstance{}, err
+	}
+	provider := fakeprovider.NewProvider(fakeprovider.Config{StateFile: providerStateFile}, "")
+	return provider.Bootstrap(name)
+}
+
+// bootstrapPoolParams describes the bootstrap pool: the repo pool of the
+// scenario, with the bootstrap provider and a flavor of its own, two runners
+// to play and room for a replacement. The manual label keeps runner
+// simulators away from it.
+func bootstrapPoolParams() params.CreatePoolParams {
+	poolParams := entitySpec(repo).Pool
+	poolParams.ProviderName = bootstrapProvider
+	// GARM allows a single pool per provider, image and flavor on the repo,
+	// the repo pool may use the bootstrap provider as well.
+	poolParams.Flavor = runLabel + "-bootstrap"
+	poolParams.MinIdleRunners = 2
+	poolParams.MaxRunners = 3
+	poolParams.Tags = append(append([]string{}, poolParams.Tags...), fakerunner.ManualLabel)
+	return forRun(poolParams)
+}
+
+// waitPendingRunner waits for an instance of the bootstrap pool that is
+// running, with a runner that has yet to call back.
+func waitPendingRunner() (params.Instance, error) {
+	var pending params.Instance
+	_, err := poll(runCtx, "a running instance of pool "+bootstrapPoolID+" with a pending runner", defaultPoll, func() (params.Instances, error) {
+		return listPoolInstances(cli, authToken, bootstrapPoolID)
+	}, func(instances params.Instances) bool {
+		for _, instance := range instances {
+			if bootstrapped[instance.Name] {
+				continue
+			}
+			if instance.Status == commonParams.InstanceRunning && instance.RunnerStatus == params.RunnerPending {
+				pending = instance
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return params.Instance{}, err
+	}
+	bootstrapped[pending.Name] = true
+	return pending, nil
+}
+
+// pendingRunner returns a runner for a pending instance of the bootstrap
+// pool.
+func pendingRunner() (*fakerunner.Runner, params.Instance, error) {
+	instance, err := waitPendingRunner()
+	if err != nil {
+		return nil, params.Instance{}, err
+	}
+	bootstrap, err := instanceBootstrap(instance.Name)
+	if err != nil {
+		return nil, params.Instance{}, fmt.Errorf("fetching the bootstrap params of %s: %w", instance.Name, err)
+	}
+	log.Printf("playing the runner of %s", instance.Name)
+	return fakerunner.New(bootstrap, httpClient), instance, nil
+}
+
+func expectUnauthorized(what string, err error) error {
+	var statusErr *fakerunner.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("expected %s to be rejected with status 401, got: %v", what, err)
+	}
+	log.Printf("%s rejected", what)
+	return nil
+}
+
+// checkRunner checks that GARM shows the runner of the named instance with
+// status, and with every message of messages, in order.
+func checkRunner(name string, status params.RunnerStatus, messages []string) (*params.Instance, error) {
+	instance, err := getInstance(cli, authToken, name)
+	if err != nil {
+		return nil, err
+	}
+	if instance.RunnerStatus != status {
+		return nil, fmt.Errorf("instance %s: runner status is %s, expected %s", name, instance.RunnerStatus, status)
+	}
+	next := 0
+	for _, msg := range instance.StatusMessages {
+		if next < len(messages) && msg.Message == messages[next] {
+			next++
+		}
+	}
+	if next < len(messages) {
+		return nil, fmt.Errorf("instance %s: status message %q missing; status messages:\n%s",
+			name, messages[next], formatStatusMessages(instance.StatusMessages))
+	}
+	return instance, nil
+}
+
+// ////////////
+// Bootstrap //
+// ////////////
+func CreateBootstrapPool() error {
+	state := repo.State()
+	poolParams := bootstrapPoolParams()
+	pools, err := repo.ListPools(state.id)
+	if err != nil {
+		return err
+	}
+	if existing, found := findPool(pools, poolParams, state.poolID, poolID); found {
+		log.Printf(">>> Bootstrap pool %s already exists, skipping create", describePool(poolParams))
+		bootstrapPoolID = existing.ID
+		return nil
+	}
+	log.Printf(">>> Create bootstrap pool %s", describePool(poolParams))
+	pool, err := repo.CreatePool(state.id, poolParams)
+	if err != nil {
+		return err
+	}
+	printResponse(pool)
+	bootstrapPoolID = pool.ID
+	cleanups.push("drain and delete bootstrap pool", DeleteBootstrapPool)
+	return nil
+}
+
+func BootstrapRunnerIdle() error {
+	log.Println(">>> Install a runner through the callbacks")
+	runner, instance, err := pendingRunner()
+	if err != nil {
+		return err
+	}
+	if _, err := runner.RegistrationToken(runCtx); err != nil {
+		return fmt.Errorf("fetching the registration token: %w", err)
+	}
+	log.Printf("registration token of %s fetched", instance.Name)
+	// GARM hands out a single registration token per instance.
+	_, err = runner.RegistrationToken(runCtx)
+	if err := expectUnauthorized("a second registration token fetch", err); err != nil {
+		return err
+	}
+
+	agentID := rand.Int63n(1<<31) + 1
+	if err := runner.ReportInstalled(runCtx, agentID); err != nil {
+		return err
+	}
+	installed, err := checkRunner(instance.Name, params.RunnerIdle,
+		append(append([]string{}, fakerunner.InstallSteps...), fakerunner.InstalledMessage))
+	if err != nil {
+		return err
+	}
+	if installed.AgentID != agentID {
+		return fmt.Errorf("instance %s: agent ID is %d, expected %d", instance.Name, installed.AgentID, agentID)
+	}
+	printResponse(installed)
+
+	// Installed runners cannot call back anymore.
+	err = runner.SendStatus(runCtx, params.RunnerActive, "running a job", nil)
+	return expectUnauthorized("a status update of an installed runner", err)
+}
+
+func BootstrapRunnerFailed() error {
+	log.Println(">>> Fail to install a runner through the callbacks")
+	runner, instance, err := pendingRunner()
+	if err != nil {
+		return err
+	}
+	step := fakerunner.InstallSteps[0]
+	if err := runner.SendStatus(runCtx, params.RunnerInstalling, step, nil); err != nil {
+		return err
+	}
+	reason := "failed to download tools: simulated failure"
+	if err := runner.Fail(runCtx, reason); err != nil {
+		return err
+	}
+	failed, err := checkRunner(instance.Name, params.RunnerFailed, []string{step, reason})
+	if err != nil {
+		return err
+	}
+	printResponse(failed)
+	if err := expectUnauthorized("a status update of a failed runner",
+		runner.SendStatus(runCtx, params.RunnerInstalling, step, nil)); err != nil {
+		return err
+	}
+
+	log.Printf(">>> Wait for the failed runner of %s to be replaced", instance.Name)
+	_, err = waitPendingRunner()
+	return err
+}
+
+func BootstrapRejectBadTokens() error {
+	log.Println(">>> Call back with missing and bad tokens")
+	instances, err := listPoolInstances(cli, authToken, bootstrapPoolID)
+	if err != nil {
+		return err
+	}
+	// The replacement of the failed runner is still pending, its token
+	// would be accepted.
+	var pending *params.Instance
+	for i := range instances {
+		if instances[i].RunnerStatus == params.RunnerPending && instances[i].Status == commonParams.InstanceRunning {
+			pending = &instances[i]
+			break
+		}
+	}
+	if pending == nil {
+		return fmt.Errorf("no instance of pool %s with a pending runner", bootstrapPoolID)
+	}
+	bootstrap, err := instanceBootstrap(pending.Name)
+	if err != nil {
+		return err
+	}
+
+	bad := []struct {
+		name  string
+		token string
+	}{
+		{"without a token", ""},
+		{"with a malformed token", "not-a-jwt"},
+		{"with a tampered token", tamperToken(bootstrap.InstanceToken)},
+		// Instance routes only take instance tokens.
+		{"with a login token", loginToken()},
+	}
+	var errs []error
+	for _, b := range bad {
+		forged := bootstrap
+		forged.InstanceToken = b.token
+		runner := fakerunner.New(forged, httpClient)
+		if err := expectUnauthorized("a status update "+b.name,
+			runner.SendStatus(runCtx, params.RunnerIdle, "forged", nil)); err != nil {
+			errs = append(errs, err)
+		}
+		_, err := runner.RegistrationToken(runCtx)
+		if err := expectUnauthorized("a registration token fetch "+b.name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	after, err := checkRunner(pending.Name, params.RunnerPending, nil)
+	if err != nil {
+		return err
+	}
+	if len(after.StatusMessages) != len(pending.StatusMessages) {
+		return fmt.Errorf("instance %s recorded forged status messages:\n%s",
+			pending.Name, formatStatusMessages(after.StatusMessages))
+	}
+	return nil
+}
+
+func DeleteBootstrapPool() error {
+	if bootstrapPoolID == "" {
+		return nil
+	}
+	if err := drainPool(bootstrapPoolID); err != nil {
+		return err
+	}
+	log.Println(">>> Delete bootstrap pool")
+	if err := deletePool(cli, authToken, bootstrapPoolID); err != nil {
+		return err
+	}
+	log.Printf("pool %s deleted", bootstrapPoolID)
+	bootstrapPoolID = ""
+	return nil
+}
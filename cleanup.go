@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/cloudbase/garm/params"
+)
+
+// cleanupStack holds the undo actions registered by the steps that create
+// resources. Unwinding runs them in reverse order, so pools are drained and
+// removed before the entities they belong to.
+type cleanupStack struct {
+	mux     sync.Mutex
+	actions []step
+	// unwinding is set while the actions run, a failing one must not start
+	// another unwind.
+	unwinding bool
+}
+
+var cleanups cleanupStack
+
+// push registers the undo action of a resource that was just created.
+func (c *cleanupStack) push(name string, undo func() error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.actions = append(c.actions, step{name: name, run: undo})
+}
+
+func (c *cleanupStack) pop() (step, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.actions) == 0 {
+		return step{}, false
+	}
+	last := c.actions[len(c.actions)-1]
+	c.actions = c.actions[:len(c.actions)-1]
+	return last, true
+}
+
+// unwind runs every registered undo action, last registered first. A failing
+// action is logged and does not stop the remaining ones. Calling it again while
+// it runs does nothing.
+func (c *cleanupStack) unwind() []error {
+	c.mux.Lock()
+	if c.unwinding {
+		c.mux.Unlock()
+		return nil
+	}
+	c.unwinding = true
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		c.unwinding = false
+		c.mux.Unlock()
+	}()
+
+	var errs []error
+	for {
+		action, ok := c.pop()
+		if !ok {
+			return errs
+		}
+		log.Printf(">>> Cleanup: %s", action.name)
+		if err := report.record("unwind", action); err != nil {
+			log.Printf("cleanup %q failed: %v", action.name, err)
+			errs = append(errs, err)
+		}
+	}
+}
+
+// runCtx is cancelled when the process gets SIGINT or SIGTERM. Waiting steps
+// return early, so the main goroutine fails and unwinds the cleanup stack.
+var runCtx = context.Background()
+
+// interruptOnSignal sets up runCtx. After the first signal the default
+// handling is restored, so a second one terminates the process right away.
+func interruptOnSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	runCtx = ctx
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Println("interrupted, cleaning up (send the signal again to exit immediately)")
+	}()
+}
+
+// drainPool disables a pool, removes all of its instances and waits for the
+// pool to be empty, so it can be deleted.
+func drainPool(poolID string) error {
+	if poolID == "" {
+		return nil
+	}
+	enabled := false
+	if _, err := updatePool(cli, authToken, poolID, params.UpdatePoolParams{Enabled: &enabled}); err != nil {
+		return err
+	}
+	instances, err := listPoolInstances(cli, authToken, poolID)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if err := deleteInstance(cli, authToken, instance.Name); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	// The run context may already be cancelled while unwinding, cleanup
+	// still needs to wait for the pool to drain.
+	log.Printf(">>> Wait until pool %s has no instances", poolID)
+	return waitPoolNoInstances(context.Background(), "pool "+poolID, func() (*params.Pool, error) {
+		return getPool(cli, authToken, poolID)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCleanupStackUnwind(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		failing map[string]bool
+		want    []string
+		errs    int
+	}{
+		{name: "empty"},
+		{
+			name:    "last registered first",
+			actions: []string{"repo", "repo pool", "org", "org pool"},
+			want:    []string{"org pool", "org", "repo pool", "repo"},
+		},
+		{
+			name:    "failing actions do not stop the others",
+			actions: []string{"repo", "repo pool", "org"},
+			failing: map[string]bool{"repo pool": true, "org": true},
+			want:    []string{"org", "repo pool", "repo"},
+			errs:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c cleanupStack
+			var ran []string
+			for _, name := range tt.actions {
+				name := name
+				c.push(name, func() error {
+					ran = append(ran, name)
+					if tt.failing[name] {
+						return errors.New(name + " failed")
+					}
+					return nil
+				})
+			}
+			errs := c.unwind()
+			if !reflect.DeepEqual(ran, tt.want) {
+				t.Errorf("unwind() ran %v, want %v", ran, tt.want)
+			}
+			if len(errs) != tt.errs {
+				t.Errorf("unwind() = %v, want %d errors", errs, tt.errs)
+			}
+			// Every action runs once.
+			ran = nil
+			if errs := c.unwind(); len(errs) != 0 || len(ran) != 0 {
+				t.Errorf("second unwind() ran %v and returned %v", ran, errs)
+			}
+		})
+	}
+}
+
+func TestCleanupStackUnwindOnce(t *testing.T) {
+	var c cleanupStack
+	var ran []string
+	for _, name := range []string{"repo", "repo pool", "org"} {
+		name := name
+		c.push(name, func() error {
+			ran = append(ran, name)
+			// Like an action failing the run while it unwinds.
+			if errs := c.unwind(); errs != nil {
+				t.Errorf("unwind() while unwinding = %v", errs)
+			}
+			return nil
+		})
+	}
+	if errs := c.unwind(); len(errs) != 0 {
+		t.Errorf("unwind() = %v", errs)
+	}
+	if want := []string{"org", "repo pool", "repo"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("unwind() ran %v, want %v", ran, want)
+	}
+}
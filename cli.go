@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudbase/garm/params"
+)
+
+// command is a subcommand of the client.
+type command struct {
+	name    string
+	args    string
+	summary string
+	// flags registers the flags specific to the command.
+	flags func(fs *flag.FlagSet)
+	run   func(args []string) error
+}
+
+func commands() []command {
+	var only string
+	var sweep janitorOptions
+	return []command{
+		{
+			name:    "run",
+			summary: "run the suite, or the steps of the scenario file",
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&only, "only", "", "comma separated groups to run, along with the groups they need: "+
+					strings.Join(groupNames(), ", ")+" (repos and orgs are accepted as well)")
+			},
+			run: func(args []string) error {
+				if len(args) > 0 {
+					return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+				}
+				groups, err := selectGroups(only)
+				if err != nil {
+					return err
+				}
+				if only != "" && len(scenario.Steps) > 0 {
+					return fmt.Errorf("--only cannot be used with a scenario listing its own steps")
+				}
+				checked := groups
+				if len(scenario.Steps) > 0 {
+					checked = scenario.groups()
+				}
+				// Misconfigurations fail the run before it creates anything. GARM
+				// is initialized first though, the checks need the admin to log in.
+				runStep(groupInit, step{name: "Preflight", run: func() error { return preflight(checked, true) }})
+				runScenario(groups)
+				return nil
+			},
+		},
+		{
+			name:    "cleanup",
+			summary: "remove the pools of a run, given with --run-id, and the entities of the scenario left unused",
+			run: func(args []string) error {
+				if len(args) > 0 {
+					return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+				}
+				// Without a run ID, cleanup would remove the pools of runs
+				// still going.
+				if runIDGenerated {
+					return fmt.Errorf("cleanup needs the ID of the run to remove, set --run-id; janitor removes what runs older than --older-than leaked")
+				}
+				if err := setup(); err != nil {
+					return err
+				}
+				return cleanupScenario()
+			},
+		},
+		{
+			name:    "janitor",
+			summary: "remove the pools, instances and entities aborted runs leaked",
+			flags: func(fs *flag.FlagSet) {
+				fs.DurationVar(&sweep.OlderThan, "older-than", 3*time.Hour,
+					"only remove pools created at least this long ago, younger ones may belong to runs still going")
+				fs.BoolVar(&sweep.DryRun, "dry-run", false, "print what would be removed, without removing it")
+			},
+			run: func(args []string) error {
+				if len(args) > 0 {
+					return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+				}
+				if err := setup(); err != nil {
+					return err
+				}
+				return janitor(sweep)
+			},
+		},
+		{
+			name:    "preflight",
+			summary: "check that GARM is reachable and has what the scenario needs",
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&only, "only", "", "comma separated groups to check for, along with the groups they need: "+
+					strings.Join(groupNames(), ", "))
+			},
+			run: func(args []string) error {
+				if len(args) > 0 {
+					return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+				}
+				groups, err := selectGroups(only)
+				if err != nil {
+					return err
+				}
+				if len(scenario.Steps) > 0 && only == "" {
+					groups = scenario.groups()
+				}
+				return preflight(groups, false)
+			},
+		},
+		{
+			name:    "list",
+			args:    "<resource>",
+			summary: "print the resources of a kind as JSON: " + strings.Join(listableResources(), ", "),
+			run: func(args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("list needs exactly one resource: %s", strings.Join(listableResources(), ", "))
+				}
+				list, ok := listers[args[0]]
+				if !ok {
+					return fmt.Errorf("unknown resource %q, expected one of: %s", args[0], strings.Join(listableResources(), ", "))
+				}
+				if err := setup(); err != nil {
+					return err
+				}
+				resources, err := list()
+				if err != nil {
+					return err
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(resources)
+			},
+		},
+	}
+}
+
+// globalFlags registers the flags shared by all the commands. Each of them
+// defaults to the environment variable it overrides.
+func globalFlags(fs *flag.FlagSet, scenarioFile *string) {
+	fs.StringVar(&baseURL, "url", baseURL, "GARM base URL, eg: http://garm.example.com:9997 (env GARM_BASE_URL)")
+	fs.StringVar(&caBundle, "ca-bundle", caBundle, "PEM file of the CAs the certificate of GARM is checked against (env GARM_CA_BUNDLE)")
+	fs.StringVar(&clientCert, "client-cert", clientCert, "PEM certificate to authenticate to GARM with, for mutual TLS (env GARM_CLIENT_CERT)")
+	fs.StringVar(&clientKey, "client-key", clientKey, "PEM key of the client certificate (env GARM_CLIENT_KEY)")
+	fs.BoolVar(&insecureSkipVerify, "insecure", insecureSkipVerify, "do not verify the certificate of GARM (env GARM_TLS_INSECURE)")
+	fs.StringVar(&username, "username", username, "GARM admin user name (env GARM_USERNAME)")
+	fs.StringVar(&password, "password", password, "GARM admin password (env GARM_PASSWORD)")
+	fs.StringVar(&fullName, "fullname", fullName, "full name of the admin user created on first run (env GARM_FULLNAME)")
+	fs.StringVar(&email, "email", email, "email of the admin user created on first run (env GARM_EMAIL)")
+	fs.StringVar(&name, "name", name, "name of the garm-cli profile the token is saved under (env GARM_NAME)")
+	fs.StringVar(&credentialsName, "credentials", credentialsName,
+		"GitHub credentials the entities use; <credentials>-clone must exist too (env CREDENTIALS_NAME)")
+	fs.StringVar(&enterpriseCredentialsName, "enterprise-credentials", enterpriseCredentialsName,
+		"GitHub credentials the enterprise uses; <credentials>-clone must exist too (env ENTERPRISE_CREDENTIALS_NAME)")
+	fs.StringVar(&entityKinds, "entities", entityKinds, "comma separated kinds of entities to create: repo, org, enterprise (env GARM_ENTITIES)")
+	fs.StringVar(&repoWebhookSecret, "repo-webhook-secret", repoWebhookSecret, "webhook secret of the repository (env REPO_WEBHOOK_SECRET)")
+	fs.StringVar(&orgWebhookSecret, "org-webhook-secret", orgWebhookSecret, "webhook secret of the organization (env ORG_WEBHOOK_SECRET)")
+	fs.StringVar(&enterpriseWebhookSecret, "enterprise-webhook-secret", enterpriseWebhookSecret,
+		"webhook secret of the enterprise (env ENTERPRISE_WEBHOOK_SECRET)")
+	fs.StringVar(&webhookURL, "webhook-url", webhookURL, "where GitHub webhooks are sent, defaults to <url>/webhooks (env GARM_WEBHOOK_URL)")
+	fs.StringVar(&expiredToken, "expired-token", expiredToken,
+		"a token GARM issued that has expired, forged from the login token when missing (env GARM_EXPIRED_TOKEN)")
+	fs.StringVar(&providerStateFile, "provider-state", providerStateFile,
+		"state file of the fake provider, the bootstrap group reads the tokens of instances from it (env GARM_FAKE_PROVIDER_STATE)")
+	fs.StringVar(&bootstrapProvider, "bootstrap-provider", bootstrapProvider,
+		"provider of the bootstrap pool, its runners must be left to call back (env GARM_BOOTSTRAP_PROVIDER)")
+	fs.DurationVar(&disabledWindow, "disabled-window", disabledWindow,
+		"how long a disabled pool, or one at its cap, is watched, it has to span several pool manager loops (env GARM_DISABLED_WINDOW)")
+	fs.StringVar(&runID, "run-id", runID,
+		"tells the resources of this run apart from those of other runs, generated when missing (env GARM_RUN_ID)")
+	fs.StringVar(&junitReportPath, "junit", junitReportPath, "write a JUnit XML report of the steps to this file (env GARM_JUNIT_REPORT)")
+	fs.StringVar(&jsonReportPath, "json-report", jsonReportPath, "write a JSON report of the steps to this file (env GARM_JSON_REPORT)")
+	fs.StringVar(&recordPath, "record", recordPath, "record the exchanges of the run with GARM to this fixture file (env GARM_RECORD)")
+	fs.StringVar(&replayPath, "replay", replayPath,
+		"replay the exchanges of this fixture file instead of calling GARM, the run has to make the recorded calls (env GARM_REPLAY)")
+	fs.StringVar(&harPath, "har", harPath, "write the HTTP traffic of the run to this HAR file, secrets redacted (env GARM_HAR_FILE)")
+	fs.StringVar(scenarioFile, "scenario", os.Getenv("GARM_SCENARIO"), "YAML file describing the scenario to run (env GARM_SCENARIO)")
+}
+
+// parseEnvSettings reads the settings the environment gives as something else
+// than a string, before the flags they are the defaults of. A value that does
+// not parse fails the run, like a bad flag.
+func parseEnvSettings() error {
+	window, err := envDuration("GARM_DISABLED_WINDOW", disabledWindow)
+	if err != nil {
+		return err
+	}
+	disabledWindow = window
+	return nil
+}
+
+// envDuration parses the duration in the environment variable key, or
+// returns value when it is not set.
+func envDuration(key string, value time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return value, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+// runCommand runs the subcommand named by the first argument. Without one,
+// or when the arguments start with a flag, the run command is used.
+func runCommand(args []string) error {
+	cmds := commands()
+	cmd := cmds[0]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		found := false
+		for _, c := range cmds {
+			if c.name == args[0] {
+				cmd, found = c, true
+				break
+			}
+		}
+		switch {
+		case args[0] == "help":
+			usage(os.Stdout, cmds)
+			return nil
+		case !found:
+			usage(os.Stderr, cmds)
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		args = args[1:]
+	} else if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		usage(os.Stdout, cmds)
+		return nil
+	}
+
+	if err := parseEnvSettings(); err != nil {
+		return err
+	}
+	var scenarioFile string
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	globalFlags(fs, &scenarioFile)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", os.Args[0], cmd.name, cmd.args, capitalize(cmd.summary))
+		fs.PrintDefaults()
+	}
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	if replayPath != "" {
+		if err := startReplay(replayPath); err != nil {
+			return err
+		}
+	}
+	if err := resolveRunID(); err != nil {
+		return err
+	}
+	scenario = defaultScenario()
+	if scenarioFile != "" {
+		loaded, err := loadScenario(scenarioFile)
+		if err != nil {
+			return err
+		}
+		scenario = loaded
+	}
+	if err := initClient(); err != nil {
+		return err
+	}
+	return cmd.run(positional)
+}
+
+// parseFlags parses args, allowing flags after the positional arguments, eg:
+// list repos --url http://garm:9997.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func usage(w io.Writer, cmds []command) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nExercises the GARM API through its swagger client.\n\nCommands:\n", os.Args[0])
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-16s %s\n", strings.TrimSpace(c.name+" "+c.args), c.summary)
+	}
+	fmt.Fprintf(w, "\nWithout a command, run is used. Flags override the environment variables\nthey default to, run '%s <command> --help' to list them.\n", os.Args[0])
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// groupAliases are the short names accepted by run --only.
+var groupAliases = map[string]string{
+	"repos": groupRepositories,
+	"orgs":  groupOrganizations,
+}
+
+func groupNames() []string {
+	var names []string
+	for _, g := range suite() {
+		if g.name != groupInit && g.name != groupCleanup {
+			names = append(names, g.name)
+		}
+	}
+	return names
+}
+
+// selectGroups returns the groups to run, in suite order, with the steps of
+// the selected entities. The init and cleanup groups always run, as do the
+// groups the selected ones require, unless they create entities that are not
+// selected. Naming a group creating an entity selects the entity. Without a
+// selection, every group but bootstrap is returned.
+func selectGroups(only string) ([]group, error) {
+	all := suite()
+	byName := map[string]group{}
+	for _, g := range all {
+		byName[g.name] = g
+	}
+	entities, err := parseEntityKinds(entityKinds)
+	if err != nil {
+		return nil, err
+	}
+	var asked []string
+	for _, name := range strings.Split(only, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if alias, ok := groupAliases[name]; ok {
+			name = alias
+		}
+		if _, ok := byName[name]; !ok {
+			return nil, fmt.Errorf("unknown group %q, expected one of: %s", name, strings.Join(groupNames(), ", "))
+		}
+		if kind, ok := entityGroups[name]; ok {
+			entities[kind] = true
+		}
+		asked = append(asked, name)
+	}
+
+	selected := map[string]bool{groupInit: true, groupCleanup: true}
+	var add func(name string)
+	add = func(name string) {
+		if kind, ok := entityGroups[name]; ok && !entities[kind] {
+			return
+		}
+		if selected[name] {
+			return
+		}
+		selected[name] = true
+		for _, req := range byName[name].requires {
+			add(req)
+		}
+	}
+	if only == "" {
+		for _, g := range all {
+			// The bootstrap flow needs a provider whose runners call
+			// back. It has to be asked for.
+			if g.name != groupBootstrap {
+				add(g.name)
+			}
+		}
+	}
+	for _, name := range asked {
+		add(name)
+	}
+
+	var groups []group
+	for _, g := range all {
+		if selected[g.name] {
+			groups = append(groups, g)
+		}
+	}
+	groups = filterEntities(groups, entities)
+	for _, name := range asked {
+		found := false
+		for _, g := range groups {
+			found = found || g.name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("group %s has no steps for the selected entities (%s), see --entities", name, entityKinds)
+		}
+	}
+	return groups, nil
+}
+
+// setup initializes GARM if needed and logs in.
+func setup() error {
+	if err := FirstRun(); err != nil {
+		return err
+	}
+	return Login()
+}
+
+// listers fetch the resources the list command prints.
+var listers = map[string]func() (interface{}, error){
+	"credentials": func() (interface{}, error) { return listCredentials(cli, authToken) },
+	"providers":   func() (interface{}, error) { return listProviders(cli, authToken) },
+	"jobs":        func() (interface{}, error) { return listJobs(cli, authToken) },
+	"pools":       func() (interface{}, error) { return listPools(cli, authToken) },
+	"instances":   func() (interface{}, error) { return listInstances(cli, authToken) },
+	"repos":       func() (interface{}, error) { return listPayloads(repo) },
+	"orgs":        func() (interface{}, error) { return listPayloads(org) },
+	"enterprises": func() (interface{}, error) { return listPayloads(enterprise) },
+}
+
+func listableResources() []string {
+	names := make([]string, 0, len(listers))
+	for name := range listers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func listPayloads(e Entity) (interface{}, error) {
+	entities, err := e.List()
+	if err != nil {
+		return nil, err
+	}
+	return payloads(entities), nil
+}
+
+// cleanupScenario removes the pools the run given with --run-id created on
+// the entities named in the scenario, with their instances, then the entities
+// no other pools use. It is meant for runs that were killed before they could
+// clean up after themselves.
+func cleanupScenario() error {
+	tag := runTag()
+	var errs []error
+	for _, e := range []Entity{repo, org, enterprise} {
+		entities, err := e.List()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, entity := range entities {
+			if !sameEntityName(entity.Name, e.Name()) {
+				continue
+			}
+			if err := cleanupEntity(e, entity, tag); err != nil {
+				errs = append(errs, fmt.Errorf("cleaning up %s %s: %w", e.Kind(), entity.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cleanupEntity removes the pools of entity tagged with tag, then entity if
+// it was created by the same run and no other pools are left.
+func cleanupEntity(e Entity, entity EntityInfo, tag string) error {
+	log.Printf(">>> Cleanup %s %s", e.Kind(), entity.Name)
+	pools, err := e.ListPools(entity.ID)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if !poolTagged(pool, tag) || isOwnerMarker(pool) {
+			continue
+		}
+		if err := drainPool(pool.ID); err != nil {
+			return err
+		}
+		if err := e.DeletePool(entity.ID, pool.ID); err != nil {
+			return err
+		}
+		log.Printf("%s pool %s deleted", e.Kind(), pool.ID)
+	}
+	deleted, err := deleteOwnedEntity(e, entity.ID, func(pool params.Pool) bool {
+		return poolTagged(pool, tag)
+	})
+	if err != nil {
+		return err
+	}
+	if deleted {
+		log.Printf("%s %s deleted", e.Kind(), entity.ID)
+	}
+	return nil
+}
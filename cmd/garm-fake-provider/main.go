@@ -0,0 +1,87 @@
+// Command garm-fake-provider is a GARM external provider reporting synthetic
+// instances, so a real GARM server can run the suite without LXD. Point GARM
+// at it in its config:
+//
+//	[[provider]]
+//	name = "fake"
+//	provider_type = "external"
+//	description = "synthetic instances"
+//	  [provider.external]
+//	  provider_executable = "/usr/local/bin/garm-fake-provider"
+//	  config_file = "/etc/garm/fake-provider.toml"
+//
+// See the fakeprovider package for the settings of the config file.
+//
+// GARM never hears from the runners of those instances, unless the provider
+// also runs as a daemon playing them, with the same config file:
+//
+//	garm-fake-provider simulate-runners -config /etc/garm/fake-provider.toml
+//
+// The daemon plays the runners of every controller sharing the state file,
+// or only those of the controller given with -controller-id.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cloudbase/garm-provider-common/execution"
+
+	"garm-test-client/fakeprovider"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 && os.Args[1] == "simulate-runners" {
+		if err := simulateRunners(ctx, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error encountered: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	env, err := execution.GetEnvironment()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error encountered: %v\n", err)
+		os.Exit(1)
+	}
+	cfg, err := fakeprovider.LoadConfig(env.ProviderConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error encountered: %v\n", err)
+		os.Exit(1)
+	}
+
+	result, err := execution.Run(ctx, fakeprovider.NewProvider(cfg, env.ControllerID), env)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error encountered: %v\n", err)
+		os.Exit(execution.ResolveErrorToExitCode(err))
+	}
+	if result != "" {
+		fmt.Fprint(os.Stdout, result)
+	}
+}
+
+func simulateRunners(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("simulate-runners", flag.ExitOnError)
+	configFile := flags.String("config", "", "provider config file")
+	controllerID := flags.String("controller-id", "", "only play the runners of this controller")
+	flags.Parse(args)
+
+	if *configFile == "" {
+		return fmt.Errorf("-config is required")
+	}
+	cfg, err := fakeprovider.LoadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if cfg.StateFile == "" && *controllerID == "" {
+		return fmt.Errorf("state_file must be set in %s, or -controller-id given", *configFile)
+	}
+	return fakeprovider.NewProvider(cfg, *controllerID).SimulateRunners(ctx, nil)
+}
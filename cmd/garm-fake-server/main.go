@@ -0,0 +1,99 @@
+// Command garm-fake-server serves the in-memory fake GARM API, so the test
+// client can be pointed at it with GARM_BASE_URL instead of a live GARM.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"garm-test-client/fakegarm"
+)
+
+func main() {
+	var (
+		listen      = flag.String("listen", "127.0.0.1:9997", "address to listen on")
+		credentials = flag.String("credentials", defaultCredentials(), "comma separated list of GitHub credentials names to expose")
+		tick        = flag.Duration("tick", fakegarm.DefaultConfig().TickInterval, "interval at which instances advance through their lifecycle")
+		callbackURL = flag.String("callback-url", "", "where runners of external providers post their status, defaults to http://<listen>/api/v1/callbacks")
+		metadataURL = flag.String("metadata-url", "", "where runners of external providers fetch their metadata, defaults to http://<listen>/api/v1/metadata")
+		tlsCert     = flag.String("tls-cert", "", "PEM certificate to serve HTTPS with")
+		tlsKey      = flag.String("tls-key", "", "PEM key of the certificate")
+		clientCA    = flag.String("tls-client-ca", "", "PEM file of the CAs client certificates must be signed by, for mutual TLS")
+	)
+	flag.Parse()
+
+	var names []string
+	for _, name := range strings.Split(*credentials, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	scheme := "http"
+	if *tlsCert != "" {
+		scheme = "https"
+	}
+	cfg := fakegarm.DefaultConfig(names...)
+	cfg.TickInterval = *tick
+	cfg.CallbackURL = *callbackURL
+	if cfg.CallbackURL == "" {
+		cfg.CallbackURL = scheme + "://" + *listen + "/api/v1/callbacks"
+	}
+	cfg.MetadataURL = *metadataURL
+	if cfg.MetadataURL == "" {
+		cfg.MetadataURL = scheme + "://" + *listen + "/api/v1/metadata"
+	}
+
+	srv := fakegarm.NewServer(cfg)
+	defer srv.Close()
+
+	server := &http.Server{Addr: *listen, Handler: srv}
+	log.Printf("fake GARM listening on %s://%s", scheme, *listen)
+	var err error
+	if *tlsCert != "" {
+		if server.TLSConfig, err = clientAuth(*clientCA); err != nil {
+			log.Fatalf("error encountered: %v", err)
+		}
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatalf("error encountered: %v", err)
+	}
+}
+
+// clientAuth requires client certificates signed by the CAs of caFile, when
+// set.
+func clientAuth(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", caFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}, nil
+}
+
+// defaultCredentials exposes CREDENTIALS_NAME and ENTERPRISE_CREDENTIALS_NAME,
+// with the "-clone" counterparts the client switches to when updating
+// entities.
+func defaultCredentials() string {
+	var names []string
+	for _, name := range []string{os.Getenv("CREDENTIALS_NAME"), os.Getenv("ENTERPRISE_CREDENTIALS_NAME")} {
+		if name != "" {
+			names = append(names, name, fmt.Sprintf("%s-clone", name))
+		}
+	}
+	return strings.Join(names, ",")
+}
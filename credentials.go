@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/cloudbase/garm/params"
+	"github.com/google/uuid"
+)
+
+// setCredentials switches e to the named credentials and checks GARM returns
+// them for e from then on.
+func setCredentials(e Entity, name string) error {
+	id := e.State().id
+	if _, err := e.Update(id, params.UpdateEntityParams{CredentialsName: name}); err != nil {
+		return err
+	}
+	info, err := e.Get(id)
+	if err != nil {
+		return err
+	}
+	if info.CredentialsName != name {
+		return fmt.Errorf("%s %s has credentials %q, expected %q", e.Kind(), id, info.CredentialsName, name)
+	}
+	log.Printf("%s %s uses credentials %q", e.Kind(), id, name)
+	return nil
+}
+
+// poolIDs returns the IDs of the pools of info.
+func poolIDs(info EntityInfo) map[string]bool {
+	ids := map[string]bool{}
+	for _, pool := range info.Pools {
+		ids[pool.ID] = true
+	}
+	return ids
+}
+
+// //////////////////////
+// Credential rotation //
+// //////////////////////
+func RotateEntityCredentials(e Entity) error {
+	info, err := e.Get(e.State().id)
+	if err != nil {
+		return err
+	}
+	// Switch between the credentials the entity is created and updated
+	// with, whichever it does not have.
+	rotated := updateCredentialsName(e)
+	if info.CredentialsName == rotated {
+		rotated = e.CredentialsName()
+	}
+	log.Printf(">>> Rotate %s credentials from %q to %q", e.Kind(), info.CredentialsName, rotated)
+	if err := setCredentials(e, rotated); err != nil {
+		return err
+	}
+	e.State().rotatedFrom = info.CredentialsName
+	return nil
+}
+
+// ReplaceEntityInstanceAfterRotation deletes an idle instance of the pool of
+// e and waits for a new runner to register in its place, with the rotated
+// credentials.
+func ReplaceEntityInstanceAfterRotation(e Entity) error {
+	state := e.State()
+	owner := e.Kind() + " pool " + state.poolID
+	list := func() (params.Instances, error) {
+		return listPoolInstances(cli, authToken, state.poolID)
+	}
+	old, err := waitIdleInstance(runCtx, owner, list)
+	if err != nil {
+		return err
+	}
+	known, err := poolInstanceNames(e)
+	if err != nil {
+		return err
+	}
+	if err := DeleteInstance(old.Name); err != nil {
+		return err
+	}
+
+	log.Printf(">>> Wait for a new runner of %s pool to register", e.Kind())
+	_, err = poll(runCtx, "a new, idle instance of "+owner, defaultPoll, list, func(instances params.Instances) bool {
+		for _, instance := range instances {
+			if !known[instance.Name] && instance.RunnerStatus == params.RunnerIdle {
+				state.instanceName = instance.Name
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("runner of %s registered", state.instanceName)
+	return nil
+}
+
+func RejectEntityUnknownCredentials(e Entity) error {
+	id := e.State().id
+	before, err := e.Get(id)
+	if err != nil {
+		return err
+	}
+	unknown := "garm-test-client-missing-" + uuid.NewString()[:8]
+	log.Printf(">>> Rotate %s credentials to unknown credentials %q", e.Kind(), unknown)
+	_, err = e.Update(id, params.UpdateEntityParams{CredentialsName: unknown})
+	if err := expectAPIError(err, http.StatusBadRequest, apiErrorBadRequest); err != nil {
+		return fmt.Errorf("%s with unknown credentials: %w", "Update"+title(e), err)
+	}
+
+	after, err := e.Get(id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case after.CredentialsName != before.CredentialsName:
+		return fmt.Errorf("%s %s has credentials %q after a rejected rotation, expected %q",
+			e.Kind(), id, after.CredentialsName, before.CredentialsName)
+	case after.Name != before.Name:
+		return fmt.Errorf("%s %s is named %q after a rejected rotation, expected %q", e.Kind(), id, after.Name, before.Name)
+	}
+	pools := poolIDs(after)
+	for poolID := range poolIDs(before) {
+		if !pools[poolID] {
+			return fmt.Errorf("%s %s lost pool %s after a rejected rotation", e.Kind(), id, poolID)
+		}
+	}
+	log.Printf("%s %s left as it was", e.Kind(), id)
+	return nil
+}
+
+func RestoreEntityCredentials(e Entity) error {
+	state := e.State()
+	name := state.rotatedFrom
+	if name == "" {
+		return fmt.Errorf("the %s credentials were not rotated", e.Kind())
+	}
+	log.Printf(">>> Switch %s back to credentials %q", e.Kind(), name)
+	if err := setCredentials(e, name); err != nil {
+		return err
+	}
+	state.rotatedFrom = ""
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cloudbase/garm/params"
+	"github.com/google/uuid"
+)
+
+// poolManagerLoop is how often the pool manager of GARM goes over its pools.
+const poolManagerLoop = 5 * time.Second
+
+// disabledWindow is how long a disabled pool is watched for new instances,
+// and a pool at its cap for more. It has to span several loops of the pool
+// manager, and the 30s GARM leaves a queued job to the idle runners before
+// creating one for it.
+var disabledWindow = 2 * time.Minute
+
+// disabledPoll is how long watchPoolInstances waits between two looks at the
+// pool. The number of looks only depends on disabledWindow, so replayed runs
+// make the calls of the recorded ones.
+var disabledPoll = poolManagerLoop
+
+// disabledPoolJobs are the jobs queued while the pool of an entity was
+// disabled, by entity kind.
+var disabledPoolJobs = map[string][]int64{}
+
+// poolInstanceNames returns the names of the instances of the pool of e.
+func poolInstanceNames(e Entity) (map[string]bool, error) {
+	instances, err := listPoolInstances(cli, authToken, e.State().poolID)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, instance := range instances {
+		names[instance.Name] = true
+	}
+	return names, nil
+}
+
+// watchPoolInstances hands the instances of the pool of e to look for
+// disabledWindow, once per loop of the pool manager, and returns how many
+// looks it took. It stops at the first error look returns.
+func watchPoolInstances(e Entity, look func([]params.Instance) error) (int, error) {
+	state := e.State()
+	polls := int(disabledWindow / poolManagerLoop)
+	if polls < 1 {
+		polls = 1
+	}
+	for i := 0; i < polls; i++ {
+		select {
+		case <-runCtx.Done():
+			return i, runCtx.Err()
+		case <-time.After(disabledPoll):
+		}
+		instances, err := listPoolInstances(cli, authToken, state.poolID)
+		if err != nil {
+			return i, err
+		}
+		if err := look(instances); err != nil {
+			return i, err
+		}
+	}
+	return polls, nil
+}
+
+// checkNoNewInstances checks, for disabledWindow, that the pool of e creates
+// no instance but those of known.
+func checkNoNewInstances(e Entity, known map[string]bool) error {
+	polls, err := watchPoolInstances(e, func(instances []params.Instance) error {
+		for _, instance := range instances {
+			if !known[instance.Name] {
+				return fmt.Errorf("disabled %s pool %s created instance %s", e.Kind(), e.State().poolID, instance.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s pool created no instance in %d pool manager loops", e.Kind(), polls)
+	return nil
+}
+
+// getJob returns the job GARM lists with the given ID.
+func getJob(jobID int64) (params.Job, error) {
+	jobs, err := listJobs(cli, authToken)
+	if err != nil {
+		return params.Job{}, err
+	}
+	for _, job := range jobs {
+		if job.ID == jobID {
+			return job, nil
+		}
+	}
+	return params.Job{}, fmt.Errorf("GARM does not list job %d", jobID)
+}
+
+// waitJobLocked waits until the pool manager of e locks the job, which it does
+// when it creates a runner for it.
+func waitJobLocked(e Entity, jobID int64) error {
+	state := e.State()
+	_, err := poll(runCtx, fmt.Sprintf("job %d to be locked by %s %s", jobID, e.Kind(), state.id), defaultPoll, func() (params.Job, error) {
+		return getJob(jobID)
+	}, func(job params.Job) bool {
+		return job.LockedBy.String() == state.id
+	})
+	return err
+}
+
+// pickUpJob plays GitHub handing the queued job to runnerName, and checks
+// GARM marks the runner active for it. The job is then completed.
+func pickUpJob(e Entity, jobID int64, runnerName string) error {
+	labels, err := poolLabels(e)
+	if err != nil {
+		return err
+	}
+	job, target := workflowJobEvent(e, "in_progress", jobID, labels, runnerName)
+	if err := sendWebhook(target, e.State().webhookSecret, job); err != nil {
+		return err
+	}
+	if err := waitJob(jobID, "in_progress"); err != nil {
+		return err
+	}
+	recorded, err := getJob(jobID)
+	if err != nil {
+		return err
+	}
+	if recorded.RunnerName != runnerName {
+		return fmt.Errorf("job %d runs on %q, want %s", jobID, recorded.RunnerName, runnerName)
+	}
+	if _, err := poll(runCtx, "runner "+runnerName+" to be active", defaultPoll, func() (*params.Instance, error) {
+		return getInstance(cli, authToken, runnerName)
+	}, func(instance *params.Instance) bool {
+		return instance.RunnerStatus == params.RunnerActive
+	}); err != nil {
+		return err
+	}
+
+	job, target = workflowJobEvent(e, "completed", jobID, labels, runnerName)
+	if err := sendWebhook(target, e.State().webhookSecret, job); err != nil {
+		return err
+	}
+	return waitJob(jobID, "completed")
+}
+
+func setPoolEnabled(e Entity, enabled bool) (*params.Pool, error) {
+	state := e.State()
+	return e.UpdatePool(state.id, state.poolID, params.UpdatePoolParams{Enabled: &enabled})
+}
+
+// /////////////////
+// Disabled pools //
+// /////////////////
+func DisableEntityPoolNoReplacement(e Entity) error {
+	state := e.State()
+	pool, err := e.GetPool(state.id, state.poolID)
+	if err != nil {
+		return err
+	}
+	if pool.MinIdleRunners == 0 {
+		return fmt.Errorf("the %s pool has no min idle runners, GARM would not replace its instances anyway", e.Kind())
+	}
+	victim, err := waitIdleInstance(runCtx, e.Kind()+" pool "+state.poolID, func() (params.Instances, error) {
+		return listPoolInstances(cli, authToken, state.poolID)
+	})
+	if err != nil {
+		return err
+	}
+	known, err := poolInstanceNames(e)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(">>> Disable %s pool with %d min idle runners", e.Kind(), pool.MinIdleRunners)
+	if _, err := setPoolEnabled(e, false); err != nil {
+		return err
+	}
+	if err := DeleteInstance(victim.Name); err != nil {
+		return err
+	}
+	log.Printf(">>> Check the disabled %s pool does not replace %s", e.Kind(), victim.Name)
+	return checkNoNewInstances(e, known)
+}
+
+func QueueEntityJobDisabledPool(e Entity) error {
+	log.Printf(">>> Queue a job for the disabled %s pool", e.Kind())
+	ids, err := queueJobs(e, 1)
+	disabledPoolJobs[e.Kind()] = append(disabledPoolJobs[e.Kind()], ids...)
+	if err != nil {
+		return err
+	}
+	if err := waitJob(ids[0], "queued"); err != nil {
+		return err
+	}
+	known, err := poolInstanceNames(e)
+	if err != nil {
+		return err
+	}
+	log.Printf(">>> Check the disabled %s pool does not pick up job %d", e.Kind(), ids[0])
+	if err := checkNoNewInstances(e, known); err != nil {
+		return err
+	}
+	job, err := getJob(ids[0])
+	if err != nil {
+		return err
+	}
+	if job.Status != "queued" || job.LockedBy != uuid.Nil {
+		return fmt.Errorf("disabled %s pool took job %d: it is %s and locked by %s", e.Kind(), job.ID, job.Status, job.LockedBy)
+	}
+	return nil
+}
+
+func EnableEntityPoolPickUpJob(e Entity) error {
+	state := e.State()
+	ids := disabledPoolJobs[e.Kind()]
+	if len(ids) == 0 {
+		return fmt.Errorf("no job was queued for the disabled %s pool", e.Kind())
+	}
+	log.Printf(">>> Enable %s pool", e.Kind())
+	pool, err := setPoolEnabled(e, true)
+	if err != nil {
+		return err
+	}
+	wanted := pool.MinIdleRunners + uint(len(ids))
+	counts, err := waitPoolCounts(e, fmt.Sprintf("%d runners for its min idle runners and queued jobs", wanted), func(c poolCounts) bool {
+		return c.total >= wanted
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s pool has %s", e.Kind(), counts)
+	for _, id := range ids {
+		if err := waitJobLocked(e, id); err != nil {
+			return err
+		}
+	}
+
+	// GitHub hands the job to any idle runner with its labels.
+	runner, err := waitIdleInstance(runCtx, e.Kind()+" pool "+state.poolID, func() (params.Instances, error) {
+		return listPoolInstances(cli, authToken, state.poolID)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf(">>> Check runner %s of the %s pool picks up job %d", runner.Name, e.Kind(), ids[0])
+	if err := pickUpJob(e, ids[0], runner.Name); err != nil {
+		return err
+	}
+
+	if err := cancelJobs(e, ids[1:]); err != nil {
+		return err
+	}
+	delete(disabledPoolJobs, e.Kind())
+	return waitScaledDown(e, poolLimits{minIdle: pool.MinIdleRunners, maxRunners: pool.MaxRunners})
+}
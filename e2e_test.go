@@ -0,0 +1,324 @@
+//go:build e2e
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"garm-test-client/fakegarm"
+)
+
+// The e2e suite runs against the GARM server at GARM_BASE_URL. When it is not
+// set, an in-memory fake GARM is started instead. With GARM_RECORD, the
+// exchanges with GARM are recorded to a fixture file, which GARM_REPLAY
+// replays without any server, to check the client against a new GARM module:
+//
+//	go test -tags e2e -v ./...
+//	go test -tags e2e -run 'TestE2E/(repositories|pools)' ./...
+//	GARM_REPLAY=testdata/replay/fake-suite.json go test -tags e2e ./...
+func TestMain(m *testing.M) {
+	os.Exit(runE2E(m))
+}
+
+func runE2E(m *testing.M) int {
+	switch {
+	case replayPath != "":
+		stop, err := startE2EReplay()
+		if err != nil {
+			log.Printf("failed to start replaying %s: %v", replayPath, err)
+			return 1
+		}
+		defer stop()
+	case baseURL == "":
+		stop, err := startFakeGarm()
+		if err != nil {
+			log.Printf("failed to start fake GARM: %v", err)
+			return 1
+		}
+		defer stop()
+	}
+	if err := parseEnvSettings(); err != nil {
+		log.Printf("failed to read the settings: %v", err)
+		return 1
+	}
+	if err := resolveRunID(); err != nil {
+		log.Printf("failed to resolve the run ID: %v", err)
+		return 1
+	}
+	scenario = defaultScenario()
+	if err := initClient(); err != nil {
+		log.Printf("failed to initialize client: %v", err)
+		return 1
+	}
+	code := m.Run()
+	writeReports()
+	if err := checkReplayed(); err != nil && code == 0 {
+		log.Print(err)
+		return 1
+	}
+	return code
+}
+
+// useE2EHome keeps the garm-cli config of the suite away from the real one.
+func useE2EHome() (func(), error) {
+	home, err := os.MkdirTemp("", "garm-e2e-")
+	if err != nil {
+		return nil, err
+	}
+	// The go tool keeps its build cache under the home too, and building the
+	// client from a cold one takes minutes.
+	if os.Getenv("GOCACHE") == "" {
+		if cache, err := os.UserCacheDir(); err == nil {
+			os.Setenv("GOCACHE", filepath.Join(cache, "go-build"))
+		}
+	}
+	if err := os.Setenv("HOME", home); err != nil {
+		return nil, err
+	}
+	return func() { os.RemoveAll(home) }, nil
+}
+
+// setE2EDefaults fills in any of the settings the suite needs that are
+// missing from the environment.
+func setE2EDefaults() {
+	setDefault := func(v *string, value string) {
+		if *v == "" {
+			*v = value
+		}
+	}
+	setDefault(&username, "admin")
+	setDefault(&password, "e2e-password")
+	setDefault(&fullName, "E2E Admin")
+	setDefault(&email, "admin@example.com")
+	setDefault(&name, "e2e-fake")
+	setDefault(&credentialsName, "e2e-credentials")
+	setDefault(&repoWebhookSecret, "e2e-repo-secret")
+	setDefault(&orgWebhookSecret, "e2e-org-secret")
+	setDefault(&enterpriseWebhookSecret, "e2e-enterprise-secret")
+	setDefault(&enterpriseCredentialsName, "e2e-enterprise-credentials")
+	if os.Getenv("GARM_ENTITIES") == "" {
+		entityKinds = "repo,org,enterprise"
+	}
+	if os.Getenv("GARM_DISABLED_WINDOW") == "" {
+		disabledWindow = 3 * poolManagerLoop
+	}
+}
+
+// startE2EReplay replays the fixture at replayPath, with the settings of the
+// fake GARM the fixtures are recorded against.
+func startE2EReplay() (func(), error) {
+	removeHome, err := useE2EHome()
+	if err != nil {
+		return nil, err
+	}
+	setE2EDefaults()
+	if err := startReplay(replayPath); err != nil {
+		removeHome()
+		return nil, err
+	}
+	return removeHome, nil
+}
+
+// startFakeGarm serves a fake GARM on a local port, with the settings of
+// setE2EDefaults.
+func startFakeGarm() (func(), error) {
+	removeHome, err := useE2EHome()
+	if err != nil {
+		return nil, err
+	}
+	setE2EDefaults()
+
+	// The listener comes first: runners need the URL of the server to call
+	// it back.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		removeHome()
+		return nil, err
+	}
+	serverURL := "http://" + listener.Addr().String()
+	cfg := fakegarm.DefaultConfig(credentialsName, credentialsName+"-clone",
+		enterpriseCredentialsName, enterpriseCredentialsName+"-clone")
+	cfg.CallbackURL = serverURL + "/api/v1/callbacks"
+	cfg.MetadataURL = serverURL + "/api/v1/metadata"
+
+	srv := fakegarm.NewServer(cfg)
+	if expiredToken == "" {
+		token, err := srv.ExpiredToken()
+		if err != nil {
+			listener.Close()
+			srv.Close()
+			removeHome()
+			return nil, err
+		}
+		expiredToken = token
+	}
+	ts := httptest.NewUnstartedServer(srv)
+	ts.Listener.Close()
+	ts.Listener = listener
+	ts.Start()
+	baseURL = ts.URL
+	bootstrapSource = srv.Bootstrap
+	// The fake GARM goes over its pools every tick, not every poolManagerLoop.
+	disabledPoll = 2 * cfg.TickInterval
+
+	return func() {
+		ts.Close()
+		srv.Close()
+		removeHome()
+	}, nil
+}
+
+func TestE2E(t *testing.T) {
+	entities, err := parseEntityKinds(entityKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := filterEntities(suite(), entities)
+	groups := map[string]group{}
+	for _, g := range all {
+		groups[g.name] = g
+	}
+
+	ran := map[string]bool{}
+	// setup runs a group the selected one depends on, outside of any subtest.
+	var setup func(t *testing.T, name string)
+	setup = func(t *testing.T, name string) {
+		if ran[name] {
+			return
+		}
+		ran[name] = true
+		for _, req := range groups[name].requires {
+			setup(t, req)
+		}
+		for _, s := range groups[name].steps {
+			if s.skipReason() != "" {
+				continue
+			}
+			if err := s.run(); err != nil {
+				t.Fatalf("setup of group %s failed at %s: %v", name, s.name, err)
+			}
+		}
+	}
+
+	var checked []group
+	for _, g := range all {
+		if e2eSkipped(g.name) == "" {
+			checked = append(checked, g)
+		}
+	}
+	if err := preflight(checked, true); err != nil {
+		t.Fatal(err)
+	}
+	setup(t, groupInit)
+	t.Cleanup(func() {
+		for _, s := range groups[groupCleanup].steps {
+			if err := s.run(); err != nil {
+				t.Errorf("cleanup step %s failed: %v", s.name, err)
+			}
+		}
+		for _, err := range cleanups.unwind() {
+			t.Errorf("cleanup failed: %v", err)
+		}
+	})
+
+	for _, g := range all {
+		if g.name == groupInit || g.name == groupCleanup {
+			continue
+		}
+		g := g
+		t.Run(g.name, func(t *testing.T) {
+			if reason := e2eSkipped(g.name); reason != "" {
+				t.Skip(reason)
+			}
+			for _, req := range g.requires {
+				setup(t, req)
+			}
+			ran[g.name] = true
+			for _, s := range g.steps {
+				if !t.Run(s.name, func(t *testing.T) {
+					if reason := s.skipReason(); reason != "" {
+						t.Skip(reason)
+					}
+					if err := s.run(); err != nil {
+						t.Fatal(err)
+					}
+				}) {
+					// Later steps of a group build on the earlier ones.
+					t.FailNow()
+				}
+			}
+		})
+	}
+}
+
+// e2eSkipped tells why the named group cannot run, if it cannot.
+func e2eSkipped(name string) string {
+	if name == groupBootstrap && !canBootstrap() {
+		return "GARM_FAKE_PROVIDER_STATE is not set"
+	}
+	return ""
+}
+
+// TestE2EConcurrentRuns runs the suite twice at once against the same GARM,
+// the way two CI jobs sharing it would, through the client binary: a run
+// keeps its settings in globals.
+func TestE2EConcurrentRuns(t *testing.T) {
+	if replayPath != "" || recordPath != "" {
+		t.Skip("fixtures hold the exchanges of a single run")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "garm-test-client")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building the client: %v\n%s", err, out)
+	}
+
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"GARM_BASE_URL=" + baseURL,
+		"GARM_USERNAME=" + username,
+		"GARM_PASSWORD=" + password,
+		"GARM_FULLNAME=" + fullName,
+		"GARM_EMAIL=" + email,
+		"GARM_NAME=" + name,
+		"GARM_ENTITIES=" + entityKinds,
+		"CREDENTIALS_NAME=" + credentialsName,
+		"ENTERPRISE_CREDENTIALS_NAME=" + enterpriseCredentialsName,
+		"REPO_WEBHOOK_SECRET=" + repoWebhookSecret,
+		"ORG_WEBHOOK_SECRET=" + orgWebhookSecret,
+		"ENTERPRISE_WEBHOOK_SECRET=" + enterpriseWebhookSecret,
+		"GARM_EXPIRED_TOKEN=" + expiredToken,
+		"GARM_WEBHOOK_URL=" + webhookURL,
+	}
+	var wg sync.WaitGroup
+	for i := 1; i <= 2; i++ {
+		id := fmt.Sprintf("%s-concurrent-%d", runID, i)
+		home := filepath.Join(dir, id)
+		if err := os.Mkdir(home, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(bin, "run", "--only", "instances,pools,webhooks", "--run-id", id)
+		cmd.Env = append(env, "HOME="+home)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cmd.Wait(); err != nil {
+				t.Errorf("run %s failed: %v\n%s", id, err, out.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	clientEnterprises "github.com/cloudbase/garm/client/enterprises"
+	clientOrganizations "github.com/cloudbase/garm/client/organizations"
+	clientRepositories "github.com/cloudbase/garm/client/repositories"
+	"github.com/cloudbase/garm/params"
+)
+
+// Entity is something GARM can attach runner pools to: a repository, an
+// organization or an enterprise. The implementations wrap the matching
+// swagger client package, so a scenario can be written once and run against
+// any entity type.
+type Entity interface {
+	// Kind is the short name used in logs and step names: repo, org or
+	// enterprise.
+	Kind() string
+	// Name is the name the entity is created with. For repositories it is
+	// owner/name.
+	Name() string
+	// State holds the IDs of the resources the suite works with.
+	State() *entityState
+	// WebhookSecret is the secret the entity is created with.
+	WebhookSecret() string
+	// CredentialsName names the GitHub credentials the entity is created
+	// with.
+	CredentialsName() string
+	// WebhookTarget fills in the fields of a workflow_job payload naming the
+	// entity and returns the hook installation target type GitHub sends
+	// along with it.
+	WebhookTarget(job *params.WorkflowJob) string
+
+	Create(credentialsName string) (EntityInfo, error)
+	List() ([]EntityInfo, error)
+	Get(id string) (EntityInfo, error)
+	Update(id string, updateParams params.UpdateEntityParams) (EntityInfo, error)
+	Delete(id string) error
+
+	CreatePool(id string, poolParams params.CreatePoolParams) (*params.Pool, error)
+	ListPools(id string) (params.Pools, error)
+	GetPool(id, poolID string) (*params.Pool, error)
+	UpdatePool(id, poolID string, poolParams params.UpdatePoolParams) (*params.Pool, error)
+	DeletePool(id, poolID string) error
+	ListInstances(id string) (params.Instances, error)
+}
+
+// EntityInfo is the part of a repository, organization or enterprise that is
+// common to all of them.
+type EntityInfo struct {
+	ID              string
+	Name            string
+	CredentialsName string
+	Pools           []params.Pool
+	// Payload is the object returned by the API, as is.
+	Payload interface{}
+}
+
+// entityState tracks the resources the suite created for, or found on, an
+// entity.
+type entityState struct {
+	id            string
+	poolID        string
+	instanceName  string
+	webhookSecret string
+	// jobID is the workflow job sent through the webhook.
+	jobID int64
+	// owned is set when the run created the entity. Entities other runs
+	// created are shared: the run neither updates nor deletes them.
+	owned bool
+	// rotatedFrom holds the credentials the entity had before the rotation
+	// steps switched them, until they are switched back.
+	rotatedFrom string
+}
+
+// title returns the kind of an entity as used in step names, eg: Repo.
+func title(e Entity) string {
+	kind := e.Kind()
+	return strings.ToUpper(kind[:1]) + kind[1:]
+}
+
+// payloads returns the objects returned by the API for a list of entities.
+func payloads(infos []EntityInfo) []interface{} {
+	result := make([]interface{}, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, info.Payload)
+	}
+	return result
+}
+
+var (
+	repo       Entity = &repoEntity{}
+	org        Entity = &orgEntity{}
+	enterprise Entity = &enterpriseEntity{}
+)
+
+// entityKinds are the kinds of the entities the run creates, comma
+// separated.
+var entityKinds = envOrDefault("GARM_ENTITIES", "repo,org")
+
+// entityGroups maps the groups creating an entity to its kind.
+var entityGroups = map[string]string{
+	groupRepositories:  "repo",
+	groupOrganizations: "org",
+	groupEnterprises:   "enterprise",
+}
+
+// parseEntityKinds returns the set of the kinds listed in kinds.
+func parseEntityKinds(kinds string) (map[string]bool, error) {
+	selected := map[string]bool{}
+	for _, kind := range strings.Split(kinds, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		if _, ok := entityByKind(kind); !ok {
+			return nil, fmt.Errorf("unknown entity %q, expected repo, org or enterprise", kind)
+		}
+		selected[kind] = true
+	}
+	return selected, nil
+}
+
+// entitySkipReason tells why the steps of e cannot run, if they cannot.
+// Enterprises need settings of their own, repositories and organizations
+// work with those the suite needs anyway.
+func entitySkipReason(e Entity) string {
+	if e.Kind() != "enterprise" {
+		return ""
+	}
+	switch {
+	case enterpriseWebhookSecret == "":
+		return "ENTERPRISE_WEBHOOK_SECRET is not set"
+	case enterpriseCredentialsName == "":
+		return "ENTERPRISE_CREDENTIALS_NAME is not set"
+	}
+	return ""
+}
+
+// ///////////////
+// Repositories //
+// ///////////////
+type repoEntity struct {
+	state entityState
+}
+
+func repoInfo(r *params.Repository) EntityInfo {
+	return EntityInfo{
+		ID:              r.ID,
+		Name:            r.Owner + "/" + r.Name,
+		CredentialsName: r.CredentialsName,
+		Pools:           r.Pools,
+		Payload:         r,
+	}
+}
+
+func (r *repoEntity) Kind() string {
+	return "repo"
+}
+
+func (r *repoEntity) Name() string {
+	spec := entitySpec(r)
+	return spec.Owner + "/" + spec.Name
+}
+
+func (r *repoEntity) State() *entityState {
+	return &r.state
+}
+
+func (r *repoEntity) WebhookSecret() string {
+	return repoWebhookSecret
+}
+
+func (r *repoEntity) CredentialsName() string {
+	return credentialsName
+}
+
+func (r *repoEntity) WebhookTarget(job *params.WorkflowJob) string {
+	spec := entitySpec(r)
+	job.Repository.Name = spec.Name
+	job.Repository.FullName = spec.Owner + "/" + spec.Name
+	job.Repository.Owner.Login = spec.Owner
+	job.Organization.Login = spec.Owner
+	return "repository"
+}
+
+func (r *repoEntity) Create(credentialsName string) (EntityInfo, error) {
+	spec := entitySpec(r)
+	createParams := params.CreateRepoParams{
+		Owner:           spec.Owner,
+		Name:            spec.Name,
+		CredentialsName: credentialsName,
+		WebhookSecret:   r.WebhookSecret(),
+	}
+	resp, err := cli.Repositories.CreateRepo(
+		clientRepositories.NewCreateRepoParams().WithBody(createParams),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return repoInfo(&resp.Payload), nil
+}
+
+func (r *repoEntity) List() ([]EntityInfo, error) {
+	resp, err := cli.Repositories.ListRepos(
+		clientRepositories.NewListReposParams(),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]EntityInfo, 0, len(resp.Payload))
+	for i := range resp.Payload {
+		infos = append(infos, repoInfo(&resp.Payload[i]))
+	}
+	return infos, nil
+}
+
+func (r *repoEntity) Get(id string) (EntityInfo, error) {
+	resp, err := cli.Repositories.GetRepo(
+		clientRepositories.NewGetRepoParams().WithRepoID(id),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return repoInfo(&resp.Payload), nil
+}
+
+func (r *repoEntity) Update(id string, updateParams params.UpdateEntityParams) (EntityInfo, error) {
+	resp, err := cli.Repositories.UpdateRepo(
+		clientRepositories.NewUpdateRepoParams().WithRepoID(id).WithBody(updateParams),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return repoInfo(&resp.Payload), nil
+}
+
+func (r *repoEntity) Delete(id string) error {
+	return cli.Repositories.DeleteRepo(
+		clientRepositories.NewDeleteRepoParams().WithRepoID(id),
+		authToken)
+}
+
+func (r *repoEntity) CreatePool(id string, poolParams params.CreatePoolParams) (*params.Pool, error) {
+	resp, err := cli.Repositories.CreateRepoPool(
+		clientRepositories.NewCreateRepoPoolParams().WithRepoID(id).WithBody(poolParams),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (r *repoEntity) ListPools(id string) (params.Pools, error) {
+	resp, err := cli.Repositories.ListRepoPools(
+		clientRepositories.NewListRepoPoolsParams().WithRepoID(id),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (r *repoEntity) GetPool(id, poolID string) (*params.Pool, error) {
+	resp, err := cli.Repositories.GetRepoPool(
+		clientRepositories.NewGetRepoPoolParams().WithRepoID(id).WithPoolID(poolID),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (r *repoEntity) UpdatePool(id, poolID string, poolParams params.UpdatePoolParams) (*params.Pool, error) {
+	resp, err := cli.Repositories.UpdateRepoPool(
+		clientRepositories.NewUpdateRepoPoolParams().WithRepoID(id).WithPoolID(poolID).WithBody(poolParams),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (r *repoEntity) DeletePool(id, poolID string) error {
+	return cli.Repositories.DeleteRepoPool(
+		clientRepositories.NewDeleteRepoPoolParams().WithRepoID(id).WithPoolID(poolID),
+		authToken)
+}
+
+func (r *repoEntity) ListInstances(id string) (params.Instances, error) {
+	resp, err := cli.Repositories.ListRepoInstances(
+		clientRepositories.NewListRepoInstancesParams().WithRepoID(id),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+// ////////////////
+// Organizations //
+// ////////////////
+type orgEntity struct {
+	state entityState
+}
+
+func orgInfo(o *params.Organization) EntityInfo {
+	return EntityInfo{
+		ID:              o.ID,
+		Name:            o.Name,
+		CredentialsName: o.CredentialsName,
+		Pools:           o.Pools,
+		Payload:         o,
+	}
+}
+
+func (o *orgEntity) Kind() string {
+	return "org"
+}
+
+func (o *orgEntity) Name() string {
+	return entitySpec(o).Name
+}
+
+func (o *orgEntity) State() *entityState {
+	return &o.state
+}
+
+func (o *orgEntity) WebhookSecret() string {
+	return orgWebhookSecret
+}
+
+func (o *orgEntity) CredentialsName() string {
+	return credentialsName
+}
+
+func (o *orgEntity) WebhookTarget(job *params.WorkflowJob) string {
+	job.Organization.Login = o.Name()
+	return "organization"
+}
+
+func (o *orgEntity) Create(credentialsName string) (EntityInfo, error) {
+	createParams := params.CreateOrgParams{
+		Name:            o.Name(),
+		CredentialsName: credentialsName,
+		WebhookSecret:   o.WebhookSecret(),
+	}
+	resp, err := cli.Organizations.CreateOrg(
+		clientOrganizations.NewCreateOrgParams().WithBody(createParams),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return orgInfo(&resp.Payload), nil
+}
+
+func (o *orgEntity) List() ([]EntityInfo, error) {
+	resp, err := cli.Organizations.ListOrgs(
+		clientOrganizations.NewListOrgsParams(),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]EntityInfo, 0, len(resp.Payload))
+	for i := range resp.Payload {
+		infos = append(infos, orgInfo(&resp.Payload[i]))
+	}
+	return infos, nil
+}
+
+func (o *orgEntity) Get(id string) (EntityInfo, error) {
+	resp, err := cli.Organizations.GetOrg(
+		clientOrganizations.NewGetOrgParams().WithOrgID(id),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return orgInfo(&resp.Payload), nil
+}
+
+func (o *orgEntity) Update(id string, updateParams params.UpdateEntityParams) (EntityInfo, error) {
+	resp, err := cli.Organizations.UpdateOrg(
+		clientOrganizations.NewUpdateOrgParams().WithOrgID(id).WithBody(updateParams),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return orgInfo(&resp.Payload), nil
+}
+
+func (o *orgEntity) Delete(id string) error {
+	return cli.Organizations.DeleteOrg(
+		clientOrganizations.NewDeleteOrgParams().WithOrgID(id),
+		authToken)
+}
+
+func (o *orgEntity) CreatePool(id string, poolParams params.CreatePoolParams) (*params.Pool, error) {
+	resp, err := cli.Organizations.CreateOrgPool(
+		clientOrganizations.NewCreateOrgPoolParams().WithOrgID(id).WithBody(poolParams),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (o *orgEntity) ListPools(id string) (params.Pools, error) {
+	resp, err := cli.Organizations.ListOrgPools(
+		clientOrganizations.NewListOrgPoolsParams().WithOrgID(id),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (o *orgEntity) GetPool(id, poolID string) (*params.Pool, error) {
+	resp, err := cli.Organizations.GetOrgPool(
+		clientOrganizations.NewGetOrgPoolParams().WithOrgID(id).WithPoolID(poolID),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (o *orgEntity) UpdatePool(id, poolID string, poolParams params.UpdatePoolParams) (*params.Pool, error) {
+	resp, err := cli.Organizations.UpdateOrgPool(
+		clientOrganizations.NewUpdateOrgPoolParams().WithOrgID(id).WithPoolID(poolID).WithBody(poolParams),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (o *orgEntity) DeletePool(id, poolID string) error {
+	return cli.Organizations.DeleteOrgPool(
+		clientOrganizations.NewDeleteOrgPoolParams().WithOrgID(id).WithPoolID(poolID),
+		authToken)
+}
+
+func (o *orgEntity) ListInstances(id string) (params.Instances, error) {
+	resp, err := cli.Organizations.ListOrgInstances(
+		clientOrganizations.NewListOrgInstancesParams().WithOrgID(id),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+// //////////////
+// Enterprises //
+// //////////////
+type enterpriseEntity struct {
+	state entityState
+}
+
+func enterpriseInfo(e *params.Enterprise) EntityInfo {
+	return EntityInfo{
+		ID:              e.ID,
+		Name:            e.Name,
+		CredentialsName: e.CredentialsName,
+		Pools:           e.Pools,
+		Payload:         e,
+	}
+}
+
+func (e *enterpriseEntity) Kind() string {
+	return "enterprise"
+}
+
+func (e *enterpriseEntity) Name() string {
+	return entitySpec(e).Name
+}
+
+func (e *enterpriseEntity) State() *entityState {
+	return &e.state
+}
+
+func (e *enterpriseEntity) WebhookSecret() string {
+	return enterpriseWebhookSecret
+}
+
+// CredentialsName names the enterprise level credentials, which the
+// credentials of repositories and organizations seldom are.
+func (e *enterpriseEntity) CredentialsName() string {
+	return enterpriseCredentialsName
+}
+
+func (e *enterpriseEntity) WebhookTarget(job *params.WorkflowJob) string {
+	job.Enterprise.Slug = e.Name()
+	job.Enterprise.Name = e.Name()
+	return "business"
+}
+
+func (e *enterpriseEntity) Create(credentialsName string) (EntityInfo, error) {
+	createParams := params.CreateEnterpriseParams{
+		Name:            e.Name(),
+		CredentialsName: credentialsName,
+		WebhookSecret:   e.WebhookSecret(),
+	}
+	resp, err := cli.Enterprises.CreateEnterprise(
+		clientEnterprises.NewCreateEnterpriseParams().WithBody(createParams),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return enterpriseInfo(&resp.Payload), nil
+}
+
+func (e *enterpriseEntity) List() ([]EntityInfo, error) {
+	resp, err := cli.Enterprises.ListEnterprises(
+		clientEnterprises.NewListEnterprisesParams(),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]EntityInfo, 0, len(resp.Payload))
+	for i := range resp.Payload {
+		infos = append(infos, enterpriseInfo(&resp.Payload[i]))
+	}
+	return infos, nil
+}
+
+func (e *enterpriseEntity) Get(id string) (EntityInfo, error) {
+	resp, err := cli.Enterprises.GetEnterprise(
+		clientEnterprises.NewGetEnterpriseParams().WithEnterpriseID(id),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return enterpriseInfo(&resp.Payload), nil
+}
+
+func (e *enterpriseEntity) Update(id string, updateParams params.UpdateEntityParams) (EntityInfo, error) {
+	resp, err := cli.Enterprises.UpdateEnterprise(
+		clientEnterprises.NewUpdateEnterpriseParams().WithEnterpriseID(id).WithBody(updateParams),
+		authToken)
+	if err != nil {
+		return EntityInfo{}, err
+	}
+	return enterpriseInfo(&resp.Payload), nil
+}
+
+func (e *enterpriseEntity) Delete(id string) error {
+	return cli.Enterprises.DeleteEnterprise(
+		clientEnterprises.NewDeleteEnterpriseParams().WithEnterpriseID(id),
+		authToken)
+}
+
+func (e *enterpriseEntity) CreatePool(id string, poolParams params.CreatePoolParams) (*params.Pool, error) {
+	resp, err := cli.Enterprises.CreateEnterprisePool(
+		clientEnterprises.NewCreateEnterprisePoolParams().WithEnterpriseID(id).WithBody(poolParams),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (e *enterpriseEntity) ListPools(id string) (params.Pools, error) {
+	resp, err := cli.Enterprises.ListEnterprisePools(
+		clientEnterprises.NewListEnterprisePoolsParams().WithEnterpriseID(id),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (e *enterpriseEntity) GetPool(id, poolID string) (*params.Pool, error) {
+	resp, err := cli.Enterprises.GetEnterprisePool(
+		clientEnterprises.NewGetEnterprisePoolParams().WithEnterpriseID(id).WithPoolID(poolID),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (e *enterpriseEntity) UpdatePool(id, poolID string, poolParams params.UpdatePoolParams) (*params.Pool, error) {
+	resp, err := cli.Enterprises.UpdateEnterprisePool(
+		clientEnterprises.NewUpdateEnterprisePoolParams().WithEnterpriseID(id).WithPoolID(poolID).WithBody(poolParams),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Payload, nil
+}
+
+func (e *enterpriseEntity) DeletePool(id, poolID string) error {
+	return cli.Enterprises.DeleteEnterprisePool(
+		clientEnterprises.NewDeleteEnterprisePoolParams().WithEnterpriseID(id).WithPoolID(poolID),
+		authToken)
+}
+
+func (e *enterpriseEntity) ListInstances(id string) (params.Instances, error) {
+	resp, err := cli.Enterprises.ListEnterpriseInstances(
+		clientEnterprises.NewListEnterpriseInstancesParams().WithEnterpriseID(id),
+		authToken)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
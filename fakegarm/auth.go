@@ -0,0 +1,166 @@
+package fakegarm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	garmParams "github.com/cloudbase/garm/params"
+)
+
+// claims is the payload of the JWT tokens handed out by the fake server. It
+// mirrors the subset of GARM's own claims that the client cares about.
+type claims struct {
+	UserID      string `json:"user"`
+	Username    string `json:"username,omitempty"`
+	IsAdmin     bool   `json:"is_admin"`
+	MetricsOnly bool   `json:"read_metrics_only,omitempty"`
+	ExpiresAt   int64  `json:"exp"`
+	IssuedAt    int64  `json:"iat"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (s *Server) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, s.jwtSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) newToken(c claims) (string, error) {
+	return s.issueToken(c, time.Now(), s.cfg.TokenTTL)
+}
+
+// ExpiredToken returns an admin token that expired an hour ago, signed like
+// the tokens handed out on login, to check that it is turned down.
+func (s *Server) ExpiredToken() (string, error) {
+	return s.issueToken(claims{IsAdmin: true}, time.Now().Add(-s.cfg.TokenTTL-time.Hour), s.cfg.TokenTTL)
+}
+
+func (s *Server) issueToken(c claims, issuedAt time.Time, ttl time.Duration) (string, error) {
+	c.IssuedAt = issuedAt.Unix()
+	c.ExpiresAt = issuedAt.Add(ttl).Unix()
+	return s.signClaims(c)
+}
+
+func (s *Server) signClaims(c interface{}) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("marshaling claims: %w", err)
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + s.sign(unsigned), nil
+}
+
+// verifyToken checks the signature of token and decodes its claims into c.
+func (s *Server) verifyToken(token string, c interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+	expected := s.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return fmt.Errorf("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("decoding token payload: %w", err)
+	}
+	if err := json.Unmarshal(payload, c); err != nil {
+		return fmt.Errorf("decoding token claims: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) parseToken(token string) (claims, error) {
+	var c claims
+	if err := s.verifyToken(token, &c); err != nil {
+		return claims{}, err
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return claims{}, fmt.Errorf("token expired")
+	}
+	// Instance tokens are signed with the same secret, but name no user.
+	if c.UserID == "" {
+		return claims{}, fmt.Errorf("not a user token")
+	}
+	return c, nil
+}
+
+// instanceClaims is the payload of the tokens runners call back with. It
+// mirrors GARM's InstanceJWTClaims.
+type instanceClaims struct {
+	ID        string              `json:"id"`
+	Name      string              `json:"name"`
+	PoolID    string              `json:"provider_id"`
+	Scope     garmParams.PoolType `json:"scope"`
+	Entity    string              `json:"entity"`
+	ExpiresAt int64               `json:"exp"`
+	Issuer    string              `json:"iss"`
+}
+
+// instanceToken returns the token the runner of instance calls back with.
+// Like GARM, it is valid for as long as the pool gives runners to come up,
+// plus an hour.
+func (s *Server) instanceToken(instance *garmParams.Instance, pool *garmParams.Pool, entityName string) (string, error) {
+	ttl := time.Duration(pool.RunnerTimeout())*time.Minute + time.Hour
+	return s.signClaims(instanceClaims{
+		ID:        instance.ID,
+		Name:      instance.Name,
+		PoolID:    pool.ID,
+		Scope:     pool.PoolType(),
+		Entity:    entityName,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+		Issuer:    "garm",
+	})
+}
+
+// authenticateInstance validates the instance token of a request and returns
+// the instance it was issued for. Like GARM, it only lets in runners that
+// have yet to finish installing.
+func (s *Server) authenticateInstance(r *http.Request) (*garmParams.Instance, bool) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer"))
+	if header == "" || token == header || token == "" {
+		return nil, false
+	}
+	var c instanceClaims
+	if err := s.verifyToken(token, &c); err != nil || c.Name == "" {
+		return nil, false
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return nil, false
+	}
+	instance, ok := s.instances[c.Name]
+	if !ok || instance.ID != c.ID {
+		return nil, false
+	}
+	switch instance.RunnerStatus {
+	case garmParams.RunnerPending, garmParams.RunnerInstalling:
+		return instance, true
+	}
+	return nil, false
+}
+
+// authenticate validates the bearer token of a request. Metrics tokens are
+// only accepted when allowMetrics is set.
+func (s *Server) authenticate(r *http.Request, allowMetrics bool) (claims, bool) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer"))
+	if header == "" || token == header || token == "" {
+		return claims{}, false
+	}
+	c, err := s.parseToken(token)
+	if err != nil {
+		return claims{}, false
+	}
+	if c.MetricsOnly && !allowMetrics {
+		return claims{}, false
+	}
+	return c, true
+}
@@ -0,0 +1,117 @@
+package fakegarm
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	garmParams "github.com/cloudbase/garm/params"
+)
+
+// Runners of the pools of external providers call back the way the install
+// script GARM hands to providers does: they fetch a registration token from
+// the metadata URL, then post their progress to the callback URL, with the
+// token of their instance. Runners of the other providers install themselves.
+
+// Bootstrap returns the bootstrap params GARM would pass to the provider
+// creating the named instance: the callback and metadata URLs, along with
+// the token the runner calls back with.
+func (s *Server) Bootstrap(name string) (commonParams.BootstrapInstance, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	instance, err := s.getInstance(name)
+	if err != nil {
+		return commonParams.BootstrapInstance{}, err
+	}
+	pool, ok := s.pools[instance.PoolID]
+	if !ok {
+		return commonParams.BootstrapInstance{}, gErrors.NewNotFoundError("pool %s not found", instance.PoolID)
+	}
+	var entityName string
+	if ent, ok := s.entities[poolOwnerID(pool)]; ok {
+		entityName = ent.displayName()
+	}
+	token, err := s.instanceToken(instance, pool, entityName)
+	if err != nil {
+		return commonParams.BootstrapInstance{}, err
+	}
+	labels := make([]string, 0, len(pool.Tags))
+	for _, tag := range pool.Tags {
+		labels = append(labels, tag.Name)
+	}
+	return commonParams.BootstrapInstance{
+		Name:              instance.Name,
+		RepoURL:           "https://github.com/" + entityName,
+		CallbackURL:       s.cfg.CallbackURL,
+		MetadataURL:       s.cfg.MetadataURL,
+		InstanceToken:     token,
+		GitHubRunnerGroup: pool.GitHubRunnerGroup,
+		OSArch:            pool.OSArch,
+		OSType:            pool.OSType,
+		Flavor:            pool.Flavor,
+		Image:             pool.Image,
+		Labels:            labels,
+		PoolID:            pool.ID,
+	}, nil
+}
+
+// callsBack reports whether the runners of pool wait for their callbacks,
+// rather than installing themselves.
+func (s *Server) callsBack(pool *garmParams.Pool) bool {
+	for _, provider := range s.cfg.Providers {
+		if provider.Name == pool.ProviderName {
+			return provider.ProviderType == garmParams.ExternalProvider
+		}
+	}
+	return false
+}
+
+func (s *Server) instanceStatusHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	instance, ok := s.authenticateInstance(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, authFailed)
+		return
+	}
+	var update garmParams.InstanceUpdateMessage
+	if err := decodeBody(r, &update); err != nil {
+		handleError(w, err)
+		return
+	}
+	instance.StatusMessages = append(instance.StatusMessages,
+		statusMessage(garmParams.EventInfo, "%s", update.Message))
+	if update.Status != "" {
+		instance.RunnerStatus = update.Status
+	}
+	if update.AgentID != nil {
+		instance.AgentID = *update.AgentID
+	}
+	instance.UpdatedAt = time.Now().UTC()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// registrationTokenHandler hands out a registration token once per instance.
+func (s *Server) registrationTokenHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	instance, ok := s.authenticateInstance(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, authFailed)
+		return
+	}
+	if instance.TokenFetched {
+		handleError(w, gErrors.ErrUnauthorized)
+		return
+	}
+	instance.TokenFetched = true
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strings.ToUpper(randomString(29))))
+}
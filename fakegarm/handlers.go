@@ -0,0 +1,814 @@
+package fakegarm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm/apiserver/params"
+	garmParams "github.com/cloudbase/garm/params"
+)
+
+const defaultRunnerBootstrapTimeout = 20
+
+// entity is the common representation of repositories, organizations and
+// enterprises. Only repositories have an owner.
+type entity struct {
+	kind            garmParams.PoolType
+	id              string
+	owner           string
+	name            string
+	credentialsName string
+	webhookSecret   string
+}
+
+func (e *entity) displayName() string {
+	if e.owner != "" {
+		return e.owner + "/" + e.name
+	}
+	return e.name
+}
+
+func (e *entity) payload(pools []garmParams.Pool) interface{} {
+	status := garmParams.PoolManagerStatus{IsRunning: true}
+	switch e.kind {
+	case garmParams.RepositoryPool:
+		return garmParams.Repository{
+			ID:                e.id,
+			Owner:             e.owner,
+			Name:              e.name,
+			Pools:             pools,
+			CredentialsName:   e.credentialsName,
+			PoolManagerStatus: status,
+		}
+	case garmParams.OrganizationPool:
+		return garmParams.Organization{
+			ID:                e.id,
+			Name:              e.name,
+			Pools:             pools,
+			CredentialsName:   e.credentialsName,
+			PoolManagerStatus: status,
+		}
+	default:
+		return garmParams.Enterprise{
+			ID:                e.id,
+			Name:              e.name,
+			Pools:             pools,
+			CredentialsName:   e.credentialsName,
+			PoolManagerStatus: status,
+		}
+	}
+}
+
+// handleError mirrors the way the GARM API controllers translate errors into
+// HTTP responses.
+func handleError(w http.ResponseWriter, err error) {
+	apiErr := params.APIErrorResponse{
+		Details: err.Error(),
+	}
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case *gErrors.NotFoundError:
+		status = http.StatusNotFound
+		apiErr.Error = "Not Found"
+	case *gErrors.UnauthorizedError:
+		status = http.StatusUnauthorized
+		apiErr.Error = "Not Authorized"
+		apiErr.Details = ""
+	case *gErrors.BadRequestError:
+		status = http.StatusBadRequest
+		apiErr.Error = "Bad Request"
+	case *gErrors.DuplicateUserError, *gErrors.ConflictError:
+		status = http.StatusConflict
+		apiErr.Error = "Conflict"
+	default:
+		apiErr.Error = "Server error"
+		apiErr.Details = ""
+	}
+	writeError(w, status, apiErr)
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return gErrors.ErrBadRequest
+	}
+	return nil
+}
+
+// /////////////
+// Controller //
+// /////////////
+
+func (s *Server) firstRunHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	var newUser garmParams.NewUserParams
+	if err := decodeBody(r, &newUser); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.user != nil {
+		handleError(w, gErrors.NewConflictError("already initialized"))
+		return
+	}
+	if newUser.Username == "" || newUser.Password == "" || newUser.Email == "" {
+		handleError(w, gErrors.NewBadRequestError("missing username, password or email"))
+		return
+	}
+	now := time.Now().UTC()
+	s.user = &garmParams.User{
+		ID:        newID(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Email:     newUser.Email,
+		Username:  newUser.Username,
+		FullName:  newUser.FullName,
+		Enabled:   true,
+		IsAdmin:   true,
+	}
+	s.password = newUser.Password
+	writeJSON(w, http.StatusOK, s.user)
+}
+
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	var loginInfo garmParams.PasswordLoginParams
+	if err := decodeBody(r, &loginInfo); err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := loginInfo.Validate(); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	s.mux.Lock()
+	user := *s.user
+	valid := loginInfo.Username == user.Username && loginInfo.Password == s.password
+	s.mux.Unlock()
+	if !valid {
+		handleError(w, gErrors.ErrUnauthorized)
+		return
+	}
+
+	token, err := s.newToken(claims{UserID: user.ID, Username: user.Username, IsAdmin: true})
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, garmParams.JWTResponse{Token: token})
+}
+
+func (s *Server) metricsTokenHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	c, _ := s.authenticate(r, false)
+	token, err := s.newToken(claims{UserID: c.UserID, MetricsOnly: true})
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, garmParams.JWTResponse{Token: token})
+}
+
+func (s *Server) listJobsHandler(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	jobs := garmParams.Jobs{}
+	jobs = append(jobs, s.jobs...)
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) listCredentialsHandler(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	creds := garmParams.Credentials{}
+	creds = append(creds, s.cfg.Credentials...)
+	writeJSON(w, http.StatusOK, creds)
+}
+
+func (s *Server) listProvidersHandler(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	providers := garmParams.Providers{}
+	providers = append(providers, s.cfg.Providers...)
+	writeJSON(w, http.StatusOK, providers)
+}
+
+func (s *Server) hasCredentials(name string) bool {
+	for _, cred := range s.cfg.Credentials {
+		if cred.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) hasProvider(name string) bool {
+	for _, provider := range s.cfg.Providers {
+		if provider.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ///////////
+// Entities //
+// ///////////
+
+func (s *Server) getEntity(kind garmParams.PoolType, id string) (*entity, error) {
+	ent, ok := s.entities[id]
+	if !ok || ent.kind != kind {
+		return nil, gErrors.NewNotFoundError("%s %s not found", kind, id)
+	}
+	return ent, nil
+}
+
+func (s *Server) entityPools(ent *entity) []garmParams.Pool {
+	pools := []garmParams.Pool{}
+	for _, pool := range s.sortedPools() {
+		if poolOwnerID(pool) == ent.id {
+			pools = append(pools, s.poolPayload(pool))
+		}
+	}
+	return pools
+}
+
+func (s *Server) createEntityHandler(w http.ResponseWriter, r *http.Request, kind garmParams.PoolType, _ map[string]string) {
+	ent := &entity{kind: kind}
+	var err error
+	switch kind {
+	case garmParams.RepositoryPool:
+		var body garmParams.CreateRepoParams
+		if err = decodeBody(r, &body); err == nil {
+			err = body.Validate()
+		}
+		ent.owner, ent.name, ent.credentialsName, ent.webhookSecret = body.Owner, body.Name, body.CredentialsName, body.WebhookSecret
+	case garmParams.OrganizationPool:
+		var body garmParams.CreateOrgParams
+		if err = decodeBody(r, &body); err == nil {
+			err = body.Validate()
+		}
+		ent.name, ent.credentialsName, ent.webhookSecret = body.Name, body.CredentialsName, body.WebhookSecret
+	default:
+		var body garmParams.CreateEnterpriseParams
+		if err = decodeBody(r, &body); err == nil {
+			err = body.Validate()
+		}
+		ent.name, ent.credentialsName, ent.webhookSecret = body.Name, body.CredentialsName, body.WebhookSecret
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.hasCredentials(ent.credentialsName) {
+		handleError(w, gErrors.NewBadRequestError("credentials %s not defined", ent.credentialsName))
+		return
+	}
+	for _, existing := range s.entities {
+		if existing.kind == kind && strings.EqualFold(existing.displayName(), ent.displayName()) {
+			handleError(w, gErrors.NewConflictError("%s %s already exists", kind, ent.displayName()))
+			return
+		}
+	}
+	ent.id = newID()
+	s.entities[ent.id] = ent
+	writeJSON(w, http.StatusOK, ent.payload(nil))
+}
+
+func (s *Server) listEntitiesHandler(w http.ResponseWriter, _ *http.Request, kind garmParams.PoolType, _ map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var ents []*entity
+	for _, ent := range s.entities {
+		if ent.kind == kind {
+			ents = append(ents, ent)
+		}
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].displayName() < ents[j].displayName() })
+
+	switch kind {
+	case garmParams.RepositoryPool:
+		payload := garmParams.Repositories{}
+		for _, ent := range ents {
+			payload = append(payload, ent.payload(nil).(garmParams.Repository))
+		}
+		writeJSON(w, http.StatusOK, payload)
+	case garmParams.OrganizationPool:
+		payload := garmParams.Organizations{}
+		for _, ent := range ents {
+			payload = append(payload, ent.payload(nil).(garmParams.Organization))
+		}
+		writeJSON(w, http.StatusOK, payload)
+	default:
+		payload := garmParams.Enterprises{}
+		for _, ent := range ents {
+			payload = append(payload, ent.payload(nil).(garmParams.Enterprise))
+		}
+		writeJSON(w, http.StatusOK, payload)
+	}
+}
+
+func (s *Server) getEntityHandler(w http.ResponseWriter, _ *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ent, err := s.getEntity(kind, vars["entityID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ent.payload(s.entityPools(ent)))
+}
+
+func (s *Server) updateEntityHandler(w http.ResponseWriter, r *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	var body garmParams.UpdateEntityParams
+	if err := decodeBody(r, &body); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ent, err := s.getEntity(kind, vars["entityID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if body.CredentialsName != "" {
+		if !s.hasCredentials(body.CredentialsName) {
+			handleError(w, gErrors.NewBadRequestError("invalid credentials (%s) for %s %s", body.CredentialsName, kind, ent.displayName()))
+			return
+		}
+		ent.credentialsName = body.CredentialsName
+	}
+	if body.WebhookSecret != "" {
+		ent.webhookSecret = body.WebhookSecret
+	}
+	writeJSON(w, http.StatusOK, ent.payload(s.entityPools(ent)))
+}
+
+func (s *Server) deleteEntityHandler(w http.ResponseWriter, _ *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ent, err := s.getEntity(kind, vars["entityID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	var poolIDs []string
+	for _, pool := range s.sortedPools() {
+		if poolOwnerID(pool) == ent.id {
+			poolIDs = append(poolIDs, pool.ID)
+		}
+	}
+	if len(poolIDs) > 0 {
+		handleError(w, gErrors.NewBadRequestError("%s has pools defined (%s)", kind, strings.Join(poolIDs, ", ")))
+		return
+	}
+	delete(s.entities, ent.id)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) listEntityInstancesHandler(w http.ResponseWriter, _ *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ent, err := s.getEntity(kind, vars["entityID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	instances := garmParams.Instances{}
+	for _, instance := range s.sortedInstances() {
+		if pool, ok := s.pools[instance.PoolID]; ok && poolOwnerID(pool) == ent.id {
+			instances = append(instances, *instance)
+		}
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+// ////////
+// Pools //
+// ////////
+
+func poolOwnerID(pool *garmParams.Pool) string {
+	switch {
+	case pool.RepoID != "":
+		return pool.RepoID
+	case pool.OrgID != "":
+		return pool.OrgID
+	default:
+		return pool.EnterpriseID
+	}
+}
+
+func (s *Server) sortedPools() []*garmParams.Pool {
+	pools := make([]*garmParams.Pool, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+	return pools
+}
+
+func (s *Server) poolPayload(pool *garmParams.Pool) garmParams.Pool {
+	payload := *pool
+	payload.Tags = append([]garmParams.Tag{}, pool.Tags...)
+	payload.Instances = []garmParams.Instance{}
+	for _, instance := range s.sortedInstances() {
+		if instance.PoolID == pool.ID {
+			payload.Instances = append(payload.Instances, *instance)
+		}
+	}
+	return payload
+}
+
+// processTags adds the labels GitHub sets on every self hosted runner, the
+// same way GARM does when a pool is created or updated.
+func processTags(osArch commonParams.OSArch, osType commonParams.OSType, tags []string) ([]garmParams.Tag, error) {
+	var ghArch, ghOSType string
+	switch osArch {
+	case commonParams.Amd64:
+		ghArch = "x64"
+	case commonParams.Arm64:
+		ghArch = "ARM64"
+	case commonParams.Arm:
+		ghArch = "ARM"
+	case commonParams.I386:
+		ghArch = "x86"
+	default:
+		return nil, gErrors.NewBadRequestError("invalid OS architecture %s", osArch)
+	}
+	switch osType {
+	case commonParams.Linux:
+		ghOSType = "Linux"
+	case commonParams.Windows:
+		ghOSType = "Windows"
+	default:
+		return nil, gErrors.NewBadRequestError("invalid OS type %s", osType)
+	}
+
+	seen := map[string]bool{}
+	var result []garmParams.Tag
+	for _, name := range append([]string{"self-hosted", ghArch, ghOSType}, tags...) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, garmParams.Tag{ID: newID(), Name: name})
+	}
+	return result, nil
+}
+
+func (s *Server) getPool(poolID string) (*garmParams.Pool, error) {
+	pool, ok := s.pools[poolID]
+	if !ok {
+		return nil, gErrors.NewNotFoundError("pool %s not found", poolID)
+	}
+	return pool, nil
+}
+
+func (s *Server) getEntityPool(kind garmParams.PoolType, entityID, poolID string) (*garmParams.Pool, error) {
+	if _, err := s.getEntity(kind, entityID); err != nil {
+		return nil, err
+	}
+	pool, err := s.getPool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	if poolOwnerID(pool) != entityID {
+		return nil, gErrors.NewNotFoundError("pool %s not found", poolID)
+	}
+	return pool, nil
+}
+
+func (s *Server) createEntityPoolHandler(w http.ResponseWriter, r *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	var body garmParams.CreatePoolParams
+	if err := decodeBody(r, &body); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ent, err := s.getEntity(kind, vars["entityID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := body.Validate(); err != nil {
+		handleError(w, gErrors.NewBadRequestError("validating params: %s", err))
+		return
+	}
+	if !s.hasProvider(body.ProviderName) {
+		handleError(w, gErrors.NewBadRequestError("no such provider %s", body.ProviderName))
+		return
+	}
+	// Like GARM, an entity has a single pool per provider, image and flavor.
+	for _, existing := range s.entityPools(ent) {
+		if existing.ProviderName == body.ProviderName && existing.Image == body.Image && existing.Flavor == body.Flavor {
+			handleError(w, gErrors.NewConflictError("pool with the same image and flavor already exists on this provider"))
+			return
+		}
+	}
+	tags, err := processTags(body.OSArch, body.OSType, body.Tags)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if body.RunnerBootstrapTimeout == 0 {
+		body.RunnerBootstrapTimeout = defaultRunnerBootstrapTimeout
+	}
+
+	pool := &garmParams.Pool{
+		RunnerPrefix:           body.RunnerPrefix,
+		ID:                     newID(),
+		ProviderName:           body.ProviderName,
+		MaxRunners:             body.MaxRunners,
+		MinIdleRunners:         body.MinIdleRunners,
+		Image:                  body.Image,
+		Flavor:                 body.Flavor,
+		OSType:                 body.OSType,
+		OSArch:                 body.OSArch,
+		Tags:                   tags,
+		Enabled:                body.Enabled,
+		RunnerBootstrapTimeout: body.RunnerBootstrapTimeout,
+		ExtraSpecs:             body.ExtraSpecs,
+		GitHubRunnerGroup:      body.GitHubRunnerGroup,
+	}
+	switch kind {
+	case garmParams.RepositoryPool:
+		pool.RepoID, pool.RepoName = ent.id, ent.displayName()
+	case garmParams.OrganizationPool:
+		pool.OrgID, pool.OrgName = ent.id, ent.name
+	default:
+		pool.EnterpriseID, pool.EnterpriseName = ent.id, ent.name
+	}
+	s.pools[pool.ID] = pool
+	writeJSON(w, http.StatusOK, s.poolPayload(pool))
+}
+
+func (s *Server) listEntityPoolsHandler(w http.ResponseWriter, _ *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ent, err := s.getEntity(kind, vars["entityID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, garmParams.Pools(s.entityPools(ent)))
+}
+
+func (s *Server) getEntityPoolHandler(w http.ResponseWriter, _ *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool, err := s.getEntityPool(kind, vars["entityID"], vars["poolID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.poolPayload(pool))
+}
+
+func (s *Server) updateEntityPoolHandler(w http.ResponseWriter, r *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	var body garmParams.UpdatePoolParams
+	if err := decodeBody(r, &body); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool, err := s.getEntityPool(kind, vars["entityID"], vars["poolID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.updatePool(pool, body); err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.poolPayload(pool))
+}
+
+func (s *Server) deleteEntityPoolHandler(w http.ResponseWriter, _ *http.Request, kind garmParams.PoolType, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool, err := s.getEntityPool(kind, vars["entityID"], vars["poolID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.deletePool(pool); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// updatePool applies the update to a copy of the pool and only commits it
+// if the result is valid.
+func (s *Server) updatePool(pool *garmParams.Pool, body garmParams.UpdatePoolParams) error {
+	updated := *pool
+	if body.Prefix != "" {
+		updated.Prefix = body.Prefix
+	}
+	if body.Enabled != nil {
+		updated.Enabled = *body.Enabled
+	}
+	if body.MaxRunners != nil {
+		updated.MaxRunners = *body.MaxRunners
+	}
+	if body.MinIdleRunners != nil {
+		updated.MinIdleRunners = *body.MinIdleRunners
+	}
+	if body.RunnerBootstrapTimeout != nil {
+		if *body.RunnerBootstrapTimeout == 0 {
+			return gErrors.NewBadRequestError("runner_bootstrap_timeout cannot be 0")
+		}
+		updated.RunnerBootstrapTimeout = *body.RunnerBootstrapTimeout
+	}
+	if body.Image != "" {
+		updated.Image = body.Image
+	}
+	if body.Flavor != "" {
+		updated.Flavor = body.Flavor
+	}
+	if body.OSType != "" {
+		updated.OSType = body.OSType
+	}
+	if body.OSArch != "" {
+		updated.OSArch = body.OSArch
+	}
+	if body.ExtraSpecs != nil {
+		updated.ExtraSpecs = body.ExtraSpecs
+	}
+	if body.GitHubRunnerGroup != nil {
+		updated.GitHubRunnerGroup = *body.GitHubRunnerGroup
+	}
+	if updated.MinIdleRunners > updated.MaxRunners {
+		return gErrors.NewBadRequestError("min_idle_runners cannot be larger than max_runners")
+	}
+	if len(body.Tags) > 0 {
+		tags, err := processTags(updated.OSArch, updated.OSType, body.Tags)
+		if err != nil {
+			return err
+		}
+		updated.Tags = tags
+	}
+	*pool = updated
+	return nil
+}
+
+func (s *Server) deletePool(pool *garmParams.Pool) error {
+	var runners []string
+	for _, instance := range s.sortedInstances() {
+		if instance.PoolID == pool.ID {
+			runners = append(runners, instance.Name)
+		}
+	}
+	if len(runners) > 0 {
+		return gErrors.NewBadRequestError("pool has runners: %s", strings.Join(runners, ", "))
+	}
+	delete(s.pools, pool.ID)
+	return nil
+}
+
+func (s *Server) listPoolsHandler(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pools := garmParams.Pools{}
+	for _, pool := range s.sortedPools() {
+		pools = append(pools, s.poolPayload(pool))
+	}
+	writeJSON(w, http.StatusOK, pools)
+}
+
+func (s *Server) getPoolHandler(w http.ResponseWriter, _ *http.Request, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool, err := s.getPool(vars["poolID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.poolPayload(pool))
+}
+
+func (s *Server) updatePoolHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	var body garmParams.UpdatePoolParams
+	if err := decodeBody(r, &body); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool, err := s.getPool(vars["poolID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.updatePool(pool, body); err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.poolPayload(pool))
+}
+
+func (s *Server) deletePoolHandler(w http.ResponseWriter, _ *http.Request, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool, err := s.getPool(vars["poolID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.deletePool(pool); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) listPoolInstancesHandler(w http.ResponseWriter, _ *http.Request, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool, err := s.getPool(vars["poolID"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, garmParams.Instances(s.poolPayload(pool).Instances))
+}
+
+// ////////////
+// Instances //
+// ////////////
+
+func (s *Server) sortedInstances() []*garmParams.Instance {
+	instances := make([]*garmParams.Instance, 0, len(s.instances))
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances
+}
+
+func (s *Server) listInstancesHandler(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	instances := garmParams.Instances{}
+	for _, instance := range s.sortedInstances() {
+		instances = append(instances, *instance)
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+func (s *Server) getInstance(name string) (*garmParams.Instance, error) {
+	instance, ok := s.instances[name]
+	if !ok {
+		return nil, gErrors.NewNotFoundError("instance %s not found", name)
+	}
+	return instance, nil
+}
+
+func (s *Server) getInstanceHandler(w http.ResponseWriter, _ *http.Request, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	instance, err := s.getInstance(vars["instanceName"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, instance)
+}
+
+func (s *Server) deleteInstanceHandler(w http.ResponseWriter, _ *http.Request, vars map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	instance, err := s.getInstance(vars["instanceName"])
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.markForDeletion(instance, "instance deletion requested via API"); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func statusMessage(level garmParams.EventLevel, format string, a ...interface{}) garmParams.StatusMessage {
+	return garmParams.StatusMessage{
+		CreatedAt:  time.Now().UTC(),
+		Message:    fmt.Sprintf(format, a...),
+		EventType:  garmParams.StatusEvent,
+		EventLevel: level,
+	}
+}
@@ -0,0 +1,168 @@
+package fakegarm
+
+import (
+	"time"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	garmParams "github.com/cloudbase/garm/params"
+	"github.com/google/uuid"
+)
+
+// tick advances every instance one step through its lifecycle and then
+// reconciles pools against their min idle and max runners settings, and the
+// jobs queued for them. An instance goes through:
+//
+//	pending_create -> running (runner installing) -> running (runner idle)
+//
+// unless its runner calls back, in which case it stays running with a pending
+// runner until the callbacks of the runner move it along. Once deleted:
+//
+//	pending_delete -> deleting -> removed
+func (s *Server) tick() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, instance := range s.sortedInstances() {
+		s.advance(instance)
+	}
+	queued := s.queuedJobs()
+	for _, pool := range s.sortedPools() {
+		s.reconcilePool(pool, queued[pool.ID])
+	}
+}
+
+// queuedJobs counts the queued jobs each pool has to run. Like GARM, a job
+// goes to the first enabled pool of its entity that has all of its labels and
+// room for one more runner, and is locked by the entity it goes to.
+func (s *Server) queuedJobs() map[string]uint {
+	queued := map[string]uint{}
+	pools := s.sortedPools()
+	for i := range s.jobs {
+		job := &s.jobs[i]
+		if job.Status != "queued" {
+			continue
+		}
+		for _, pool := range pools {
+			if !pool.Enabled || poolOwnerID(pool) != jobOwnerID(*job) || !poolHasLabels(pool, job.Labels) {
+				continue
+			}
+			if queued[pool.ID] < pool.MaxRunners {
+				queued[pool.ID]++
+				job.LockedBy = uuid.MustParse(poolOwnerID(pool))
+				break
+			}
+		}
+	}
+	return queued
+}
+
+func (s *Server) advance(instance *garmParams.Instance) {
+	pool, ok := s.pools[instance.PoolID]
+	callsBack := ok && s.callsBack(pool)
+	switch instance.Status {
+	case commonParams.InstancePendingCreate:
+		instance.Status = commonParams.InstanceRunning
+		instance.ProviderID = instance.Name
+		instance.OSName = "ubuntu"
+		instance.OSVersion = "22.04"
+		instance.Addresses = []commonParams.Address{
+			{Address: "10.10.0.10", Type: commonParams.PrivateAddress},
+		}
+		if !callsBack {
+			instance.RunnerStatus = garmParams.RunnerInstalling
+			instance.StatusMessages = append(instance.StatusMessages,
+				statusMessage(garmParams.EventInfo, "installing runner"))
+		}
+	case commonParams.InstanceRunning:
+		if callsBack || instance.RunnerStatus != garmParams.RunnerInstalling {
+			return
+		}
+		instance.RunnerStatus = garmParams.RunnerIdle
+		instance.AgentID = time.Now().UnixNano() % 100000
+		instance.StatusMessages = append(instance.StatusMessages,
+			statusMessage(garmParams.EventInfo, "runner successfully installed"))
+	case commonParams.InstancePendingDelete:
+		instance.Status = commonParams.InstanceDeleting
+	case commonParams.InstanceDeleting:
+		delete(s.instances, instance.Name)
+		return
+	default:
+		return
+	}
+	instance.UpdatedAt = time.Now().UTC()
+}
+
+func isDeleting(instance *garmParams.Instance) bool {
+	return instance.Status == commonParams.InstancePendingDelete || instance.Status == commonParams.InstanceDeleting
+}
+
+// reconcilePool creates instances until the pool has MinIdleRunners idle or
+// soon to be idle runners, plus one for every queued job it has to run,
+// without going over MaxRunners, and removes the idle runners in excess.
+// Disabled pools are never scaled up.
+func (s *Server) reconcilePool(pool *garmParams.Pool, queued uint) {
+	var total, idleOrPending uint
+	var idle []*garmParams.Instance
+	for _, instance := range s.sortedInstances() {
+		if instance.PoolID != pool.ID || isDeleting(instance) {
+			continue
+		}
+		total++
+		switch instance.RunnerStatus {
+		case garmParams.RunnerIdle:
+			idle = append(idle, instance)
+			idleOrPending++
+		case garmParams.RunnerPending, garmParams.RunnerInstalling:
+			idleOrPending++
+		}
+	}
+
+	wanted := pool.MinIdleRunners + queued
+	if uint(len(idle)) > wanted {
+		for _, instance := range idle[wanted:] {
+			_ = s.markForDeletion(instance, "scaling down pool: idle runners exceed min_idle_runners")
+		}
+		return
+	}
+
+	if !pool.Enabled {
+		return
+	}
+	for idleOrPending < wanted && total < pool.MaxRunners {
+		s.addInstance(pool)
+		idleOrPending++
+		total++
+	}
+}
+
+func (s *Server) addInstance(pool *garmParams.Pool) *garmParams.Instance {
+	instance := &garmParams.Instance{
+		ID:                newID(),
+		Name:              pool.GetRunnerPrefix() + "-" + randomString(12),
+		OSType:            pool.OSType,
+		OSArch:            pool.OSArch,
+		Status:            commonParams.InstancePendingCreate,
+		RunnerStatus:      garmParams.RunnerPending,
+		PoolID:            pool.ID,
+		UpdatedAt:         time.Now().UTC(),
+		GitHubRunnerGroup: pool.GitHubRunnerGroup,
+	}
+	s.instances[instance.Name] = instance
+	return instance
+}
+
+func (s *Server) markForDeletion(instance *garmParams.Instance, reason string) error {
+	if isDeleting(instance) {
+		return nil
+	}
+	if instance.RunnerStatus == garmParams.RunnerActive {
+		return gErrors.NewBadRequestError("runner %s is running a job", instance.Name)
+	}
+	instance.Status = commonParams.InstancePendingDelete
+	instance.UpdatedAt = time.Now().UTC()
+	instance.StatusMessages = append(instance.StatusMessages,
+		statusMessage(garmParams.EventInfo, "%s", reason))
+	return nil
+}
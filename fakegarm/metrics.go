@@ -0,0 +1,131 @@
+package fakegarm
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cloudbase/garm/apiserver/params"
+	garmParams "github.com/cloudbase/garm/params"
+)
+
+const metricsPath = "/metrics"
+
+// webhookLabels identifies a garm_webhooks_received counter.
+type webhookLabels struct {
+	valid  string
+	reason string
+}
+
+// recordWebhook counts a webhook the way GARM does: valid ones with an empty
+// reason, the others with why they were turned down. The caller must hold
+// s.mux.
+func (s *Server) recordWebhook(valid bool, reason string) {
+	s.webhooksReceived[webhookLabels{valid: fmt.Sprint(valid), reason: reason}]++
+}
+
+// metricsHandler serves the Prometheus metrics GARM exposes. Like GARM, only
+// metrics tokens are accepted, the tokens handed out on login are not.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if c, ok := s.authenticate(r, true); !ok || !c.MetricsOnly {
+		writeError(w, http.StatusUnauthorized, authFailed)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, params.APIErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	controller := map[string]string{"hostname": s.hostname, "controller_id": s.controllerID}
+
+	var b strings.Builder
+	writeMetricHeader(&b, "garm_health", "Health of the runner", "gauge")
+	writeSample(&b, "garm_health", controller, 1)
+
+	writeMetricHeader(&b, "garm_runner_status", "Status of the runner", "gauge")
+	names := make([]string, 0, len(s.instances))
+	for name := range s.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		instance := s.instances[name]
+		var owner, poolType string
+		if pool, ok := s.pools[instance.PoolID]; ok {
+			poolType = string(pool.PoolType())
+			switch pool.PoolType() {
+			case garmParams.RepositoryPool:
+				owner = pool.RepoName
+			case garmParams.OrganizationPool:
+				owner = pool.OrgName
+			default:
+				owner = pool.EnterpriseName
+			}
+		}
+		writeSample(&b, "garm_runner_status", withLabels(controller, map[string]string{
+			"name":          instance.Name,
+			"status":        string(instance.Status),
+			"runner_status": string(instance.RunnerStatus),
+			"pool_owner":    owner,
+			"pool_type":     poolType,
+			"pool_id":       instance.PoolID,
+		}), 1)
+	}
+
+	writeMetricHeader(&b, "garm_webhooks_received", "The total number of webhooks received", "counter")
+	keys := make([]webhookLabels, 0, len(s.webhooksReceived))
+	for key := range s.webhooksReceived {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].valid != keys[j].valid {
+			return keys[i].valid < keys[j].valid
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	for _, key := range keys {
+		writeSample(&b, "garm_webhooks_received", withLabels(controller, map[string]string{
+			"valid":  key.valid,
+			"reason": key.reason,
+		}), float64(s.webhooksReceived[key]))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, b.String())
+}
+
+func withLabels(base, extra map[string]string) map[string]string {
+	labels := make(map[string]string, len(base)+len(extra))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
+
+func writeMetricHeader(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a sample in the Prometheus text format, with its labels
+// sorted by name as the Prometheus client does.
+func writeSample(b *strings.Builder, name string, labels map[string]string, value float64) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, labelValueEscaper.Replace(labels[k])))
+	}
+	fmt.Fprintf(b, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+}
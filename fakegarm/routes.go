@@ -0,0 +1,119 @@
+package fakegarm
+
+import (
+	"net/http"
+	"strings"
+
+	garmParams "github.com/cloudbase/garm/params"
+)
+
+type access int
+
+const (
+	// accessPublic routes can be called before the controller is initialized.
+	accessPublic access = iota
+	// accessInitialized routes need a first run, but no token.
+	accessInitialized
+	// accessAuthenticated routes need a first run and a valid bearer token.
+	accessAuthenticated
+)
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, vars map[string]string)
+
+type route struct {
+	method  string
+	pattern []string
+	access  access
+	handler handlerFunc
+}
+
+func (rt route) match(method string, segments []string) (map[string]string, bool) {
+	if rt.method != method || len(rt.pattern) != len(segments) {
+		return nil, false
+	}
+	vars := map[string]string{}
+	for idx, part := range rt.pattern {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			vars[strings.Trim(part, "{}")] = segments[idx]
+			continue
+		}
+		if part != segments[idx] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+func newRoute(method, pattern string, acc access, handler handlerFunc) route {
+	return route{
+		method:  method,
+		pattern: splitPath(pattern),
+		access:  acc,
+		handler: handler,
+	}
+}
+
+// entityRoutes maps the API path of each entity type to its pool type.
+var entityRoutes = []struct {
+	path string
+	kind garmParams.PoolType
+}{
+	{"repositories", garmParams.RepositoryPool},
+	{"organizations", garmParams.OrganizationPool},
+	{"enterprises", garmParams.EnterprisePool},
+}
+
+func (s *Server) routes() []route {
+	routes := []route{
+		newRoute("POST", "/first-run", accessPublic, s.firstRunHandler),
+		newRoute("POST", "/auth/login", accessInitialized, s.loginHandler),
+
+		newRoute("GET", "/metrics-token", accessAuthenticated, s.metricsTokenHandler),
+		newRoute("GET", "/jobs", accessAuthenticated, s.listJobsHandler),
+		newRoute("GET", "/credentials", accessAuthenticated, s.listCredentialsHandler),
+		newRoute("GET", "/providers", accessAuthenticated, s.listProvidersHandler),
+
+		newRoute("GET", "/pools", accessAuthenticated, s.listPoolsHandler),
+		newRoute("GET", "/pools/{poolID}", accessAuthenticated, s.getPoolHandler),
+		newRoute("PUT", "/pools/{poolID}", accessAuthenticated, s.updatePoolHandler),
+		newRoute("DELETE", "/pools/{poolID}", accessAuthenticated, s.deletePoolHandler),
+		newRoute("GET", "/pools/{poolID}/instances", accessAuthenticated, s.listPoolInstancesHandler),
+
+		newRoute("GET", "/instances", accessAuthenticated, s.listInstancesHandler),
+		newRoute("GET", "/instances/{instanceName}", accessAuthenticated, s.getInstanceHandler),
+		newRoute("DELETE", "/instances/{instanceName}", accessAuthenticated, s.deleteInstanceHandler),
+
+		// Runners authenticate with the token of their instance.
+		newRoute("POST", "/callbacks/status", accessPublic, s.instanceStatusHandler),
+		newRoute("POST", "/callbacks/status/", accessPublic, s.instanceStatusHandler),
+		newRoute("GET", "/metadata/runner-registration-token", accessPublic, s.registrationTokenHandler),
+		newRoute("GET", "/metadata/runner-registration-token/", accessPublic, s.registrationTokenHandler),
+	}
+
+	for _, ent := range entityRoutes {
+		kind := ent.kind
+		base := "/" + ent.path
+		routes = append(routes,
+			newRoute("POST", base, accessAuthenticated, s.withKind(kind, s.createEntityHandler)),
+			newRoute("GET", base, accessAuthenticated, s.withKind(kind, s.listEntitiesHandler)),
+			newRoute("GET", base+"/{entityID}", accessAuthenticated, s.withKind(kind, s.getEntityHandler)),
+			newRoute("PUT", base+"/{entityID}", accessAuthenticated, s.withKind(kind, s.updateEntityHandler)),
+			newRoute("DELETE", base+"/{entityID}", accessAuthenticated, s.withKind(kind, s.deleteEntityHandler)),
+			newRoute("GET", base+"/{entityID}/instances", accessAuthenticated, s.withKind(kind, s.listEntityInstancesHandler)),
+			newRoute("POST", base+"/{entityID}/pools", accessAuthenticated, s.withKind(kind, s.createEntityPoolHandler)),
+			newRoute("GET", base+"/{entityID}/pools", accessAuthenticated, s.withKind(kind, s.listEntityPoolsHandler)),
+			newRoute("GET", base+"/{entityID}/pools/{poolID}", accessAuthenticated, s.withKind(kind, s.getEntityPoolHandler)),
+			newRoute("PUT", base+"/{entityID}/pools/{poolID}", accessAuthenticated, s.withKind(kind, s.updateEntityPoolHandler)),
+			newRoute("DELETE", base+"/{entityID}/pools/{poolID}", accessAuthenticated, s.withKind(kind, s.deleteEntityPoolHandler)),
+		)
+	}
+	return routes
+}
+
+type entityHandlerFunc func(w http.ResponseWriter, r *http.Request, kind garmParams.PoolType, vars map[string]string)
+
+func (s *Server) withKind(kind garmParams.PoolType, handler entityHandlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+		handler(w, r, kind, vars)
+	}
+}
@@ -0,0 +1,231 @@
+// Package fakegarm implements an in-memory stand-in for the GARM API server.
+//
+// It serves the same routes the swagger generated client.GarmAPI calls and
+// simulates runner instances moving through their lifecycle, so the test
+// client can run offline, without a live GARM and a working LXD provider.
+// Signed workflow_job webhooks posted to /webhooks are recorded as jobs and
+// update the runners they name, like GARM does, and /metrics exposes the
+// Prometheus metrics GARM does. The runners of external providers are only
+// installed once they call back, see Bootstrap.
+package fakegarm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbase/garm/apiserver/params"
+	garmParams "github.com/cloudbase/garm/params"
+	"github.com/google/uuid"
+)
+
+const apiPrefix = "/api/v1"
+
+// authFailed is what GARM's auth middleware answers requests without a valid
+// token with.
+var authFailed = params.APIErrorResponse{Error: "Authentication failed"}
+
+// Config holds the settings of a fake GARM server.
+type Config struct {
+	// Credentials are the GitHub credentials known to the server. Entities
+	// can only be created with, or updated to, one of these.
+	Credentials []garmParams.GithubCredentials
+	// Providers are the providers pools can be created with.
+	Providers []garmParams.Provider
+	// TickInterval is how often instances advance to the next stage of
+	// their lifecycle.
+	TickInterval time.Duration
+	// TokenTTL is the validity of the JWT tokens issued on login.
+	TokenTTL time.Duration
+	// CallbackURL and MetadataURL are where runners of external providers
+	// call back, like the settings of the same names of GARM. They are
+	// handed to runners with Bootstrap.
+	CallbackURL string
+	MetadataURL string
+}
+
+// DefaultConfig returns a configuration exposing an lxd_local provider, whose
+// runners install themselves, a fake external provider, whose runners wait
+// for their callbacks, and the given credentials names.
+func DefaultConfig(credentials ...string) Config {
+	cfg := Config{
+		Providers: []garmParams.Provider{
+			{
+				Name:         "lxd_local",
+				ProviderType: garmParams.LXDProvider,
+				Description:  "Local LXD installation",
+			},
+			{
+				Name:         "fake",
+				ProviderType: garmParams.ExternalProvider,
+				Description:  "synthetic instances",
+			},
+		},
+		TickInterval: 500 * time.Millisecond,
+		TokenTTL:     24 * time.Hour,
+	}
+	for _, name := range credentials {
+		cfg.Credentials = append(cfg.Credentials, garmParams.GithubCredentials{
+			Name:          name,
+			Description:   name,
+			BaseURL:       "https://github.com",
+			APIBaseURL:    "https://api.github.com",
+			UploadBaseURL: "https://uploads.github.com",
+		})
+	}
+	return cfg
+}
+
+// Server is an in-memory GARM API server. It implements http.Handler.
+type Server struct {
+	cfg       Config
+	jwtSecret []byte
+	router    []route
+
+	mux       sync.Mutex
+	user      *garmParams.User
+	password  string
+	entities  map[string]*entity
+	pools     map[string]*garmParams.Pool
+	instances map[string]*garmParams.Instance
+	jobs      []garmParams.Job
+
+	hostname         string
+	controllerID     string
+	webhooksReceived map[webhookLabels]int
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer returns a new fake server and starts the goroutine that drives
+// the instance lifecycle. Call Close to stop it.
+func NewServer(cfg Config) *Server {
+	if cfg.TickInterval == 0 {
+		cfg.TickInterval = DefaultConfig().TickInterval
+	}
+	if cfg.TokenTTL == 0 {
+		cfg.TokenTTL = DefaultConfig().TokenTTL
+	}
+	s := &Server{
+		cfg:       cfg,
+		jwtSecret: []byte(randomString(32)),
+		entities:  map[string]*entity{},
+		pools:     map[string]*garmParams.Pool{},
+		instances: map[string]*garmParams.Instance{},
+		quit:      make(chan struct{}),
+
+		controllerID:     newID(),
+		webhooksReceived: map[webhookLabels]int{},
+	}
+	s.hostname, _ = os.Hostname()
+	s.router = s.routes()
+	go s.loop()
+	return s
+}
+
+// Close stops the lifecycle goroutine.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+func (s *Server) loop() {
+	ticker := time.NewTicker(s.cfg.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.tick()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, webhooksPrefix) {
+		s.webhookHandler(w, r)
+		return
+	}
+	if strings.TrimSuffix(r.URL.Path, "/") == metricsPath {
+		s.metricsHandler(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		writeError(w, http.StatusNotFound, params.APIErrorResponse{Error: "Not found", Details: "Resource not found"})
+		return
+	}
+	segments := splitPath(strings.TrimPrefix(r.URL.Path, apiPrefix))
+	for _, rt := range s.router {
+		vars, ok := rt.match(r.Method, segments)
+		if !ok {
+			continue
+		}
+		switch rt.access {
+		case accessAuthenticated:
+			if !s.isInitialized() {
+				writeError(w, http.StatusConflict, params.InitializationRequired)
+				return
+			}
+			if _, ok := s.authenticate(r, false); !ok {
+				writeError(w, http.StatusUnauthorized, authFailed)
+				return
+			}
+		case accessInitialized:
+			if !s.isInitialized() {
+				writeError(w, http.StatusConflict, params.InitializationRequired)
+				return
+			}
+		}
+		rt.handler(w, r, vars)
+		return
+	}
+	writeError(w, http.StatusNotFound, params.APIErrorResponse{Error: "Not found", Details: "Resource not found"})
+}
+
+func (s *Server) isInitialized() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.user != nil
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to encode response: %q", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, apiErr params.APIErrorResponse) {
+	writeJSON(w, status, apiErr)
+}
+
+func newID() string {
+	return uuid.New().String()
+}
+
+func randomString(n int) string {
+	b := make([]byte, n/2+1)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)[:n]
+}
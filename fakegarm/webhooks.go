@@ -0,0 +1,239 @@
+package fakegarm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	garmParams "github.com/cloudbase/garm/params"
+	"github.com/google/uuid"
+)
+
+const webhooksPrefix = "/webhooks"
+
+// hookTargetTypes maps the X-Github-Hook-Installation-Target-Type header to
+// the entity type the hook was installed on.
+var hookTargetTypes = map[string]garmParams.PoolType{
+	"repository":   garmParams.RepositoryPool,
+	"organization": garmParams.OrganizationPool,
+	"business":     garmParams.EnterprisePool,
+}
+
+// webhookHandler handles the GitHub webhooks the way GARM does. Only
+// workflow_job events are processed, everything else is ignored, as are jobs
+// of entities GARM does not know about. Processed events are counted in the
+// garm_webhooks_received metric.
+func (s *Server) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Github-Event") != "workflow_job" {
+		log.Printf("ignoring unknown event %s", r.Header.Get("X-Github-Event"))
+		return
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		handleError(w, gErrors.NewBadRequestError("invalid post body: %s", err))
+		return
+	}
+	if len(body) == 0 {
+		handleError(w, gErrors.NewBadRequestError("missing job data"))
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var job garmParams.WorkflowJob
+	if err := json.Unmarshal(body, &job); err != nil {
+		s.recordWebhook(false, "unknown")
+		handleError(w, gErrors.NewBadRequestError("invalid job data: %s", err))
+		return
+	}
+	kind, ok := hookTargetTypes[r.Header.Get("X-Github-Hook-Installation-Target-Type")]
+	if !ok {
+		s.recordWebhook(false, "unknown")
+		handleError(w, gErrors.NewBadRequestError("cannot handle hook target type %s", r.Header.Get("X-Github-Hook-Installation-Target-Type")))
+		return
+	}
+	ent := s.findHookEntity(kind, job)
+	if ent == nil {
+		s.recordWebhook(false, "owner_unknown")
+		log.Printf("no %s configured for job %d, webhook not meant for us?", kind, job.WorkflowJob.ID)
+		return
+	}
+	if err := validateSignature(r.Header.Get("X-Hub-Signature-256"), ent.webhookSecret, body); err != nil {
+		s.recordWebhook(false, "signature_invalid")
+		handleError(w, err)
+		return
+	}
+	if err := s.handleWorkflowJob(ent, job); err != nil {
+		s.recordWebhook(false, "unknown")
+		handleError(w, err)
+		return
+	}
+	s.recordWebhook(true, "")
+}
+
+func (s *Server) findHookEntity(kind garmParams.PoolType, job garmParams.WorkflowJob) *entity {
+	for _, ent := range s.entities {
+		if ent.kind != kind {
+			continue
+		}
+		switch kind {
+		case garmParams.RepositoryPool:
+			if strings.EqualFold(ent.owner, job.Repository.Owner.Login) && strings.EqualFold(ent.name, job.Repository.Name) {
+				return ent
+			}
+		case garmParams.OrganizationPool:
+			if strings.EqualFold(ent.name, job.Organization.Login) {
+				return ent
+			}
+		case garmParams.EnterprisePool:
+			if strings.EqualFold(ent.name, job.Enterprise.Slug) {
+				return ent
+			}
+		}
+	}
+	return nil
+}
+
+func validateSignature(signature, secret string, body []byte) error {
+	if secret == "" {
+		return gErrors.NewMissingSecretError("missing secret to validate webhook signature")
+	}
+	if signature == "" {
+		return gErrors.NewUnauthorizedError("missing github signature")
+	}
+	hashType, value, ok := strings.Cut(signature, "=")
+	if !ok {
+		return gErrors.NewBadRequestError("invalid signature format")
+	}
+	if hashType != "sha256" {
+		return gErrors.NewBadRequestError("unknown signature type")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal([]byte(value), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return gErrors.NewUnauthorizedError("signature missmatch")
+	}
+	return nil
+}
+
+// handleWorkflowJob records the job and updates the runner it names. Jobs
+// are only recorded if a pool of the entity has all of their labels.
+func (s *Server) handleWorkflowJob(ent *entity, job garmParams.WorkflowJob) error {
+	record := garmParams.Job{
+		ID:              job.WorkflowJob.ID,
+		Action:          job.Action,
+		RunID:           job.WorkflowJob.RunID,
+		Status:          job.WorkflowJob.Status,
+		Conclusion:      job.WorkflowJob.Conclusion,
+		StartedAt:       job.WorkflowJob.StartedAt,
+		CompletedAt:     job.WorkflowJob.CompletedAt,
+		Name:            job.WorkflowJob.Name,
+		GithubRunnerID:  job.WorkflowJob.RunnerID,
+		RunnerName:      job.WorkflowJob.RunnerName,
+		RunnerGroupID:   job.WorkflowJob.RunnerGroupID,
+		RunnerGroupName: job.WorkflowJob.RunnerGroupName,
+		RepositoryName:  job.Repository.Name,
+		RepositoryOwner: job.Repository.Owner.Login,
+		Labels:          job.WorkflowJob.Labels,
+		UpdatedAt:       time.Now().UTC(),
+	}
+	entityID, err := uuid.Parse(ent.id)
+	if err != nil {
+		return err
+	}
+	switch ent.kind {
+	case garmParams.RepositoryPool:
+		record.RepoID = &entityID
+	case garmParams.OrganizationPool:
+		record.OrgID = &entityID
+	default:
+		record.EnterpriseID = &entityID
+	}
+	s.recordJob(ent, record)
+
+	if job.Action == "queued" || record.RunnerName == "" {
+		return nil
+	}
+	instance, ok := s.instances[record.RunnerName]
+	if !ok || !s.ownsPool(ent, instance.PoolID) {
+		// A runner of some other entity, or not managed by GARM at all.
+		return nil
+	}
+	switch job.Action {
+	case "in_progress":
+		instance.RunnerStatus = garmParams.RunnerActive
+		instance.StatusMessages = append(instance.StatusMessages,
+			statusMessage(garmParams.EventInfo, "runner picked up job %d", record.ID))
+	case "completed":
+		instance.RunnerStatus = garmParams.RunnerTerminated
+		instance.Status = commonParams.InstancePendingDelete
+		instance.StatusMessages = append(instance.StatusMessages,
+			statusMessage(garmParams.EventInfo, "job %d completed, removing runner", record.ID))
+	}
+	instance.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+func (s *Server) recordJob(ent *entity, record garmParams.Job) {
+	for i := range s.jobs {
+		if s.jobs[i].ID == record.ID {
+			record.CreatedAt = s.jobs[i].CreatedAt
+			record.LockedBy = s.jobs[i].LockedBy
+			s.jobs[i] = record
+			return
+		}
+	}
+	if !s.hasPoolMatchingLabels(ent, record.Labels) {
+		log.Printf("no pools matching tags %s; not recording job", strings.Join(record.Labels, ", "))
+		return
+	}
+	record.CreatedAt = record.UpdatedAt
+	s.jobs = append(s.jobs, record)
+}
+
+func (s *Server) ownsPool(ent *entity, poolID string) bool {
+	pool, ok := s.pools[poolID]
+	return ok && poolOwnerID(pool) == ent.id
+}
+
+func (s *Server) hasPoolMatchingLabels(ent *entity, labels []string) bool {
+	for _, pool := range s.pools {
+		if poolOwnerID(pool) == ent.id && poolHasLabels(pool, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolHasLabels reports whether pool has a tag for every label of a job.
+func poolHasLabels(pool *garmParams.Pool, labels []string) bool {
+	tags := map[string]bool{}
+	for _, tag := range pool.Tags {
+		tags[strings.ToLower(tag.Name)] = true
+	}
+	for _, label := range labels {
+		if !tags[strings.ToLower(label)] {
+			return false
+		}
+	}
+	return true
+}
+
+// jobOwnerID returns the ID of the entity a job belongs to.
+func jobOwnerID(job garmParams.Job) string {
+	for _, id := range []*uuid.UUID{job.RepoID, job.OrgID, job.EnterpriseID} {
+		if id != nil {
+			return id.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package fakeprovider
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockFile takes an exclusive lock on path by creating it, waiting for any
+// other process holding it to remove it.
+func lockFile(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,374 @@
+// Package fakeprovider implements a GARM external provider whose instances
+// only exist in a state file. GARM runs the provider executable once per
+// operation, so the instances are kept on disk between calls, under a lock.
+//
+// It lets a real GARM server run the suite on a machine without LXD or any
+// cloud: instances boot after a configurable delay and calls can be made to
+// fail at configurable rates, to exercise GARM's retries.
+package fakeprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/execution"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+)
+
+// Config is the provider config file GARM points the provider to, eg:
+//
+//	state_file = "/var/lib/garm/fake-provider.json"
+//	boot_delay = "5s"
+//	delete_delay = "1s"
+//	create_failure_rate = 0.1
+//	delete_failure_rate = 0.05
+//
+//	[runners]
+//	install_delay = "3s"
+//	failure_rate = 0.1
+type Config struct {
+	// StateFile holds the instances. It defaults to a file in the
+	// temporary directory, named after the controller.
+	StateFile string `toml:"state_file"`
+	// BootDelay is how long creating an instance takes. Instances show as
+	// pending_create meanwhile.
+	BootDelay Duration `toml:"boot_delay"`
+	// DeleteDelay is how long deleting an instance takes.
+	DeleteDelay Duration `toml:"delete_delay"`
+	// CreateFailureRate is the fraction of the creations that fail, from
+	// 0 to 1.
+	CreateFailureRate float64 `toml:"create_failure_rate"`
+	// DeleteFailureRate is the fraction of the deletions that fail.
+	DeleteFailureRate float64 `toml:"delete_failure_rate"`
+	// Runners configures the runners SimulateRunners plays.
+	Runners RunnersConfig `toml:"runners"`
+}
+
+// RunnersConfig configures the simulated runners.
+type RunnersConfig struct {
+	// InstallDelay is how long installing a runner takes, once its instance
+	// is running.
+	InstallDelay Duration `toml:"install_delay"`
+	// FailureRate is the fraction of the installs that fail.
+	FailureRate float64 `toml:"failure_rate"`
+	// PollInterval is how often the state file is checked for new
+	// instances. It defaults to a second.
+	PollInterval Duration `toml:"poll_interval"`
+}
+
+// Duration is a time.Duration written as a string in the config, eg: 5s.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// LoadConfig reads a provider config file.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return Config{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c Config) Validate() error {
+	for name, rate := range map[string]float64{
+		"create_failure_rate":  c.CreateFailureRate,
+		"delete_failure_rate":  c.DeleteFailureRate,
+		"runners.failure_rate": c.Runners.FailureRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+	if c.BootDelay.Duration < 0 || c.DeleteDelay.Duration < 0 || c.Runners.InstallDelay.Duration < 0 || c.Runners.PollInterval.Duration < 0 {
+		return fmt.Errorf("delays cannot be negative")
+	}
+	return nil
+}
+
+// instance is an instance as kept in the state file.
+type instance struct {
+	commonParams.ProviderInstance
+	PoolID       string `json:"pool_id"`
+	ControllerID string `json:"controller_id"`
+	// Bootstrap holds what GARM passed to CreateInstance, eg: the callback
+	// URL and the token of the runner.
+	Bootstrap commonParams.BootstrapInstance `json:"bootstrap"`
+	CreatedAt time.Time                      `json:"created_at"`
+	// RunnerStatus is the last status SimulateRunners reported for the
+	// runner. Instances without one have yet to be picked up.
+	RunnerStatus string `json:"runner_status,omitempty"`
+}
+
+// Provider is a fake external provider. It implements
+// execution.ExternalProvider.
+type Provider struct {
+	cfg          Config
+	controllerID string
+}
+
+var _ execution.ExternalProvider = &Provider{}
+
+// NewProvider returns a provider configured by cfg, acting for the given
+// controller.
+func NewProvider(cfg Config, controllerID string) *Provider {
+	if cfg.StateFile == "" {
+		cfg.StateFile = filepath.Join(os.TempDir(), "garm-fake-provider-"+controllerID+".json")
+	}
+	return &Provider{cfg: cfg, controllerID: controllerID}
+}
+
+// CreateInstance records the instance as pending_create, waits for it to
+// boot, then marks it running. The runner on it is left to SimulateRunners.
+func (p *Provider) CreateInstance(ctx context.Context, bootstrapParams commonParams.BootstrapInstance) (commonParams.ProviderInstance, error) {
+	if fails(p.cfg.CreateFailureRate) {
+		return commonParams.ProviderInstance{}, fmt.Errorf("simulated failure creating %s", bootstrapParams.Name)
+	}
+	created := instance{
+		ProviderInstance: commonParams.ProviderInstance{
+			ProviderID: bootstrapParams.Name,
+			Name:       bootstrapParams.Name,
+			OSType:     bootstrapParams.OSType,
+			OSArch:     bootstrapParams.OSArch,
+			OSName:     "ubuntu",
+			OSVersion:  "22.04",
+			Status:     commonParams.InstancePendingCreate,
+		},
+		PoolID:       bootstrapParams.PoolID,
+		ControllerID: p.controllerID,
+		Bootstrap:    bootstrapParams,
+		CreatedAt:    time.Now().UTC(),
+	}
+	err := p.update(func(instances map[string]*instance) error {
+		if _, ok := instances[created.Name]; ok {
+			return fmt.Errorf("instance %s: %w", created.Name, gErrors.ErrDuplicateEntity)
+		}
+		instances[created.Name] = &created
+		return nil
+	})
+	if err != nil {
+		return commonParams.ProviderInstance{}, err
+	}
+
+	if err := sleep(ctx, p.cfg.BootDelay.Duration); err != nil {
+		return commonParams.ProviderInstance{}, err
+	}
+	var booted commonParams.ProviderInstance
+	err = p.update(func(instances map[string]*instance) error {
+		inst, ok := instances[created.Name]
+		if !ok {
+			return fmt.Errorf("instance %s was deleted while booting: %w", created.Name, gErrors.ErrNotFound)
+		}
+		inst.Status = commonParams.InstanceRunning
+		inst.Addresses = []commonParams.Address{
+			{Address: fakeAddress(created.Name), Type: commonParams.PrivateAddress},
+		}
+		booted = inst.ProviderInstance
+		return nil
+	})
+	return booted, err
+}
+
+// DeleteInstance removes an instance. Instances that do not exist, or belong
+// to another controller, are already deleted, as far as GARM is concerned.
+func (p *Provider) DeleteInstance(ctx context.Context, name string) error {
+	if fails(p.cfg.DeleteFailureRate) {
+		return fmt.Errorf("simulated failure deleting %s", name)
+	}
+	found := false
+	err := p.update(func(instances map[string]*instance) error {
+		if inst, ok := p.get(instances, name); ok {
+			inst.Status = commonParams.InstanceDeleting
+			found = true
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return err
+	}
+	if err := sleep(ctx, p.cfg.DeleteDelay.Duration); err != nil {
+		return err
+	}
+	return p.update(func(instances map[string]*instance) error {
+		if _, ok := p.get(instances, name); ok {
+			delete(instances, name)
+		}
+		return nil
+	})
+}
+
+func (p *Provider) GetInstance(ctx context.Context, name string) (commonParams.ProviderInstance, error) {
+	var found commonParams.ProviderInstance
+	err := p.view(func(instances map[string]*instance) error {
+		inst, ok := p.get(instances, name)
+		if !ok {
+			return fmt.Errorf("instance %s: %w", name, gErrors.ErrNotFound)
+		}
+		found = inst.ProviderInstance
+		return nil
+	})
+	return found, err
+}
+
+func (p *Provider) ListInstances(ctx context.Context, poolID string) ([]commonParams.ProviderInstance, error) {
+	listed := []commonParams.ProviderInstance{}
+	err := p.view(func(instances map[string]*instance) error {
+		for _, inst := range sorted(instances) {
+			if inst.PoolID == poolID && p.owns(inst) {
+				listed = append(listed, inst.ProviderInstance)
+			}
+		}
+		return nil
+	})
+	return listed, err
+}
+
+// RemoveAllInstances removes the instances of the controller.
+func (p *Provider) RemoveAllInstances(ctx context.Context) error {
+	return p.update(func(instances map[string]*instance) error {
+		for name, inst := range instances {
+			if p.owns(inst) {
+				delete(instances, name)
+			}
+		}
+		return nil
+	})
+}
+
+func (p *Provider) Stop(ctx context.Context, name string, force bool) error {
+	return p.setStatus(name, commonParams.InstanceStopped)
+}
+
+func (p *Provider) Start(ctx context.Context, name string) error {
+	return p.setStatus(name, commonParams.InstanceRunning)
+}
+
+func (p *Provider) setStatus(name string, status commonParams.InstanceStatus) error {
+	return p.update(func(instances map[string]*instance) error {
+		inst, ok := p.get(instances, name)
+		if !ok {
+			return fmt.Errorf("instance %s: %w", name, gErrors.ErrNotFound)
+		}
+		inst.Status = status
+		return nil
+	})
+}
+
+// owns reports whether inst was created for the controller of the provider.
+// The instances of the other controllers sharing the state file are out of
+// its reach.
+func (p *Provider) owns(inst *instance) bool {
+	return inst.ControllerID == p.controllerID
+}
+
+// get returns the named instance, if it belongs to the controller of the
+// provider.
+func (p *Provider) get(instances map[string]*instance, name string) (*instance, bool) {
+	inst, ok := instances[name]
+	if !ok || !p.owns(inst) {
+		return nil, false
+	}
+	return inst, true
+}
+
+// view calls fn with the instances in the state file.
+func (p *Provider) view(fn func(map[string]*instance) error) error {
+	return p.withState(false, fn)
+}
+
+// update calls fn with the instances in the state file and saves what fn
+// leaves in it, unless fn fails.
+func (p *Provider) update(fn func(map[string]*instance) error) error {
+	return p.withState(true, fn)
+}
+
+func (p *Provider) withState(save bool, fn func(map[string]*instance) error) error {
+	unlock, err := lockFile(p.cfg.StateFile + ".lock")
+	if err != nil {
+		return fmt.Errorf("locking %s: %w", p.cfg.StateFile, err)
+	}
+	defer unlock()
+
+	instances := map[string]*instance{}
+	data, err := os.ReadFile(p.cfg.StateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &instances); err != nil {
+			return fmt.Errorf("parsing %s: %w", p.cfg.StateFile, err)
+		}
+	}
+	if err := fn(instances); err != nil || !save {
+		return err
+	}
+	data, err = json.MarshalIndent(instances, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so a crash never leaves half a file.
+	tmp := p.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.cfg.StateFile)
+}
+
+func sorted(instances map[string]*instance) []*instance {
+	list := make([]*instance, 0, len(instances))
+	for _, inst := range instances {
+		list = append(list, inst)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func fails(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// fakeAddress returns an address of the 10.10.0.0/16 network, derived from
+// the name of the instance.
+func fakeAddress(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	n := h.Sum32()
+	return fmt.Sprintf("10.10.%d.%d", (n>>8)%256, n%253+2)
+}
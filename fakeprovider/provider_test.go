@@ -0,0 +1,65 @@
+package fakeprovider
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+)
+
+func TestProviderControllers(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{StateFile: filepath.Join(t.TempDir(), "state.json")}
+	mine := NewProvider(cfg, "controller-1")
+	other := NewProvider(cfg, "controller-2")
+
+	_, err := mine.CreateInstance(ctx, commonParams.BootstrapInstance{
+		Name:   "garm-runner-1",
+		PoolID: "pool-1",
+		OSType: commonParams.Linux,
+		OSArch: commonParams.Amd64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.GetInstance(ctx, "garm-runner-1"); !errors.Is(err, gErrors.ErrNotFound) {
+		t.Errorf("GetInstance of another controller's instance: got %v, want not found", err)
+	}
+	if err := other.Stop(ctx, "garm-runner-1", true); !errors.Is(err, gErrors.ErrNotFound) {
+		t.Errorf("Stop of another controller's instance: got %v, want not found", err)
+	}
+	if err := other.Start(ctx, "garm-runner-1"); !errors.Is(err, gErrors.ErrNotFound) {
+		t.Errorf("Start of another controller's instance: got %v, want not found", err)
+	}
+	if listed, err := other.ListInstances(ctx, "pool-1"); err != nil || len(listed) != 0 {
+		t.Errorf("ListInstances of another controller: got %v, %v, want none", listed, err)
+	}
+	if err := other.DeleteInstance(ctx, "garm-runner-1"); err != nil {
+		t.Errorf("DeleteInstance of another controller's instance: %v", err)
+	}
+	if err := other.RemoveAllInstances(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	inst, err := mine.GetInstance(ctx, "garm-runner-1")
+	if err != nil {
+		t.Fatalf("the other controller removed the instance: %v", err)
+	}
+	if inst.Status != commonParams.InstanceRunning {
+		t.Errorf("the other controller changed the status of the instance to %s", inst.Status)
+	}
+
+	if err := mine.Stop(ctx, "garm-runner-1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mine.DeleteInstance(ctx, "garm-runner-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mine.GetInstance(ctx, "garm-runner-1"); !errors.Is(err, gErrors.ErrNotFound) {
+		t.Errorf("GetInstance of a deleted instance: got %v, want not found", err)
+	}
+}
@@ -0,0 +1,124 @@
+package fakeprovider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm/params"
+
+	"garm-test-client/fakerunner"
+)
+
+// SimulateRunners plays the runner of every instance that boots, until ctx
+// is done: once an instance is running, it waits for the install delay, then
+// installs a runner on it, or fails to, with the callbacks of the bootstrap
+// params GARM passed to CreateInstance.
+//
+// Without a controller ID, the instances of all the controllers sharing the
+// state file are played. Instances labelled with fakerunner.ManualLabel are
+// left alone.
+func (p *Provider) SimulateRunners(ctx context.Context, client *http.Client) error {
+	interval := p.cfg.Runners.PollInterval.Duration
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		var claimed []instance
+		err := p.update(func(instances map[string]*instance) error {
+			for _, inst := range sorted(instances) {
+				if !p.simulated(inst) {
+					continue
+				}
+				inst.RunnerStatus = string(params.RunnerPending)
+				claimed = append(claimed, *inst)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, inst := range claimed {
+			wg.Add(1)
+			go func(inst instance) {
+				defer wg.Done()
+				p.simulate(ctx, inst, client)
+			}(inst)
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return nil
+		}
+	}
+}
+
+// simulated reports whether inst is running a runner SimulateRunners has
+// yet to play.
+func (p *Provider) simulated(inst *instance) bool {
+	if inst.RunnerStatus != "" || inst.Status != commonParams.InstanceRunning {
+		return false
+	}
+	if p.controllerID != "" && inst.ControllerID != p.controllerID {
+		return false
+	}
+	for _, label := range inst.Bootstrap.Labels {
+		if label == fakerunner.ManualLabel {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Provider) simulate(ctx context.Context, inst instance, client *http.Client) {
+	if err := sleep(ctx, p.cfg.Runners.InstallDelay.Duration); err != nil {
+		return
+	}
+	runner := fakerunner.New(inst.Bootstrap, client)
+	status := params.RunnerIdle
+	var err error
+	if fails(p.cfg.Runners.FailureRate) {
+		status = params.RunnerFailed
+		err = runner.Fail(ctx, "simulated failure installing the runner")
+	} else {
+		err = runner.Install(ctx, rand.Int63n(1<<31)+1)
+	}
+	if err != nil {
+		log.Printf("runner of %s: %v", inst.Name, err)
+		status = params.RunnerFailed
+	} else {
+		log.Printf("runner of %s: %s", inst.Name, status)
+	}
+
+	err = p.update(func(instances map[string]*instance) error {
+		// The instance may be gone already, GARM removes failed runners.
+		if current, ok := instances[inst.Name]; ok {
+			current.RunnerStatus = string(status)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("recording the runner of %s: %v", inst.Name, err)
+	}
+}
+
+// Bootstrap returns the bootstrap params GARM created the named instance
+// with.
+func (p *Provider) Bootstrap(name string) (commonParams.BootstrapInstance, error) {
+	var found commonParams.BootstrapInstance
+	err := p.view(func(instances map[string]*instance) error {
+		inst, ok := instances[name]
+		if !ok {
+			return fmt.Errorf("instance %s: %w", name, gErrors.ErrNotFound)
+		}
+		found = inst.Bootstrap
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,154 @@
+// Package fakerunner plays the part of the GitHub runner installed on an
+// instance. Like the install script GARM hands to providers, it fetches a
+// runner registration token from the metadata URL and reports its progress to
+// the callback URL, authenticated with the JWT of the instance, without
+// installing anything.
+package fakerunner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm/params"
+)
+
+// ManualLabel marks the pools whose runners are played by the test client,
+// step by step. Simulators leave their instances alone.
+const ManualLabel = "fake-runner-manual"
+
+// InstalledMessage is the message the runner reports as idle with.
+const InstalledMessage = "runner successfully installed"
+
+// InstallSteps are the messages the install script sends while installing.
+var InstallSteps = []string{
+	"downloading tools",
+	"extracting runner",
+	"configuring runner",
+	"installing runner service",
+	"starting service",
+}
+
+// StatusError is returned when GARM answers with a status other than 200.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d: %s", e.URL, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Runner reports to GARM for the instance it was bootstrapped with.
+type Runner struct {
+	Bootstrap commonParams.BootstrapInstance
+	Client    *http.Client
+}
+
+// New returns a runner for the instance bootstrapped with bootstrap. A nil
+// client stands for http.DefaultClient.
+func New(bootstrap commonParams.BootstrapInstance, client *http.Client) *Runner {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Runner{Bootstrap: bootstrap, Client: client}
+}
+
+// RegistrationToken fetches the token the runner registers with GitHub with.
+// GARM hands it out once per instance.
+func (r *Runner) RegistrationToken(ctx context.Context) (string, error) {
+	url := strings.TrimSuffix(r.Bootstrap.MetadataURL, "/") + "/runner-registration-token/"
+	body, err := r.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(body))
+	if token == "" {
+		return "", fmt.Errorf("%s: empty registration token", url)
+	}
+	return token, nil
+}
+
+// SendStatus reports the status of the runner, with a message GARM adds to
+// the status messages of the instance.
+func (r *Runner) SendStatus(ctx context.Context, status params.RunnerStatus, message string, agentID *int64) error {
+	payload, err := json.Marshal(params.InstanceUpdateMessage{
+		Status:  status,
+		Message: message,
+		AgentID: agentID,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.do(ctx, http.MethodPost, r.statusURL(), payload)
+	return err
+}
+
+// Install goes through what the install script does: it fetches the
+// registration token, reports every install step, then reports the runner as
+// idle, registered with agentID.
+func (r *Runner) Install(ctx context.Context, agentID int64) error {
+	if _, err := r.RegistrationToken(ctx); err != nil {
+		return fmt.Errorf("fetching the registration token: %w", err)
+	}
+	return r.ReportInstalled(ctx, agentID)
+}
+
+// ReportInstalled reports every install step, then the runner as idle,
+// registered with agentID. The registration token is left to the caller.
+func (r *Runner) ReportInstalled(ctx context.Context, agentID int64) error {
+	for _, step := range InstallSteps {
+		if err := r.SendStatus(ctx, params.RunnerInstalling, step, nil); err != nil {
+			return fmt.Errorf("reporting %q: %w", step, err)
+		}
+	}
+	return r.SendStatus(ctx, params.RunnerIdle, InstalledMessage, &agentID)
+}
+
+// Fail reports that installing the runner failed, the way the install script
+// does when one of its steps fails.
+func (r *Runner) Fail(ctx context.Context, reason string) error {
+	return r.SendStatus(ctx, params.RunnerFailed, reason, nil)
+}
+
+// statusURL is where statuses are posted: the callback URL, which the
+// install script completes with /status when it does not end with it.
+func (r *Runner) statusURL() string {
+	url := strings.TrimSuffix(r.Bootstrap.CallbackURL, "/")
+	if !strings.HasSuffix(url, "/status") {
+		url += "/status"
+	}
+	return url
+}
+
+func (r *Runner) do(ctx context.Context, method, url string, payload []byte) ([]byte, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.Bootstrap.InstanceToken)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return respBody, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// harPath is where the HTTP traffic of the run is written as a HAR file, when
+// set.
+var harPath = os.Getenv("GARM_HAR_FILE")
+
+// redactedHeaders are the headers carrying secrets: tokens, cookies and the
+// signatures derived from webhook secrets.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Hub-Signature":     true,
+	"X-Hub-Signature-256": true,
+}
+
+// secretPaths are the API paths answering with a bare secret.
+var secretPaths = []string{
+	"/metadata/runner-registration-token",
+}
+
+// //////////
+// HAR 1.2 //
+// //////////
+
+// harFile is the HAR document, see
+// http://www.softwareishard.com/blog/har-12-spec.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	// Comment names the step that made the call, and the error of calls
+	// that got no response.
+	Comment string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+// harTimings only tells the time spent waiting for the response apart: the
+// transport does not expose the others.
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// trafficCapture keeps every call going through recordingTransport, for the
+// HAR file.
+type trafficCapture struct {
+	mux     sync.Mutex
+	entries []harEntry
+}
+
+var traffic = &trafficCapture{}
+
+// add records a call made at start that took elapsed. Without a response,
+// err tells why.
+func (c *trafficCapture) add(step string, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, start time.Time, elapsed time.Duration, err error) {
+	if harPath == "" {
+		return
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	entry := harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         harURL(req.URL),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: harQuery(req.URL.Query()),
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{Wait: ms},
+		Comment: step,
+	}
+	if entry.Request.HTTPVersion == "" {
+		entry.Request.HTTPVersion = "HTTP/1.1"
+	}
+	if len(reqBody) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     redactBody(req.URL.Path, reqBody),
+		}
+	}
+	if err != nil {
+		entry.Comment = strings.TrimSpace(step + ": " + err.Error())
+	} else {
+		entry.Response.Status = resp.StatusCode
+		entry.Response.StatusText = http.StatusText(resp.StatusCode)
+		entry.Response.HTTPVersion = resp.Proto
+		entry.Response.Headers = harHeaders(resp.Header)
+		entry.Response.BodySize = len(respBody)
+		entry.Response.Content = harContent{
+			Size:     len(respBody),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     redactBody(req.URL.Path, respBody),
+		}
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries = append(c.entries, entry)
+}
+
+// write writes the calls captured so far to path, as a HAR file.
+func (c *trafficCapture) write(path string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	har := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "garm-test-client", Version: runID},
+		Entries: c.entries,
+	}}
+	if har.Log.Entries == nil {
+		har.Log.Entries = []harEntry{}
+	}
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for key, values := range header {
+		for _, value := range values {
+			if redactedHeaders[http.CanonicalHeaderKey(key)] {
+				value = "REDACTED"
+			}
+			headers = append(headers, harNameValue{Name: key, Value: value})
+		}
+	}
+	sort.SliceStable(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+// harURL returns u with the values of its secret query parameters redacted.
+func harURL(u *url.URL) string {
+	query := u.Query()
+	if !redactQuery(query) {
+		return u.String()
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+func harQuery(query url.Values) []harNameValue {
+	redactQuery(query)
+	params := []harNameValue{}
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, harNameValue{Name: key, Value: value})
+		}
+	}
+	sort.SliceStable(params, func(i, j int) bool { return params[i].Name < params[j].Name })
+	return params
+}
+
+// redactQuery redacts the values of the query parameters named like the
+// secret fields of JSON documents, telling whether there were any.
+func redactQuery(query url.Values) bool {
+	redacted := false
+	for key, values := range query {
+		if !redactedFields[key] {
+			continue
+		}
+		for i := range values {
+			values[i] = "REDACTED"
+		}
+		redacted = true
+	}
+	return redacted
+}
+
+// redactBody returns body with its secrets redacted. Bodies of JSON documents
+// lose the values of their secret fields, bodies of the paths answering with
+// a bare secret are dropped.
+func redactBody(path string, body []byte) string {
+	if isSecretPath(path) {
+		return "REDACTED"
+	}
+	if !json.Valid(body) {
+		return string(body)
+	}
+	return string(redactJSON(body))
+}
+
+func isSecretPath(path string) bool {
+	for _, secret := range secretPaths {
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), secret) {
+			return true
+		}
+	}
+	return false
+}
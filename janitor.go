@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cloudbase/garm/params"
+)
+
+// janitorOptions tells the janitor what to sweep.
+type janitorOptions struct {
+	// OlderThan leaves alone the pools created more recently, they may
+	// belong to runs still going.
+	OlderThan time.Duration
+	// DryRun only prints what would be removed.
+	DryRun bool
+}
+
+// leakedPool is a pool the janitor removes, with what it knows about it.
+type leakedPool struct {
+	pool params.Pool
+	// age is zero when the pool does not record when it was created.
+	age time.Duration
+}
+
+func (l leakedPool) String() string {
+	age := "unknown"
+	if l.age > 0 {
+		age = l.age.Round(time.Minute).String()
+	}
+	run := poolRunID(l.pool)
+	if run == "" {
+		run = "unknown"
+	}
+	return fmt.Sprintf("pool %s of %s (run %s, age %s, %d instances)",
+		l.pool.ID, poolOwner(l.pool), run, age, len(l.pool.Instances))
+}
+
+// poolOwner describes the entity a pool belongs to, eg: repo owner/name.
+func poolOwner(pool params.Pool) string {
+	switch pool.PoolType() {
+	case params.RepositoryPool:
+		return "repo " + pool.RepoName
+	case params.OrganizationPool:
+		return "org " + pool.OrgName
+	default:
+		return "enterprise " + pool.EnterpriseName
+	}
+}
+
+// createdByClient reports whether pool was created by this client: by the run
+// given with --run-id, found by its tag or runner prefix, or by any run when
+// no run ID was given.
+func createdByClient(pool params.Pool) bool {
+	if !runIDGenerated {
+		return poolTagged(pool, runTag()) || strings.HasSuffix(pool.GetRunnerPrefix(), "-"+runID)
+	}
+	return poolTagged(pool, runLabel)
+}
+
+// findLeakedPools returns the pools created by this client at least
+// olderThan ago. Pools not recording when they were created are taken as old.
+func findLeakedPools(olderThan time.Duration) ([]leakedPool, error) {
+	pools, err := listPools(cli, authToken)
+	if err != nil {
+		return nil, err
+	}
+	var leaked []leakedPool
+	for _, pool := range pools {
+		// Owner markers go along with their entity.
+		if !createdByClient(pool) || isOwnerMarker(pool) {
+			continue
+		}
+		l := leakedPool{pool: pool}
+		if !l.old(olderThan) {
+			log.Printf("keeping pool %s of %s, created %s ago", pool.ID, poolOwner(pool), l.age.Round(time.Second))
+			continue
+		}
+		leaked = append(leaked, l)
+	}
+	return leaked, nil
+}
+
+// old sets the age of the pool and reports whether it was created at least
+// olderThan ago. Pools not recording when they were created are taken as
+// old.
+func (l *leakedPool) old(olderThan time.Duration) bool {
+	created, ok := poolCreatedAt(l.pool)
+	if !ok {
+		return true
+	}
+	l.age = time.Since(created)
+	return l.age >= olderThan
+}
+
+// unusedEntity is an entity the janitor removes, along with its owner marker.
+type unusedEntity struct {
+	EntityInfo
+	marker leakedPool
+	// leaked are the IDs of the leaked pools of the entity, which have to be
+	// gone before the entity can be deleted.
+	leaked []string
+}
+
+// poolLeft returns a leaked pool of the entity that is not among the deleted
+// ones, if any.
+func (u unusedEntity) poolLeft(deleted map[string]bool) (string, bool) {
+	for _, id := range u.leaked {
+		if !deleted[id] {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// findUnusedEntities returns the entities this client created at least
+// olderThan ago, going by their owner marker, and that have no pools left once
+// the leaked pools are gone. They are not looked up by name, the entities of
+// the default scenario are named after the run that created them.
+func findUnusedEntities(leaked []leakedPool, olderThan time.Duration) (map[Entity][]unusedEntity, error) {
+	removed := map[string]bool{}
+	for _, l := range leaked {
+		removed[l.pool.ID] = true
+	}
+	unused := map[Entity][]unusedEntity{}
+	for _, e := range []Entity{repo, org, enterprise} {
+		entities, err := e.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, entity := range entities {
+			pools, err := e.ListPools(entity.ID)
+			if err != nil {
+				return nil, err
+			}
+			var left params.Pools
+			var leakedIDs []string
+			for _, pool := range pools {
+				if removed[pool.ID] {
+					leakedIDs = append(leakedIDs, pool.ID)
+					continue
+				}
+				left = append(left, pool)
+			}
+			marker, others, found := ownerMarker(left, createdByClient)
+			switch {
+			case !found:
+				log.Printf("keeping %s %s, it has no owner marker of this client", e.Kind(), entity.Name)
+				continue
+			case others > 0:
+				log.Printf("keeping %s %s, it has pools that are not leaked (%d)", e.Kind(), entity.Name, others)
+				continue
+			}
+			m := leakedPool{pool: marker}
+			if !m.old(olderThan) {
+				log.Printf("keeping %s %s, created %s ago", e.Kind(), entity.Name, m.age.Round(time.Second))
+				continue
+			}
+			unused[e] = append(unused[e], unusedEntity{EntityInfo: entity, marker: m, leaked: leakedIDs})
+		}
+	}
+	return unused, nil
+}
+
+// janitor removes what aborted runs leaked: it disables their pools, deletes
+// the instances, waits for the pools to drain, then deletes the pools and the
+// entities they leave unused.
+func janitor(opts janitorOptions) error {
+	leaked, err := findLeakedPools(opts.OlderThan)
+	if err != nil {
+		return err
+	}
+	unused, err := findUnusedEntities(leaked, opts.OlderThan)
+	if err != nil {
+		return err
+	}
+
+	verb := "removing"
+	if opts.DryRun {
+		verb = "would remove"
+	}
+	for _, l := range leaked {
+		log.Printf("%s %s", verb, l)
+		for _, instance := range l.pool.Instances {
+			log.Printf("  instance %s (%s/%s)", instance.Name, instance.Status, instance.RunnerStatus)
+		}
+	}
+	for _, e := range []Entity{repo, org, enterprise} {
+		for _, entity := range unused[e] {
+			log.Printf("%s %s %s (%s) and its owner marker, %s", verb, e.Kind(), entity.Name, entity.ID, entity.marker)
+		}
+	}
+	if len(leaked) == 0 && len(unused) == 0 {
+		log.Println("nothing leaked")
+		return nil
+	}
+	if opts.DryRun {
+		return nil
+	}
+
+	var errs []error
+	var draining []leakedPool
+	deleted := map[string]bool{}
+	enabled := false
+	for _, l := range leaked {
+		if _, err := updatePool(cli, authToken, l.pool.ID, params.UpdatePoolParams{Enabled: &enabled}); err != nil {
+			errs = append(errs, fmt.Errorf("disabling pool %s: %w", l.pool.ID, err))
+			continue
+		}
+		draining = append(draining, l)
+	}
+	// Every pool is disabled before any instance is deleted, so none of them
+	// gets replaced.
+	for _, l := range draining {
+		instances, err := listPoolInstances(cli, authToken, l.pool.ID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, instance := range instances {
+			if err := deleteInstance(cli, authToken, instance.Name); err != nil && !isNotFound(err) {
+				errs = append(errs, fmt.Errorf("deleting instance %s: %w", instance.Name, err))
+			}
+		}
+	}
+	for _, l := range draining {
+		log.Printf(">>> Wait until pool %s has no instances", l.pool.ID)
+		err := waitPoolNoInstances(runCtx, "pool "+l.pool.ID, func() (*params.Pool, error) {
+			return getPool(cli, authToken, l.pool.ID)
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := deletePool(cli, authToken, l.pool.ID); err != nil {
+			errs = append(errs, fmt.Errorf("deleting pool %s: %w", l.pool.ID, err))
+			continue
+		}
+		deleted[l.pool.ID] = true
+		log.Printf("pool %s deleted", l.pool.ID)
+	}
+	for _, e := range []Entity{repo, org, enterprise} {
+		for _, entity := range unused[e] {
+			// The marker stays until the entity can go, a later sweep
+			// needs it to delete the entity.
+			if id, left := entity.poolLeft(deleted); left {
+				log.Printf("keeping %s %s, its leaked pool %s is left", e.Kind(), entity.Name, id)
+				continue
+			}
+			entityDeleted, err := deleteMarkedEntity(e, entity.ID, entity.marker.pool)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("deleting %s %s: %w", e.Kind(), entity.Name, err))
+				continue
+			}
+			if entityDeleted {
+				log.Printf("%s %s deleted", e.Kind(), entity.Name)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
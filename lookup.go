@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudbase/garm/params"
+)
+
+// runLabel is added to the tags of the pools the suite creates, so they are
+// never mistaken for pools someone else created on a shared GARM.
+const runLabel = "garm-test-client"
+
+// createdTagPrefix starts the tag recording when a pool was created, as a
+// Unix timestamp. GARM keeps no creation time for pools, the janitor needs it
+// to tell leaked pools from the pools of runs still going.
+const createdTagPrefix = runLabel + "-created-"
+
+// ownerLabel tags the owner marker of the entities this client created: a
+// disabled pool without runners, created along with the entity. GARM keeps
+// nothing on entities telling who created them, pools have tags.
+const ownerLabel = runLabel + "-owner"
+
+// runID tells the resources of a run apart from those of the other runs
+// sharing the same GARM. It is generated when not given, passing the ID of an
+// earlier run picks up the pools it left behind.
+var runID = os.Getenv("GARM_RUN_ID")
+
+// runIDGenerated is set when runID was not given.
+var runIDGenerated bool
+
+// runIDPattern keeps run IDs usable in tags and runner names.
+var runIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$`)
+
+// resolveRunID generates runID when it is not set and exports it as
+// GARM_RUN_ID, so scenario files can refer to it.
+func resolveRunID() error {
+	if runID == "" {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("generating a run ID: %w", err)
+		}
+		runID = hex.EncodeToString(b)
+		runIDGenerated = true
+	}
+	if !runIDPattern.MatchString(runID) {
+		return fmt.Errorf("invalid run ID %q: expected up to 32 lowercase letters, digits and dashes", runID)
+	}
+	// The run tag of such IDs would be read as an owner marker or a
+	// creation time.
+	if tag := runTag(); tag == ownerLabel || strings.HasPrefix(tag, createdTagPrefix) {
+		return fmt.Errorf("invalid run ID %q: its tag %s is reserved", runID, tag)
+	}
+	return os.Setenv("GARM_RUN_ID", runID)
+}
+
+// runTag is the tag of the pools created by this run.
+func runTag() string {
+	return runLabel + "-" + runID
+}
+
+// runName returns name followed by the run ID, once there is one.
+func runName(name string) string {
+	if runID == "" {
+		return name
+	}
+	return name + "-" + runID
+}
+
+// defaultLabels are the labels GARM adds to every pool on its own, from its
+// OS type and architecture. They are left out of fingerprints, the OS type and
+// architecture are part of them already.
+var defaultLabels = map[string]bool{
+	"self-hosted": true,
+	"x64":         true,
+	"arm":         true,
+	"arm64":       true,
+	"linux":       true,
+	"windows":     true,
+	"macos":       true,
+}
+
+// sameEntityName reports whether an entity named name is the one named want.
+// GitHub names are case insensitive, as are GARM's duplicate checks.
+func sameEntityName(name, want string) bool {
+	return strings.EqualFold(name, want)
+}
+
+// findEntity returns the entity of the kind of e named after the scenario, if
+// it exists.
+func findEntity(e Entity) (EntityInfo, bool, error) {
+	entities, err := e.List()
+	if err != nil {
+		return EntityInfo{}, false, err
+	}
+	for _, entity := range entities {
+		if sameEntityName(entity.Name, e.Name()) {
+			return entity, true, nil
+		}
+	}
+	return EntityInfo{}, false, nil
+}
+
+// forRun returns poolParams tagged with runLabel and runTag, and with runID
+// in the runner prefix, so the pool and its runners can be told apart from
+// those of other runs.
+func forRun(poolParams params.CreatePoolParams) params.CreatePoolParams {
+	tags := append([]string{}, poolParams.Tags...)
+	for _, label := range []string{runLabel, runTag()} {
+		if !hasTag(tags, label) {
+			tags = append(tags, label)
+		}
+	}
+	if !hasCreatedTag(tags) {
+		tags = append(tags, createdTagPrefix+strconv.FormatInt(time.Now().Unix(), 10))
+	}
+	poolParams.Tags = tags
+	if prefix := poolParams.GetRunnerPrefix(); !strings.Contains(prefix, runID) {
+		poolParams.RunnerPrefix.Prefix = prefix + "-" + runID
+	}
+	return poolParams
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCreatedTag(tags []string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(strings.ToLower(tag), createdTagPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolCreatedAt returns when pool was created, as recorded by forRun.
+func poolCreatedAt(pool params.Pool) (time.Time, bool) {
+	for _, tag := range pool.Tags {
+		unix, ok := strings.CutPrefix(strings.ToLower(tag.Name), createdTagPrefix)
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.ParseInt(unix, 10, 64)
+		if err != nil {
+			continue
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
+// poolRunID returns the ID of the run that created pool, if it has one.
+func poolRunID(pool params.Pool) string {
+	for _, tag := range pool.Tags {
+		name := strings.ToLower(tag.Name)
+		if strings.HasPrefix(name, createdTagPrefix) || name == ownerLabel {
+			continue
+		}
+		if id, ok := strings.CutPrefix(name, runLabel+"-"); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// poolTagged reports whether pool has the given tag.
+func poolTagged(pool params.Pool, tag string) bool {
+	for _, t := range pool.Tags {
+		if strings.EqualFold(t.Name, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// createdByRun reports whether pool was created by this run.
+func createdByRun(pool params.Pool) bool {
+	return poolTagged(pool, runTag())
+}
+
+// runPools returns the pools among pools created by this run.
+func runPools(pools params.Pools) params.Pools {
+	var owned params.Pools
+	for _, pool := range pools {
+		if createdByRun(pool) {
+			owned = append(owned, pool)
+		}
+	}
+	return owned
+}
+
+// poolFingerprint identifies a pool by its provider, image, flavor, OS and
+// custom tags, so a pool created by an earlier run can be found again. The
+// tags are compared regardless of their case and order, the creation time is
+// left out.
+func poolFingerprint(provider, image, flavor, osType, osArch string, tags []string) string {
+	var custom []string
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(tag)
+		if defaultLabels[tag] || seen[tag] || strings.HasPrefix(tag, createdTagPrefix) {
+			continue
+		}
+		seen[tag] = true
+		custom = append(custom, tag)
+	}
+	sort.Strings(custom)
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		provider, image, flavor, osType, osArch, strings.Join(custom, ","),
+	}, "\n")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func paramsFingerprint(poolParams params.CreatePoolParams) string {
+	return poolFingerprint(poolParams.ProviderName, poolParams.Image, poolParams.Flavor,
+		string(poolParams.OSType), string(poolParams.OSArch), poolParams.Tags)
+}
+
+func existingPoolFingerprint(pool params.Pool) string {
+	tags := make([]string, 0, len(pool.Tags))
+	for _, tag := range pool.Tags {
+		tags = append(tags, tag.Name)
+	}
+	return poolFingerprint(pool.ProviderName, pool.Image, pool.Flavor,
+		string(pool.OSType), string(pool.OSArch), tags)
+}
+
+// findPool returns the pool among pools created with poolParams, leaving out
+// the pools with the IDs in skip.
+func findPool(pools params.Pools, poolParams params.CreatePoolParams, skip ...string) (params.Pool, bool) {
+	want := paramsFingerprint(poolParams)
+	for _, pool := range pools {
+		if existingPoolFingerprint(pool) != want || contains(skip, pool.ID) {
+			continue
+		}
+		return pool, true
+	}
+	return params.Pool{}, false
+}
+
+// ownerMarkerParams describes the owner marker of e: a disabled pool of the
+// provider of the pool of e, that never has runners. GARM allows a single pool
+// per provider, image and flavor on an entity, the marker has an image and a
+// flavor of its own so it never stands in the way of the pools of the suite.
+func ownerMarkerParams(e Entity) params.CreatePoolParams {
+	poolParams := entitySpec(e).Pool
+	poolParams.Image = ownerLabel
+	poolParams.Flavor = ownerLabel
+	poolParams.MinIdleRunners = 0
+	poolParams.MaxRunners = 1
+	poolParams.Enabled = false
+	poolParams.Tags = []string{ownerLabel}
+	return forRun(poolParams)
+}
+
+func isOwnerMarker(pool params.Pool) bool {
+	return poolTagged(pool, ownerLabel)
+}
+
+// ownerMarker returns the owner marker among pools that mine accepts, and how
+// many other pools there are.
+func ownerMarker(pools params.Pools, mine func(params.Pool) bool) (params.Pool, int, bool) {
+	var marker params.Pool
+	var found bool
+	others := 0
+	for _, pool := range pools {
+		if !found && isOwnerMarker(pool) && mine(pool) {
+			marker, found = pool, true
+			continue
+		}
+		others++
+	}
+	return marker, others, found
+}
+
+// deleteOwnedEntity deletes the entity with the given ID and its owner
+// marker, when the marker is one mine accepts and the entity has no other
+// pools. It reports whether the entity was deleted.
+func deleteOwnedEntity(e Entity, id string, mine func(params.Pool) bool) (bool, error) {
+	pools, err := e.ListPools(id)
+	if err != nil {
+		return false, err
+	}
+	marker, others, found := ownerMarker(pools, mine)
+	switch {
+	case !found:
+		log.Printf("%s %s has no owner marker of this run, leaving it", e.Kind(), id)
+		return false, nil
+	case others > 0:
+		// The marker stays, so the janitor can delete the entity once the
+		// other runs are done with it.
+		log.Printf("%s %s is still used by other runs, leaving it (%d pools)", e.Kind(), id, others)
+		return false, nil
+	}
+	return deleteMarkedEntity(e, id, marker)
+}
+
+// deleteMarkedEntity deletes marker, the owner marker of the entity with the
+// given ID, then the entity. GARM refuses to delete entities having pools, so
+// the marker has to go first; when the entity is left anyway, as another run
+// added a pool to it in the meantime, the marker is created again so the
+// entity can still be deleted later. It reports whether the entity was
+// deleted.
+func deleteMarkedEntity(e Entity, id string, marker params.Pool) (bool, error) {
+	if err := e.DeletePool(id, marker.ID); err != nil {
+		return false, fmt.Errorf("deleting the owner marker %s: %w", marker.ID, err)
+	}
+	deleted, err := deleteEntity(e, id)
+	if deleted {
+		return true, nil
+	}
+	if restoreErr := restoreOwnerMarker(e, id, marker); restoreErr != nil {
+		return false, errors.Join(err, restoreErr)
+	}
+	return false, err
+}
+
+// restoreOwnerMarker creates marker again on the entity with the given ID,
+// with the same tags, so it still tells which run created the entity and
+// when.
+func restoreOwnerMarker(e Entity, id string, marker params.Pool) error {
+	poolParams := params.CreatePoolParams{
+		RunnerPrefix:           marker.RunnerPrefix,
+		ProviderName:           marker.ProviderName,
+		MaxRunners:             marker.MaxRunners,
+		MinIdleRunners:         0,
+		Image:                  marker.Image,
+		Flavor:                 marker.Flavor,
+		OSType:                 marker.OSType,
+		OSArch:                 marker.OSArch,
+		Enabled:                false,
+		RunnerBootstrapTimeout: marker.RunnerBootstrapTimeout,
+	}
+	// GARM adds the default labels on its own.
+	for _, tag := range marker.Tags {
+		if !defaultLabels[strings.ToLower(tag.Name)] {
+			poolParams.Tags = append(poolParams.Tags, tag.Name)
+		}
+	}
+	restored, err := e.CreatePool(id, poolParams)
+	if err != nil {
+		return fmt.Errorf("restoring the owner marker of %s %s: %w", e.Kind(), id, err)
+	}
+	log.Printf("%s %s is still in use, restored its owner marker as %s", e.Kind(), id, restored.ID)
+	return nil
+}
+
+// deleteEntity deletes the entity with the given ID, unless the pools of
+// other runs still use it. It reports whether the entity was deleted.
+func deleteEntity(e Entity, id string) (bool, error) {
+	err := e.Delete(id)
+	if err == nil {
+		return true, nil
+	}
+	// GARM refuses to delete entities having pools, the runs owning them
+	// delete the entity once they are done.
+	code, payload, parseErr := errorResponse(err)
+	if parseErr == nil && code == http.StatusBadRequest && strings.Contains(payload.Details, "has pools defined") {
+		log.Printf("%s %s is still used by other runs, leaving it: %s", e.Kind(), id, payload.Details)
+		return false, nil
+	}
+	return false, err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// describePool is how pools show in logs: their image and fingerprint.
+func describePool(poolParams params.CreatePoolParams) string {
+	return fmt.Sprintf("%s (fingerprint %s)", poolParams.Image, paramsFingerprint(poolParams))
+}
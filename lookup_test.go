@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestResolveRunID(t *testing.T) {
+	saved, savedEnv := runID, os.Getenv("GARM_RUN_ID")
+	t.Cleanup(func() {
+		runID = saved
+		os.Setenv("GARM_RUN_ID", savedEnv)
+	})
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{"1a2b3c4d", false},
+		{"nightly-42", false},
+		{"owners", false},
+		{"created", false},
+		{"Nightly", true},
+		{"-nightly", true},
+		{"nightly_42", true},
+		{"owner", true},
+		{"created-1700000000", true},
+		{"created-nightly", true},
+	}
+	for _, tt := range tests {
+		runID = tt.id
+		if err := resolveRunID(); (err != nil) != tt.wantErr {
+			t.Errorf("resolveRunID() of %q error = %v, want an error: %v", tt.id, err, tt.wantErr)
+		}
+	}
+}
@@ -2,57 +2,46 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
-	commonParams "github.com/cloudbase/garm-provider-common/params"
 	client "github.com/cloudbase/garm/client"
 	clientCredentials "github.com/cloudbase/garm/client/credentials"
-	clientEnterprises "github.com/cloudbase/garm/client/enterprises"
 	clientFirstRun "github.com/cloudbase/garm/client/first_run"
 	clientInstances "github.com/cloudbase/garm/client/instances"
 	clientJobs "github.com/cloudbase/garm/client/jobs"
 	clientLogin "github.com/cloudbase/garm/client/login"
 	clientMetricsToken "github.com/cloudbase/garm/client/metrics_token"
-	clientOrganizations "github.com/cloudbase/garm/client/organizations"
 	clientPools "github.com/cloudbase/garm/client/pools"
 	clientProviders "github.com/cloudbase/garm/client/providers"
-	clientRepositories "github.com/cloudbase/garm/client/repositories"
 	"github.com/cloudbase/garm/cmd/garm-cli/config"
 	"github.com/cloudbase/garm/params"
 	"github.com/go-openapi/runtime"
 	openapiRuntimeClient "github.com/go-openapi/runtime/client"
 )
 
-const (
-	orgName        = "test-garm-org"
-	repoName       = "test-garm-repo"
-	enterpriseName = "cloudbase-solutions"
-)
-
 var (
 	cli       *client.GarmAPI
 	cfg       config.Config
 	authToken runtime.ClientAuthInfoWriter
+	// httpClient makes the calls the swagger client has no operation for,
+	// eg: webhooks and metrics scrapes.
+	httpClient = &http.Client{
+		Transport: &recordingTransport{next: http.DefaultTransport},
+		Timeout:   30 * time.Second,
+	}
 
-	credentialsName = os.Getenv("CREDENTIALS_NAME")
-
-	repoID            string
-	repoPoolID        string
-	repoInstanceName  string
-	repoWebhookSecret = os.Getenv("REPO_WEBHOOK_SECRET")
-
-	orgID            string
-	orgPoolID        string
-	orgInstanceName  string
-	orgWebhookSecret = os.Getenv("ORG_WEBHOOK_SECRET")
+	credentialsName           = os.Getenv("CREDENTIALS_NAME")
+	enterpriseCredentialsName = os.Getenv("ENTERPRISE_CREDENTIALS_NAME")
 
-	enterpriseID            string
-	enterprisePoolID        string
-	enterpriseInstanceName  string
+	repoWebhookSecret       = os.Getenv("REPO_WEBHOOK_SECRET")
+	orgWebhookSecret        = os.Getenv("ORG_WEBHOOK_SECRET")
 	enterpriseWebhookSecret = os.Getenv("ENTERPRISE_WEBHOOK_SECRET")
 
 	username = os.Getenv("GARM_USERNAME")
@@ -70,13 +59,50 @@ var (
 // ///////////////////
 func handleError(err error) {
 	if err != nil {
-		log.Fatalf("error encountered: %v", err)
+		log.Printf("error encountered: %v", err)
+		cleanups.unwind()
+		writeReports()
+		os.Exit(1)
+	}
+}
+
+// isNotFound reports whether err is an API error with a 404 status code.
+func isNotFound(err error) bool {
+	var apiErr interface{ IsCode(int) bool }
+	return errors.As(err, &apiErr) && apiErr.IsCode(http.StatusNotFound)
+}
+
+// statusError is returned by the calls made through httpClient when GARM
+// answers with an unexpected status code.
+type statusError struct {
+	What       string
+	StatusCode int
+	Body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d: %s", e.What, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+func formatStatusMessages(messages []params.StatusMessage) string {
+	if len(messages) == 0 {
+		return "  (none)"
+	}
+	lines := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		lines = append(lines, fmt.Sprintf("  %s [%s] %s", msg.CreatedAt.Format(time.RFC3339), msg.EventLevel, msg.Message))
 	}
+	return strings.Join(lines, "\n")
 }
 
+// printResponse logs resp. It does not fail the run, so the cleanup actions
+// calling it return their errors to the unwinding stack.
 func printResponse(resp interface{}) {
 	b, err := json.MarshalIndent(resp, "", "  ")
-	handleError(err)
+	if err != nil {
+		log.Printf("printing %T: %v", resp, err)
+		return
+	}
 	log.Println(string(b))
 }
 
@@ -152,216 +178,6 @@ func getMetricsToken(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfo
 	return getMetricsTokenResponse.Payload.Token, nil
 }
 
-// ///////////////
-// Repositories //
-// ///////////////
-func createRepo(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoParams params.CreateRepoParams) (*params.Repository, error) {
-	createRepoResponse, err := apiCli.Repositories.CreateRepo(
-		clientRepositories.NewCreateRepoParams().WithBody(repoParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &createRepoResponse.Payload, nil
-}
-
-func listRepos(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter) (params.Repositories, error) {
-	listReposResponse, err := apiCli.Repositories.ListRepos(
-		clientRepositories.NewListReposParams(),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listReposResponse.Payload, nil
-}
-
-func updateRepo(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID string, repoParams params.UpdateEntityParams) (*params.Repository, error) {
-	updateRepoResponse, err := apiCli.Repositories.UpdateRepo(
-		clientRepositories.NewUpdateRepoParams().WithRepoID(repoID).WithBody(repoParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &updateRepoResponse.Payload, nil
-}
-
-func getRepo(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID string) (*params.Repository, error) {
-	getRepoResponse, err := apiCli.Repositories.GetRepo(
-		clientRepositories.NewGetRepoParams().WithRepoID(repoID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &getRepoResponse.Payload, nil
-}
-
-func createRepoPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID string, poolParams params.CreatePoolParams) (*params.Pool, error) {
-	createRepoPoolResponse, err := apiCli.Repositories.CreateRepoPool(
-		clientRepositories.NewCreateRepoPoolParams().WithRepoID(repoID).WithBody(poolParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &createRepoPoolResponse.Payload, nil
-}
-
-func listRepoPools(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID string) (params.Pools, error) {
-	listRepoPoolsResponse, err := apiCli.Repositories.ListRepoPools(
-		clientRepositories.NewListRepoPoolsParams().WithRepoID(repoID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listRepoPoolsResponse.Payload, nil
-}
-
-func getRepoPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID, poolID string) (*params.Pool, error) {
-	getRepoPoolResponse, err := apiCli.Repositories.GetRepoPool(
-		clientRepositories.NewGetRepoPoolParams().WithRepoID(repoID).WithPoolID(poolID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &getRepoPoolResponse.Payload, nil
-}
-
-func updateRepoPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID, poolID string, poolParams params.UpdatePoolParams) (*params.Pool, error) {
-	updateRepoPoolResponse, err := apiCli.Repositories.UpdateRepoPool(
-		clientRepositories.NewUpdateRepoPoolParams().WithRepoID(repoID).WithPoolID(poolID).WithBody(poolParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &updateRepoPoolResponse.Payload, nil
-}
-
-func listRepoInstances(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID string) (params.Instances, error) {
-	listRepoInstancesResponse, err := apiCli.Repositories.ListRepoInstances(
-		clientRepositories.NewListRepoInstancesParams().WithRepoID(repoID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listRepoInstancesResponse.Payload, nil
-}
-
-func deleteRepo(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID string) error {
-	return apiCli.Repositories.DeleteRepo(
-		clientRepositories.NewDeleteRepoParams().WithRepoID(repoID),
-		apiAuthToken)
-}
-
-func deleteRepoPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, repoID, poolID string) error {
-	return apiCli.Repositories.DeleteRepoPool(
-		clientRepositories.NewDeleteRepoPoolParams().WithRepoID(repoID).WithPoolID(poolID),
-		apiAuthToken)
-}
-
-// ////////////////
-// Organizations //
-// ////////////////
-func createOrg(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgParams params.CreateOrgParams) (*params.Organization, error) {
-	createOrgResponse, err := apiCli.Organizations.CreateOrg(
-		clientOrganizations.NewCreateOrgParams().WithBody(orgParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &createOrgResponse.Payload, nil
-}
-
-func listOrgs(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter) (params.Organizations, error) {
-	listOrgsResponse, err := apiCli.Organizations.ListOrgs(
-		clientOrganizations.NewListOrgsParams(),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listOrgsResponse.Payload, nil
-}
-
-func updateOrg(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID string, orgParams params.UpdateEntityParams) (*params.Organization, error) {
-	updateOrgResponse, err := apiCli.Organizations.UpdateOrg(
-		clientOrganizations.NewUpdateOrgParams().WithOrgID(orgID).WithBody(orgParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &updateOrgResponse.Payload, nil
-}
-
-func getOrg(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID string) (*params.Organization, error) {
-	getOrgResponse, err := apiCli.Organizations.GetOrg(
-		clientOrganizations.NewGetOrgParams().WithOrgID(orgID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &getOrgResponse.Payload, nil
-}
-
-func createOrgPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID string, poolParams params.CreatePoolParams) (*params.Pool, error) {
-	createOrgPoolResponse, err := apiCli.Organizations.CreateOrgPool(
-		clientOrganizations.NewCreateOrgPoolParams().WithOrgID(orgID).WithBody(poolParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &createOrgPoolResponse.Payload, nil
-}
-
-func listOrgPools(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID string) (params.Pools, error) {
-	listOrgPoolsResponse, err := apiCli.Organizations.ListOrgPools(
-		clientOrganizations.NewListOrgPoolsParams().WithOrgID(orgID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listOrgPoolsResponse.Payload, nil
-}
-
-func getOrgPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID, poolID string) (*params.Pool, error) {
-	getOrgPoolResponse, err := apiCli.Organizations.GetOrgPool(
-		clientOrganizations.NewGetOrgPoolParams().WithOrgID(orgID).WithPoolID(poolID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &getOrgPoolResponse.Payload, nil
-}
-
-func updateOrgPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID, poolID string, poolParams params.UpdatePoolParams) (*params.Pool, error) {
-	updateOrgPoolResponse, err := apiCli.Organizations.UpdateOrgPool(
-		clientOrganizations.NewUpdateOrgPoolParams().WithOrgID(orgID).WithPoolID(poolID).WithBody(poolParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &updateOrgPoolResponse.Payload, nil
-}
-
-func listOrgInstances(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID string) (params.Instances, error) {
-	listOrgInstancesResponse, err := apiCli.Organizations.ListOrgInstances(
-		clientOrganizations.NewListOrgInstancesParams().WithOrgID(orgID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listOrgInstancesResponse.Payload, nil
-}
-
-func deleteOrg(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID string) error {
-	return apiCli.Organizations.DeleteOrg(
-		clientOrganizations.NewDeleteOrgParams().WithOrgID(orgID),
-		apiAuthToken)
-}
-
-func deleteOrgPool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, orgID, poolID string) error {
-	return apiCli.Organizations.DeleteOrgPool(
-		clientOrganizations.NewDeleteOrgPoolParams().WithOrgID(orgID).WithPoolID(poolID),
-		apiAuthToken)
-}
-
 // ////////////
 // Instances //
 // ////////////
@@ -440,111 +256,6 @@ func deletePool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWrite
 		apiAuthToken)
 }
 
-// ///////////////
-// Enterprises //
-// ///////////////
-func createEnterprise(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseParams params.CreateEnterpriseParams) (*params.Enterprise, error) {
-	createEnterpriseResponse, err := apiCli.Enterprises.CreateEnterprise(
-		clientEnterprises.NewCreateEnterpriseParams().WithBody(enterpriseParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &createEnterpriseResponse.Payload, nil
-}
-
-func listEnterprises(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter) (params.Enterprises, error) {
-	listEnterprisesResponse, err := apiCli.Enterprises.ListEnterprises(
-		clientEnterprises.NewListEnterprisesParams(),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listEnterprisesResponse.Payload, nil
-}
-
-func updateEnterprise(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID string, enterpriseParams params.UpdateEntityParams) (*params.Enterprise, error) {
-	updateEnterpriseResponse, err := apiCli.Enterprises.UpdateEnterprise(
-		clientEnterprises.NewUpdateEnterpriseParams().WithEnterpriseID(enterpriseID).WithBody(enterpriseParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &updateEnterpriseResponse.Payload, nil
-}
-
-func getEnterprise(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID string) (*params.Enterprise, error) {
-	getEnterpriseResponse, err := apiCli.Enterprises.GetEnterprise(
-		clientEnterprises.NewGetEnterpriseParams().WithEnterpriseID(enterpriseID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &getEnterpriseResponse.Payload, nil
-}
-
-func createEnterprisePool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID string, poolParams params.CreatePoolParams) (*params.Pool, error) {
-	createEnterprisePoolResponse, err := apiCli.Enterprises.CreateEnterprisePool(
-		clientEnterprises.NewCreateEnterprisePoolParams().WithEnterpriseID(enterpriseID).WithBody(poolParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &createEnterprisePoolResponse.Payload, nil
-}
-
-func listEnterprisesPools(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID string) (params.Pools, error) {
-	listEnterprisesPoolsResponse, err := apiCli.Enterprises.ListEnterprisePools(
-		clientEnterprises.NewListEnterprisePoolsParams().WithEnterpriseID(enterpriseID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listEnterprisesPoolsResponse.Payload, nil
-}
-
-func getEnterprisePool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID, poolID string) (*params.Pool, error) {
-	getEnterprisePoolResponse, err := apiCli.Enterprises.GetEnterprisePool(
-		clientEnterprises.NewGetEnterprisePoolParams().WithEnterpriseID(enterpriseID).WithPoolID(poolID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &getEnterprisePoolResponse.Payload, nil
-}
-
-func updateEnterprisePool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID, poolID string, poolParams params.UpdatePoolParams) (*params.Pool, error) {
-	updateEnterprisePoolResponse, err := apiCli.Enterprises.UpdateEnterprisePool(
-		clientEnterprises.NewUpdateEnterprisePoolParams().WithEnterpriseID(enterpriseID).WithPoolID(poolID).WithBody(poolParams),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return &updateEnterprisePoolResponse.Payload, nil
-}
-
-func listEnterpriseInstances(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID string) (params.Instances, error) {
-	listEnterpriseInstancesResponse, err := apiCli.Enterprises.ListEnterpriseInstances(
-		clientEnterprises.NewListEnterpriseInstancesParams().WithEnterpriseID(enterpriseID),
-		apiAuthToken)
-	if err != nil {
-		return nil, err
-	}
-	return listEnterpriseInstancesResponse.Payload, nil
-}
-
-func deleteEnterprise(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID string) error {
-	return apiCli.Enterprises.DeleteEnterprise(
-		clientEnterprises.NewDeleteEnterpriseParams().WithEnterpriseID(enterpriseID),
-		apiAuthToken)
-}
-
-func deleteEnterprisePool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAuthInfoWriter, enterpriseID, poolID string) error {
-	return apiCli.Enterprises.DeleteEnterprisePool(
-		clientEnterprises.NewDeleteEnterprisePoolParams().WithEnterpriseID(enterpriseID).WithPoolID(poolID),
-		apiAuthToken)
-}
-
 // /////////////////
 // Main functions //
 // /////////////////
@@ -552,14 +263,16 @@ func deleteEnterprisePool(apiCli *client.GarmAPI, apiAuthToken runtime.ClientAut
 // /////////////
 // Garm Init //
 // /////////////
-func Login() {
+func Login() error {
 	log.Println(">>> Login")
 	loginParams := params.PasswordLoginParams{
 		Username: username,
 		Password: password,
 	}
 	token, err := login(cli, loginParams)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	printResponse(token)
 	authToken = openapiRuntimeClient.BearerToken(token)
 	cfg.Managers = []config.Manager{
@@ -571,16 +284,21 @@ func Login() {
 	}
 	cfg.ActiveManager = name
 	err = cfg.SaveConfig()
-	handleError(err)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-func FirstRun() {
+func FirstRun() error {
 	existingCfg, err := config.LoadConfig()
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	if existingCfg != nil {
 		if existingCfg.HasManager(name) {
 			log.Println(">>> Already initialized")
-			return
+			return nil
 		}
 	}
 
@@ -592,747 +310,543 @@ func FirstRun() {
 		Email:    email,
 	}
 	user, err := firstRun(cli, newUser)
-	handleError(err)
+	if err != nil {
+		// The garm-cli config is local to the run, another run may have
+		// initialized GARM already.
+		if code, _, parseErr := errorResponse(err); parseErr == nil && code == http.StatusConflict {
+			log.Println("GARM was initialized by another run")
+			return nil
+		}
+		return err
+	}
 	printResponse(user)
+	return nil
 }
 
 // ////////////////////////////
 // Credentials and Providers //
 // ////////////////////////////
-func ListCredentials() {
+func ListCredentials() error {
 	log.Println(">>> List credentials")
 	credentials, err := listCredentials(cli, authToken)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	printResponse(credentials)
+	return nil
 }
 
-func ListProviders() {
+func ListProviders() error {
 	log.Println(">>> List providers")
 	providers, err := listProviders(cli, authToken)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	printResponse(providers)
+	return nil
 }
 
 // ////////
 // Jobs //
 // ////////
-func ListJobs() {
+func ListJobs() error {
 	log.Println(">>> List jobs")
 	jobs, err := listJobs(cli, authToken)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	printResponse(jobs)
+	return nil
 }
 
 // //////////////////
 // / Metrics Token //
 // //////////////////
-func GetMetricsToken() {
+func GetMetricsToken() error {
 	log.Println(">>> Get metrics token")
 	token, err := getMetricsToken(cli, authToken)
-	handleError(err)
-	printResponse(token)
-}
-
-// ///////////////
-// Repositories //
-// ///////////////
-func CreateRepo() {
-	repos, err := listRepos(cli, authToken)
-	handleError(err)
-	if len(repos) > 0 {
-		log.Println(">>> Repo already exists, skipping create")
-		repoID = repos[0].ID
-		return
+	if err != nil {
+		return err
 	}
-	log.Println(">>> Create repo")
-	createParams := params.CreateRepoParams{
-		Owner:           orgName,
-		Name:            repoName,
-		CredentialsName: credentialsName,
-		WebhookSecret:   repoWebhookSecret,
-	}
-	repo, err := createRepo(cli, authToken, createParams)
-	handleError(err)
-	printResponse(repo)
-	repoID = repo.ID
-}
-
-func ListRepos() {
-	log.Println(">>> List repos")
-	repos, err := listRepos(cli, authToken)
-	handleError(err)
-	printResponse(repos)
-}
-
-func UpdateRepo() {
-	log.Println(">>> Update repo")
-	updateParams := params.UpdateEntityParams{
-		CredentialsName: fmt.Sprintf("%s-clone", credentialsName),
-	}
-	repo, err := updateRepo(cli, authToken, repoID, updateParams)
-	handleError(err)
-	printResponse(repo)
-}
-
-func GetRepo() {
-	log.Println(">>> Get repo")
-	repo, err := getRepo(cli, authToken, repoID)
-	handleError(err)
-	printResponse(repo)
+	printResponse(token)
+	metricsToken = token
+	return nil
 }
 
-func CreateRepoPool() {
-	pools, err := listRepoPools(cli, authToken, repoID)
-	handleError(err)
-	if len(pools) > 0 {
-		log.Println(">>> Repo pool already exists, skipping create")
-		repoPoolID = pools[0].ID
-		return
+// ///////////
+// Entities //
+// ///////////
+func CreateEntity(e Entity) error {
+	state := e.State()
+	existing, found, err := findEntity(e)
+	if err != nil {
+		return err
+	}
+	if found {
+		state.id = existing.ID
+		state.webhookSecret = e.WebhookSecret()
+		pools, err := e.ListPools(existing.ID)
+		if err != nil {
+			return err
+		}
+		// A run picking up what it left behind owns the entities it created
+		// the first time.
+		if _, _, mine := ownerMarker(pools, createdByRun); mine {
+			log.Printf(">>> %s %s was created by this run already, skipping create", title(e), existing.Name)
+			state.owned = true
+			return nil
+		}
+		log.Printf(">>> %s %s already exists, skipping create; it is shared, the run neither updates nor deletes it",
+			title(e), existing.Name)
+		return nil
 	}
-	log.Println(">>> Create repo pool")
-	poolParams := params.CreatePoolParams{
-		MaxRunners:     2,
-		MinIdleRunners: 0,
-		Flavor:         "garm",
-		Image:          "ubuntu:22.04",
-		OSType:         commonParams.Linux,
-		OSArch:         commonParams.Amd64,
-		ProviderName:   "lxd_local",
-		Tags:           []string{"ubuntu", "simple-runner"},
-		Enabled:        true,
-	}
-	repo, err := createRepoPool(cli, authToken, repoID, poolParams)
-	handleError(err)
-	printResponse(repo)
-	repoPoolID = repo.ID
-}
-
-func ListRepoPools() {
-	log.Println(">>> List repo pools")
-	pools, err := listRepoPools(cli, authToken, repoID)
-	handleError(err)
-	printResponse(pools)
-}
-
-func GetRepoPool() {
-	log.Println(">>> Get repo pool")
-	pool, err := getRepoPool(cli, authToken, repoID, repoPoolID)
-	handleError(err)
-	printResponse(pool)
-}
-
-func UpdateRepoPool() {
-	log.Println(">>> Update repo pool")
-	var maxRunners uint = 5
-	var idleRunners uint = 1
-	poolParams := params.UpdatePoolParams{
-		MinIdleRunners: &idleRunners,
-		MaxRunners:     &maxRunners,
-	}
-	pool, err := updateRepoPool(cli, authToken, repoID, repoPoolID, poolParams)
-	handleError(err)
-	printResponse(pool)
-}
-
-func DisableRepoPool() {
-	enabled := false
-	_, err := updateRepoPool(cli, authToken, repoID, repoPoolID, params.UpdatePoolParams{Enabled: &enabled})
-	handleError(err)
-	log.Printf("repo pool %s disabled", repoPoolID)
-}
-
-func WaitRepoPoolNoInstances() {
-	for {
-		log.Println(">>> Wait until repo pool has no instances")
-		pool, err := getRepoPool(cli, authToken, repoID, repoPoolID)
-		handleError(err)
-		if len(pool.Instances) == 0 {
-			break
+	log.Printf(">>> Create %s", e.Kind())
+	entity, err := e.Create(e.CredentialsName())
+	if err != nil {
+		if code, _, parseErr := errorResponse(err); parseErr != nil || code != http.StatusConflict {
+			return err
+		}
+		// Another run sharing this GARM created it in the meantime.
+		existing, found, findErr := findEntity(e)
+		if findErr != nil || !found {
+			return err
 		}
-		time.Sleep(5 * time.Second)
+		log.Printf("%s %s was created by another run, using it", e.Kind(), existing.Name)
+		state.id = existing.ID
+		state.webhookSecret = e.WebhookSecret()
+		return nil
 	}
-}
-
-func WaitRepoInstance() {
-	log.Println(">>> Wait until repo instance is in running state")
-	for {
-		instances, err := listRepoInstances(cli, authToken, repoID)
-		handleError(err)
-		if len(instances) > 0 {
-			instance := instances[0]
-			log.Printf("instance %s status: %s", instance.Name, instance.Status)
-			if instance.Status == commonParams.InstanceRunning && instance.RunnerStatus == params.RunnerIdle {
-				repoInstanceName = instance.Name
-				break
-			}
+	printResponse(entity.Payload)
+	marker, err := e.CreatePool(entity.ID, ownerMarkerParams(e))
+	if err != nil {
+		// Without its marker, the entity would never be deleted.
+		if _, deleteErr := deleteEntity(e, entity.ID); deleteErr != nil {
+			err = errors.Join(err, deleteErr)
 		}
-		time.Sleep(5 * time.Second)
+		return fmt.Errorf("creating the owner marker of %s %s: %w", e.Kind(), entity.ID, err)
 	}
+	log.Printf("%s %s owner marker: pool %s", e.Kind(), entity.ID, marker.ID)
+	state.id = entity.ID
+	state.webhookSecret = e.WebhookSecret()
+	state.owned = true
+	cleanups.push("delete "+e.Kind(), func() error { return DeleteEntity(e) })
+	return nil
 }
 
-func ListRepoInstances() {
-	log.Println(">>> List repo instances")
-	instances, err := listRepoInstances(cli, authToken, repoID)
-	handleError(err)
-	printResponse(instances)
-}
-
-func DeleteRepo() {
-	log.Println(">>> Delete repo")
-	err := deleteRepo(cli, authToken, repoID)
-	handleError(err)
-	log.Printf("repo %s deleted", repoID)
-}
-
-func DeleteRepoPool() {
-	log.Println(">>> Delete repo pool")
-	err := deleteRepoPool(cli, authToken, repoID, repoPoolID)
-	handleError(err)
-	log.Printf("repo pool %s deleted", repoPoolID)
+func ListEntities(e Entity) error {
+	log.Printf(">>> List %ss", e.Kind())
+	entities, err := e.List()
+	if err != nil {
+		return err
+	}
+	printResponse(payloads(entities))
+	return nil
 }
 
-// ////////////////
-// Organizations //
-// ////////////////
-func CreateOrg() {
-	orgs, err := listOrgs(cli, authToken)
-	handleError(err)
-	if len(orgs) > 0 {
-		log.Println(">>> Org already exists, skipping create")
-		orgID = orgs[0].ID
-		return
+func UpdateEntity(e Entity) error {
+	log.Printf(">>> Update %s", e.Kind())
+	updateParams := entitySpec(e).Update
+	updateParams.CredentialsName = updateCredentialsName(e)
+	entity, err := e.Update(e.State().id, updateParams)
+	if err != nil {
+		return err
 	}
-	log.Println(">>> Create org")
-	orgParams := params.CreateOrgParams{
-		Name:            orgName,
-		CredentialsName: credentialsName,
-		WebhookSecret:   orgWebhookSecret,
+	printResponse(entity.Payload)
+	if updateParams.WebhookSecret != "" {
+		e.State().webhookSecret = updateParams.WebhookSecret
 	}
-	org, err := createOrg(cli, authToken, orgParams)
-	handleError(err)
-	printResponse(org)
-	orgID = org.ID
-}
-
-func ListOrgs() {
-	log.Println(">>> List orgs")
-	orgs, err := listOrgs(cli, authToken)
-	handleError(err)
-	printResponse(orgs)
+	return nil
 }
 
-func UpdateOrg() {
-	log.Println(">>> Update org")
-	updateParams := params.UpdateEntityParams{
-		CredentialsName: fmt.Sprintf("%s-clone", credentialsName),
-	}
-	org, err := updateOrg(cli, authToken, orgID, updateParams)
-	handleError(err)
-	printResponse(org)
+// updateCredentialsName returns the credentials the entity is updated with:
+// those of the scenario, or the "-clone" of the ones it is created with.
+func updateCredentialsName(e Entity) string {
+	if name := entitySpec(e).Update.CredentialsName; name != "" {
+		return name
+	}
+	return e.CredentialsName() + "-clone"
 }
 
-func GetOrg() {
-	log.Println(">>> Get org")
-	org, err := getOrg(cli, authToken, orgID)
-	handleError(err)
-	printResponse(org)
+func GetEntity(e Entity) error {
+	log.Printf(">>> Get %s", e.Kind())
+	entity, err := e.Get(e.State().id)
+	if err != nil {
+		return err
+	}
+	printResponse(entity.Payload)
+	return nil
 }
 
-func CreateOrgPool() {
-	pools, err := listOrgPools(cli, authToken, orgID)
-	handleError(err)
-	if len(pools) > 0 {
-		log.Println(">>> Org pool already exists, skipping create")
-		orgPoolID = pools[0].ID
-		return
+func CreateEntityPool(e Entity) error {
+	state := e.State()
+	poolParams := forRun(entitySpec(e).Pool)
+	pools, err := e.ListPools(state.id)
+	if err != nil {
+		return err
+	}
+	if existing, found := findPool(pools, poolParams); found {
+		log.Printf(">>> %s pool %s already exists, skipping create", title(e), describePool(poolParams))
+		state.poolID = existing.ID
+		return nil
+	}
+	log.Printf(">>> Create %s pool %s", e.Kind(), describePool(poolParams))
+	pool, err := e.CreatePool(state.id, poolParams)
+	if isNotFound(err) && !state.owned {
+		// The run that created the entity deleted it in the meantime, as
+		// it had no pools left.
+		log.Printf("%s %s is gone, creating it again", e.Kind(), state.id)
+		if err := CreateEntity(e); err != nil {
+			return err
+		}
+		pool, err = e.CreatePool(state.id, poolParams)
+	}
+	if err != nil {
+		return err
 	}
-	log.Println(">>> Create org pool")
-	poolParams := params.CreatePoolParams{
-		MaxRunners:     2,
-		MinIdleRunners: 0,
-		Flavor:         "garm",
-		Image:          "ubuntu:22.04",
-		OSType:         commonParams.Linux,
-		OSArch:         commonParams.Amd64,
-		ProviderName:   "lxd_local",
-		Tags:           []string{"ubuntu", "simple-runner"},
-		Enabled:        true,
-	}
-	org, err := createOrgPool(cli, authToken, orgID, poolParams)
-	handleError(err)
-	printResponse(org)
-	orgPoolID = org.ID
+	printResponse(pool)
+	state.poolID = pool.ID
+	cleanups.push("drain and delete "+e.Kind()+" pool", func() error {
+		if err := drainPool(state.poolID); err != nil {
+			return err
+		}
+		return DeleteEntityPool(e)
+	})
+	return nil
 }
 
-func ListOrgPools() {
-	log.Println(">>> List org pools")
-	pools, err := listOrgPools(cli, authToken, orgID)
-	handleError(err)
+func ListEntityPools(e Entity) error {
+	log.Printf(">>> List %s pools", e.Kind())
+	pools, err := e.ListPools(e.State().id)
+	if err != nil {
+		return err
+	}
 	printResponse(pools)
+	return nil
 }
 
-func GetOrgPool() {
-	log.Println(">>> Get org pool")
-	pool, err := getOrgPool(cli, authToken, orgID, orgPoolID)
-	handleError(err)
+func GetEntityPool(e Entity) error {
+	log.Printf(">>> Get %s pool", e.Kind())
+	state := e.State()
+	pool, err := e.GetPool(state.id, state.poolID)
+	if err != nil {
+		return err
+	}
 	printResponse(pool)
+	return nil
 }
 
-func UpdateOrgPool() {
-	log.Println(">>> Update org pool")
-	var maxRunners uint = 5
-	var idleRunners uint = 1
-	poolParams := params.UpdatePoolParams{
-		MinIdleRunners: &idleRunners,
-		MaxRunners:     &maxRunners,
-	}
-	pool, err := updateOrgPool(cli, authToken, orgID, orgPoolID, poolParams)
-	handleError(err)
+func UpdateEntityPool(e Entity) error {
+	log.Printf(">>> Update %s pool", e.Kind())
+	state := e.State()
+	pool, err := e.UpdatePool(state.id, state.poolID, entitySpec(e).PoolUpdate)
+	if err != nil {
+		return err
+	}
 	printResponse(pool)
+	return nil
 }
 
-func DisableOrgPool() {
+func DisableEntityPool(e Entity) error {
+	state := e.State()
+	if state.poolID == "" {
+		return nil
+	}
 	enabled := false
-	_, err := updateOrgPool(cli, authToken, orgID, orgPoolID, params.UpdatePoolParams{Enabled: &enabled})
-	handleError(err)
-	log.Printf("org pool %s disabled", orgPoolID)
+	_, err := e.UpdatePool(state.id, state.poolID, params.UpdatePoolParams{Enabled: &enabled})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s pool %s disabled", e.Kind(), state.poolID)
+	return nil
 }
 
-func WaitOrgPoolNoInstances() {
-	for {
-		log.Println(">>> Wait until org pool has no instances")
-		pool, err := getOrgPool(cli, authToken, orgID, orgPoolID)
-		handleError(err)
-		if len(pool.Instances) == 0 {
-			break
-		}
-		time.Sleep(5 * time.Second)
+func WaitEntityPoolNoInstances(e Entity) error {
+	state := e.State()
+	if state.poolID == "" {
+		return nil
 	}
+	log.Printf(">>> Wait until %s pool has no instances", e.Kind())
+	return waitPoolNoInstances(runCtx, e.Kind()+" pool "+state.poolID, func() (*params.Pool, error) {
+		return e.GetPool(state.id, state.poolID)
+	})
 }
 
-func WaitOrgInstance() {
-	log.Println(">>> Wait until org instance is in running state")
-	for {
-		instances, err := listOrgInstances(cli, authToken, orgID)
-		handleError(err)
-		if len(instances) > 0 {
-			instance := instances[0]
-			log.Printf("instance %s status: %s", instance.Name, instance.Status)
-			if instance.Status == commonParams.InstanceRunning && instance.RunnerStatus == params.RunnerIdle {
-				orgInstanceName = instance.Name
-				break
-			}
-		}
-		time.Sleep(5 * time.Second)
+func WaitEntityInstance(e Entity) error {
+	log.Printf(">>> Wait until %s instance is in running state", e.Kind())
+	state := e.State()
+	instance, err := waitIdleInstance(runCtx, e.Kind()+" pool "+state.poolID, func() (params.Instances, error) {
+		return listPoolInstances(cli, authToken, state.poolID)
+	})
+	if err != nil {
+		return err
 	}
+	state.instanceName = instance.Name
+	return nil
 }
 
-func ListOrgInstances() {
-	log.Println(">>> List org instances")
-	instances, err := listOrgInstances(cli, authToken, orgID)
-	handleError(err)
+func ListEntityInstances(e Entity) error {
+	log.Printf(">>> List %s instances", e.Kind())
+	instances, err := e.ListInstances(e.State().id)
+	if err != nil {
+		return err
+	}
 	printResponse(instances)
+	return nil
 }
 
-func DeleteOrg() {
-	log.Println(">>> Delete org")
-	err := deleteOrg(cli, authToken, orgID)
-	handleError(err)
-	log.Printf("org %s deleted", orgID)
+// DeleteEntityInstance deletes the instance the suite waited for, then the
+// other instances of the pool of e, which the suite may not have waited for,
+// so the pool can drain once disabled.
+func DeleteEntityInstance(e Entity) error {
+	state := e.State()
+	if err := DeleteInstance(state.instanceName); err != nil {
+		return err
+	}
+	if state.poolID == "" {
+		return nil
+	}
+	instances, err := listPoolInstances(cli, authToken, state.poolID)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if err := deleteInstance(cli, authToken, instance.Name); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteEntity(e Entity) error {
+	state := e.State()
+	if state.id == "" {
+		return nil
+	}
+	if !state.owned {
+		log.Printf("%s %s was not created by this run, leaving it", e.Kind(), state.id)
+		return nil
+	}
+	log.Printf(">>> Delete %s", e.Kind())
+	deleted, err := deleteOwnedEntity(e, state.id, createdByRun)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		log.Printf("%s %s deleted", e.Kind(), state.id)
+	}
+	state.id = ""
+	return nil
 }
 
-func DeleteOrgPool() {
-	log.Println(">>> Delete org pool")
-	err := deleteOrgPool(cli, authToken, orgID, orgPoolID)
-	handleError(err)
-	log.Printf("org pool %s deleted", orgPoolID)
+func DeleteEntityPool(e Entity) error {
+	state := e.State()
+	if state.poolID == "" {
+		return nil
+	}
+	log.Printf(">>> Delete %s pool", e.Kind())
+	err := e.DeletePool(state.id, state.poolID)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s pool %s deleted", e.Kind(), state.poolID)
+	state.poolID = ""
+	return nil
 }
 
 // ////////////
 // Instances //
 // ////////////
-func ListInstances() {
+func ListInstances() error {
 	log.Println(">>> List instances")
 	instances, err := listInstances(cli, authToken)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	printResponse(instances)
+	return nil
 }
 
-func GetInstance() {
+func GetInstance() error {
 	log.Println(">>> Get instance")
-	instance, err := getInstance(cli, authToken, orgInstanceName)
-	handleError(err)
+	// The instance of the organization pool, unless the run has no
+	// organization.
+	var name string
+	for _, e := range []Entity{org, repo, enterprise} {
+		if name = e.State().instanceName; name != "" {
+			break
+		}
+	}
+	instance, err := getInstance(cli, authToken, name)
+	if err != nil {
+		return err
+	}
 	printResponse(instance)
+	return nil
 }
 
-func DeleteInstance(name string) {
-	err := deleteInstance(cli, authToken, name)
-	for {
-		log.Printf(">>> Wait until instance %s is deleted", name)
-		instances, err := listInstances(cli, authToken)
-		handleError(err)
-		for _, instance := range instances {
-			if instance.Name == name {
-				time.Sleep(5 * time.Second)
-				continue
-			}
+func DeleteInstance(name string) error {
+	if name == "" {
+		return nil
+	}
+	log.Printf(">>> Delete instance %s", name)
+	if err := deleteInstance(cli, authToken, name); err != nil {
+		if isNotFound(err) {
+			log.Printf("instance %s already gone", name)
+			return nil
 		}
-		break
+		return err
+	}
+
+	log.Printf(">>> Wait until instance %s is deleted", name)
+	_, err := poll(runCtx, "instance "+name+" to be deleted", defaultPoll, func() (*params.Instance, error) {
+		instance, err := getInstance(cli, authToken, name)
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return instance, err
+	}, func(instance *params.Instance) bool {
+		return instance == nil
+	})
+	var timeoutErr *pollTimeoutError[*params.Instance]
+	if errors.As(err, &timeoutErr) && timeoutErr.Last != nil {
+		return fmt.Errorf("instance %s stuck in %s; status messages:\n%s\n%w",
+			name, timeoutErr.Last.Status, formatStatusMessages(timeoutErr.Last.StatusMessages), err)
+	}
+	if err != nil {
+		return err
 	}
-	handleError(err)
 	log.Printf("instance %s deleted", name)
+	return nil
 }
 
 // ////////
 // Pools //
 // ////////
-func CreatePool() {
-	pools, err := listPools(cli, authToken)
-	handleError(err)
-	for _, pool := range pools {
-		if pool.Image == "ubuntu:20.04" {
-			// this is the extra pool to be deleted, later, via [DELETE] pools dedicated API.
-			poolID = pool.ID
-			return
-		}
+func CreatePool() error {
+	state := repo.State()
+	poolParams := forRun(scenario.Pool)
+	pools, err := repo.ListPools(state.id)
+	if err != nil {
+		return err
+	}
+	// This is the extra pool to be deleted, later, via [DELETE] pools
+	// dedicated API. It may look like the repo pool, which it is not.
+	if existing, found := findPool(pools, poolParams, state.poolID); found {
+		log.Printf(">>> Pool %s already exists, skipping create", describePool(poolParams))
+		poolID = existing.ID
+		return nil
+	}
+	log.Printf(">>> Create pool %s", describePool(poolParams))
+	pool, err := repo.CreatePool(state.id, poolParams)
+	if err != nil {
+		return err
 	}
-	log.Println(">>> Create pool")
-	poolParams := params.CreatePoolParams{
-		MaxRunners:     2,
-		MinIdleRunners: 0,
-		Flavor:         "garm",
-		Image:          "ubuntu:20.04",
-		OSType:         commonParams.Linux,
-		OSArch:         commonParams.Amd64,
-		ProviderName:   "lxd_local",
-		Tags:           []string{"ubuntu", "simple-runner"},
-		Enabled:        true,
-	}
-	pool, err := createRepoPool(cli, authToken, repoID, poolParams)
-	handleError(err)
 	printResponse(pool)
 	poolID = pool.ID
+	cleanups.push("drain and delete pool", func() error {
+		if err := drainPool(poolID); err != nil {
+			return err
+		}
+		return DeletePool()
+	})
+	return nil
 }
 
-func ListPools() {
+func ListPools() error {
 	log.Println(">>> List pools")
 	pools, err := listPools(cli, authToken)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	printResponse(pools)
+	return nil
 }
 
-func UpdatePool() {
+func UpdatePool() error {
 	log.Println(">>> Update pool")
-	var maxRunners uint = 5
-	var idleRunners uint = 0
-	poolParams := params.UpdatePoolParams{
-		MinIdleRunners: &idleRunners,
-		MaxRunners:     &maxRunners,
-	}
-	pool, err := updatePool(cli, authToken, poolID, poolParams)
-	handleError(err)
+	pool, err := updatePool(cli, authToken, poolID, scenario.PoolUpdate)
+	if err != nil {
+		return err
+	}
 	printResponse(pool)
+	return nil
 }
 
-func GetPool() {
+func GetPool() error {
 	log.Println(">>> Get pool")
 	pool, err := getPool(cli, authToken, poolID)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	printResponse(pool)
+	return nil
 }
 
-func DeletePool() {
+func DeletePool() error {
+	if poolID == "" {
+		return nil
+	}
 	log.Println(">>> Delete pool")
 	err := deletePool(cli, authToken, poolID)
-	handleError(err)
+	if err != nil {
+		return err
+	}
 	log.Printf("pool %s deleted", poolID)
+	poolID = ""
+	return nil
 }
 
-func ListPoolInstances() {
+func ListPoolInstances() error {
 	log.Println(">>> List pool instances")
-	instances, err := listPoolInstances(cli, authToken, repoPoolID)
-	handleError(err)
+	instances, err := listPoolInstances(cli, authToken, repo.State().poolID)
+	if err != nil {
+		return err
+	}
 	printResponse(instances)
+	return nil
 }
 
-// ///////////////
-// Enterprises //
-// ///////////////
-func CreateEnterprise() {
-	enterprises, err := listEnterprises(cli, authToken)
-	handleError(err)
-	if len(enterprises) > 0 {
-		log.Println(">>> Enterprise already exists, skipping create")
-		enterpriseID = enterprises[0].ID
-		return
+// initClient builds the API client for the GARM server at baseURL.
+func initClient() error {
+	garmUrl, err := url.Parse(baseURL)
+	if err != nil {
+		return err
 	}
-	log.Println(">>> Create enterprise")
-	createParams := params.CreateEnterpriseParams{
-		Name:            enterpriseName,
-		CredentialsName: credentialsName,
-		WebhookSecret:   enterpriseWebhookSecret,
+	apiPath, err := url.JoinPath(garmUrl.Path, client.DefaultBasePath)
+	if err != nil {
+		return err
 	}
-	enterprise, err := createEnterprise(cli, authToken, createParams)
-	handleError(err)
-	printResponse(enterprise)
-	enterpriseID = enterprise.ID
-}
-
-func ListEnterprises() {
-	log.Println(">>> List enterprises")
-	enterprises, err := listEnterprises(cli, authToken)
-	handleError(err)
-	printResponse(enterprises)
-}
-
-func UpdateEnterprise() {
-	log.Println(">>> Update enterprise")
-	updateParams := params.UpdateEntityParams{
-		CredentialsName: fmt.Sprintf("%s-clone", credentialsName),
-	}
-	enterprise, err := updateEnterprise(cli, authToken, enterpriseID, updateParams)
-	handleError(err)
-	printResponse(enterprise)
-}
-
-func GetEnterprise() {
-	log.Println(">>> Get enterprise")
-	enterprise, err := getEnterprise(cli, authToken, enterpriseID)
-	handleError(err)
-	printResponse(enterprise)
-}
-
-func CreateEnterprisePool() {
-	pools, err := listEnterprisesPools(cli, authToken, enterpriseID)
-	handleError(err)
-	if len(pools) > 0 {
-		log.Println(">>> Enterprise pool already exists, skipping create")
-		enterprisePoolID = pools[0].ID
-		return
+	transport, err := tlsTransport()
+	if err != nil {
+		return err
 	}
-	log.Println(">>> Create enterprise pool")
-	poolParams := params.CreatePoolParams{
-		MaxRunners:     2,
-		MinIdleRunners: 0,
-		Flavor:         "garm",
-		Image:          "ubuntu:22.04",
-		OSType:         commonParams.Linux,
-		OSArch:         commonParams.Amd64,
-		ProviderName:   "lxd_local",
-		Tags:           []string{"ubuntu", "simple-runner"},
-		Enabled:        true,
-	}
-	enterprise, err := createEnterprisePool(cli, authToken, enterpriseID, poolParams)
-	handleError(err)
-	printResponse(enterprise)
-	enterprisePoolID = enterprise.ID
-}
-
-func ListEnterprisePools() {
-	log.Println(">>> List enterprise pools")
-	pools, err := listEnterprisesPools(cli, authToken, enterpriseID)
-	handleError(err)
-	printResponse(pools)
+	rt := openapiRuntimeClient.New(garmUrl.Host, apiPath, []string{garmUrl.Scheme})
+	rt.Transport = apiTransport(transport)
+	cli = client.New(rt, nil)
+	httpClient.Transport = apiTransport(transport)
+	return nil
 }
 
-func GetEnterprisePool() {
-	log.Println(">>> Get enterprise pool")
-	pool, err := getEnterprisePool(cli, authToken, enterpriseID, enterprisePoolID)
-	handleError(err)
-	printResponse(pool)
-}
-
-func UpdateEnterprisePool() {
-	log.Println(">>> Update enterprise pool")
-	var maxRunners uint = 5
-	var idleRunners uint = 1
-	poolParams := params.UpdatePoolParams{
-		MinIdleRunners: &idleRunners,
-		MaxRunners:     &maxRunners,
-	}
-	pool, err := updateEnterprisePool(cli, authToken, enterpriseID, enterprisePoolID, poolParams)
-	handleError(err)
-	printResponse(pool)
-}
-
-func DisableEnterprisePool() {
-	enabled := false
-	_, err := updateEnterprisePool(cli, authToken, enterpriseID, enterprisePoolID, params.UpdatePoolParams{Enabled: &enabled})
-	handleError(err)
-	log.Printf("enterprise pool %s disabled", enterprisePoolID)
-}
-
-func WaitEnterprisePoolNoInstances() {
-	for {
-		log.Println(">>> Wait until enterprise pool has no instances")
-		pool, err := getEnterprisePool(cli, authToken, enterpriseID, enterprisePoolID)
-		handleError(err)
-		if len(pool.Instances) == 0 {
-			break
+func main() {
+	interruptOnSignal()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic: %v", r)
+			cleanups.unwind()
+			writeReports()
+			panic(r)
 		}
-		time.Sleep(5 * time.Second)
-	}
-}
+	}()
 
-func WaitEnterpriseInstance() {
-	log.Println(">>> Wait until enterprise instance is in running state")
-	for {
-		instances, err := listEnterpriseInstances(cli, authToken, enterpriseID)
-		handleError(err)
-		if len(instances) > 0 {
-			instance := instances[0]
-			log.Printf("instance %s status: %s", instance.Name, instance.Status)
-			if instance.Status == commonParams.InstanceRunning && instance.RunnerStatus == params.RunnerIdle {
-				enterpriseInstanceName = instance.Name
-				break
-			}
-		}
-		time.Sleep(5 * time.Second)
+	handleError(runCommand(os.Args[1:]))
+	// Remove whatever the cleanup steps above did not get to.
+	errs := cleanups.unwind()
+	writeReports()
+	if err := checkReplayed(); err != nil {
+		log.Print(err)
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
 	}
-}
-
-func ListEnterpriseInstances() {
-	log.Println(">>> List enterprise instances")
-	instances, err := listEnterpriseInstances(cli, authToken, enterpriseID)
-	handleError(err)
-	printResponse(instances)
-}
-
-func DeleteEnterprise() {
-	log.Println(">>> Delete enterprise")
-	err := deleteEnterprise(cli, authToken, enterpriseID)
-	handleError(err)
-	log.Printf("enterprise %s deleted", enterpriseID)
-}
-
-func DeleteEnterprisePool() {
-	log.Println(">>> Delete enterprise pool")
-	err := deleteEnterprisePool(cli, authToken, enterpriseID, enterprisePoolID)
-	handleError(err)
-	log.Printf("enterprise pool %s deleted", enterprisePoolID)
-}
-
-func main() {
-	//////////////////
-	// initialize cli /
-	//////////////////
-	garmUrl, err := url.Parse(baseURL)
-	handleError(err)
-	apiPath, err := url.JoinPath(garmUrl.Path, client.DefaultBasePath)
-	handleError(err)
-	transportCfg := client.DefaultTransportConfig().
-		WithHost(garmUrl.Host).
-		WithBasePath(apiPath).
-		WithSchemes([]string{garmUrl.Scheme})
-	cli = client.NewHTTPClientWithConfig(nil, transportCfg)
-
-	//////////////////
-	// garm init //
-	//////////////////
-	FirstRun()
-	Login()
-
-	// ////////////////////////////
-	// credentials and providers //
-	// ////////////////////////////
-	ListCredentials()
-	ListProviders()
-
-	//////////
-	// jobs //
-	//////////
-	ListJobs()
-
-	////////////////////
-	/// metrics token //
-	////////////////////
-	GetMetricsToken()
-
-	//////////////////
-	// repositories //
-	//////////////////
-	CreateRepo()
-	ListRepos()
-	UpdateRepo()
-	GetRepo()
-
-	CreateRepoPool()
-	ListRepoPools()
-	GetRepoPool()
-	UpdateRepoPool()
-
-	//////////////////
-	// organizations //
-	//////////////////
-	CreateOrg()
-	ListOrgs()
-	UpdateOrg()
-	GetOrg()
-
-	CreateOrgPool()
-	ListOrgPools()
-	GetOrgPool()
-	UpdateOrgPool()
-
-	///////////////
-	// instances //
-	///////////////
-	WaitRepoInstance()
-	ListRepoInstances()
-
-	WaitOrgInstance()
-	ListOrgInstances()
-
-	ListInstances()
-	GetInstance()
-
-	///////////////
-	// pools //
-	///////////////
-	CreatePool()
-	ListPools()
-	UpdatePool()
-	GetPool()
-	ListPoolInstances()
-
-	///////////////
-	// enterprise /
-	///////////////
-	// CreateEnterprise()
-	// ListEnterprises()
-	// UpdateEnterprise()
-	// GetEnterprise()
-
-	// CreateEnterprisePool()
-	// ListEnterprisePools()
-	// GetEnterprisePool()
-	// UpdateEnterprisePool()
-
-	// WaitEnterpriseInstance()
-	// ListEnterpriseInstances()
-
-	// DisableEnterprisePool()
-	// DeleteInstance(enterpriseInstanceName)
-	// WaitEnterprisePoolNoInstances()
-	// DeleteEnterprisePool()
-	// DeleteEnterprise()
-
-	/////////////
-	// Cleanup //
-	/////////////
-	DisableRepoPool()
-	DisableOrgPool()
-
-	DeleteInstance(repoInstanceName)
-	DeleteInstance(orgInstanceName)
-
-	WaitRepoPoolNoInstances()
-	WaitOrgPoolNoInstances()
-
-	DeleteRepoPool()
-	DeleteOrgPool()
-	DeletePool()
-
-	DeleteRepo()
-	DeleteOrg()
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudbase/garm/params"
+)
+
+// metricsToken is the token handed out by GetMetricsToken.
+var metricsToken string
+
+// metricsPoll is used while waiting for the metrics to catch up with the API.
+// Metrics are collected on every scrape, they should agree quickly.
+var metricsPoll = pollOptions{
+	Timeout:     2 * time.Minute,
+	Interval:    time.Second,
+	MaxInterval: 10 * time.Second,
+	Multiplier:  1.5,
+	Jitter:      0.2,
+}
+
+// metricSample is a single sample of the Prometheus text exposition format.
+type metricSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// metricFamilies holds the samples of a scrape, by metric name.
+type metricFamilies map[string][]metricSample
+
+// find returns the samples of the named metric having all the given labels.
+func (f metricFamilies) find(name string, labels map[string]string) []metricSample {
+	var found []metricSample
+	for _, sample := range f[name] {
+		matches := true
+		for k, v := range labels {
+			if sample.Labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			found = append(found, sample)
+		}
+	}
+	return found
+}
+
+// sum adds up the values of the samples find returns.
+func (f metricFamilies) sum(name string, labels map[string]string) float64 {
+	var total float64
+	for _, sample := range f.find(name, labels) {
+		total += sample.Value
+	}
+	return total
+}
+
+// parseMetrics parses a scrape in the Prometheus text exposition format.
+// Comments, including HELP and TYPE lines, are skipped.
+func parseMetrics(r io.Reader) (metricFamilies, error) {
+	families := metricFamilies{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("parsing metrics, line %d: %w", lineNo, err)
+		}
+		families[sample.Name] = append(families[sample.Name], sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading metrics: %w", err)
+	}
+	return families, nil
+}
+
+// parseSample parses a line like: name{label="value",...} value [timestamp]
+func parseSample(line string) (metricSample, error) {
+	sample := metricSample{Labels: map[string]string{}}
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return sample, fmt.Errorf("malformed sample %q", line)
+	}
+	sample.Name = line[:end]
+	rest := line[end:]
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		if rest, err = parseLabels(rest[1:], sample.Labels); err != nil {
+			return sample, fmt.Errorf("malformed labels of %s: %w", sample.Name, err)
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return sample, fmt.Errorf("expected a value and an optional timestamp for %s, got %q", sample.Name, rest)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("malformed value of %s: %w", sample.Name, err)
+	}
+	sample.Value = value
+	return sample, nil
+}
+
+// parseLabels parses the labels following an opening brace into labels. It
+// returns what follows the closing brace.
+func parseLabels(s string, labels map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return "", fmt.Errorf("expected a label name in %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return "", fmt.Errorf("expected a quoted value for label %s", name)
+		}
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return "", fmt.Errorf("unterminated value for label %s", name)
+		}
+		labels[name] = value.String()
+		s = strings.TrimPrefix(strings.TrimLeft(s[i+1:], " \t"), ",")
+	}
+}
+
+func metricsEndpoint() (string, error) {
+	return url.JoinPath(baseURL, "metrics")
+}
+
+// scrapeMetrics fetches the metrics of GARM. An empty bearer sends no
+// Authorization header at all.
+func scrapeMetrics(bearer string) (metricFamilies, error) {
+	endpoint, err := metricsEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &statusError{What: "metrics scrape", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return parseMetrics(resp.Body)
+}
+
+func ensureMetricsToken() error {
+	if metricsToken != "" {
+		return nil
+	}
+	token, err := getMetricsToken(cli, authToken)
+	if err != nil {
+		return err
+	}
+	metricsToken = token
+	return nil
+}
+
+// checkMetrics compares a scrape with the instances and pools listed through
+// the API. Only the pools of this run are checked, other runs sharing GARM
+// change theirs at any time.
+func checkMetrics(families metricFamilies, instances params.Instances, pools params.Pools) error {
+	var errs []error
+	health := families.find("garm_health", nil)
+	if len(health) != 1 || health[0].Value != 1 {
+		errs = append(errs, fmt.Errorf("expected a single garm_health sample of 1, got %v", health))
+	}
+
+	pools = runPools(pools)
+	owned := map[string]bool{}
+	for _, pool := range pools {
+		owned[pool.ID] = true
+	}
+	for _, instance := range instances {
+		if !owned[instance.PoolID] {
+			continue
+		}
+		samples := families.find("garm_runner_status", map[string]string{"name": instance.Name})
+		if len(samples) != 1 {
+			errs = append(errs, fmt.Errorf("expected one garm_runner_status sample for %s, got %d", instance.Name, len(samples)))
+			continue
+		}
+		labels := samples[0].Labels
+		if labels["status"] != string(instance.Status) || labels["runner_status"] != string(instance.RunnerStatus) || labels["pool_id"] != instance.PoolID {
+			errs = append(errs, fmt.Errorf("garm_runner_status of %s is %s/%s in pool %s, the API says %s/%s in pool %s",
+				instance.Name, labels["status"], labels["runner_status"], labels["pool_id"],
+				instance.Status, instance.RunnerStatus, instance.PoolID))
+		}
+	}
+	for _, pool := range pools {
+		runners := len(families.find("garm_runner_status", map[string]string{"pool_id": pool.ID}))
+		if runners != len(pool.Instances) {
+			errs = append(errs, fmt.Errorf("pool %s has %d runners in the metrics, %d in the API", pool.ID, runners, len(pool.Instances)))
+		}
+	}
+
+	// The webhooks group ran, its events have to be counted.
+	if repo.State().jobID != 0 {
+		if valid := families.sum("garm_webhooks_received", map[string]string{"valid": "true"}); valid < 3 {
+			errs = append(errs, fmt.Errorf("expected at least 3 valid webhooks in garm_webhooks_received, got %v", valid))
+		}
+		invalid := families.sum("garm_webhooks_received", map[string]string{"valid": "false", "reason": "signature_invalid"})
+		if invalid < 1 {
+			errs = append(errs, fmt.Errorf("expected at least 1 webhook with an invalid signature in garm_webhooks_received, got %v", invalid))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// //////////
+// Metrics //
+// //////////
+func ScrapeMetrics() error {
+	log.Println(">>> Scrape metrics")
+	if err := ensureMetricsToken(); err != nil {
+		return err
+	}
+	var mismatch error
+	families, err := poll(runCtx, "the metrics to match the API", metricsPoll, func() (metricFamilies, error) {
+		families, err := scrapeMetrics(metricsToken)
+		if err != nil {
+			var statusErr *statusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+				return nil, fmt.Errorf("metrics are not enabled on GARM: %w", err)
+			}
+			return nil, err
+		}
+		instances, err := listInstances(cli, authToken)
+		if err != nil {
+			return nil, err
+		}
+		pools, err := listPools(cli, authToken)
+		if err != nil {
+			return nil, err
+		}
+		mismatch = checkMetrics(families, instances, pools)
+		return families, nil
+	}, func(metricFamilies) bool {
+		return mismatch == nil
+	})
+	var timeoutErr *pollTimeoutError[metricFamilies]
+	if errors.As(err, &timeoutErr) {
+		return fmt.Errorf("metrics do not match the API after %s:\n%w", metricsPoll.Timeout, mismatch)
+	}
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, fmt.Sprintf("%s (%d)", name, len(families[name])))
+	}
+	sort.Strings(names)
+	log.Printf("metrics match the API: %s", strings.Join(names, ", "))
+	return nil
+}
+
+func MetricsRejectBadTokens() error {
+	log.Println(">>> Scrape metrics with missing and bad tokens")
+	if err := ensureMetricsToken(); err != nil {
+		return err
+	}
+	bad := []struct {
+		name  string
+		token string
+	}{
+		{"without a token", ""},
+		{"with a malformed token", "not-a-jwt"},
+		{"with a tampered token", tamperToken(metricsToken)},
+		// GARM only serves metrics to metrics tokens.
+		{"with a login token", loginToken()},
+	}
+	var errs []error
+	for _, b := range bad {
+		_, err := scrapeMetrics(b.token)
+		var statusErr *statusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+			errs = append(errs, fmt.Errorf("expected a scrape %s to be rejected with status 401, got: %v", b.name, err))
+			continue
+		}
+		log.Printf("scrape %s rejected", b.name)
+	}
+	return errors.Join(errs...)
+}
+
+// tamperToken changes the signature of a JWT, leaving it well formed.
+func tamperToken(token string) string {
+	i := strings.LastIndexByte(token, '.') + 1
+	if i == 0 || i == len(token) {
+		return token + "x"
+	}
+	// The first character of the signature is changed: the last one may only
+	// carry padding bits, which decoders ignore.
+	replacement := "A"
+	if token[i] == 'A' {
+		replacement = "B"
+	}
+	return token[:i] + replacement + token[i+1:]
+}
+
+// loginToken returns the token Login saved in the garm-cli profile.
+func loginToken() string {
+	for _, manager := range cfg.Managers {
+		if manager.Name == name {
+			return manager.Token
+		}
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetrics(t *testing.T) {
+	scrape := `# HELP garm_pool_info Info of the pool.
+# TYPE garm_pool_info gauge
+garm_pool_info{id="p1",image="ubuntu:22.04",tags="a,b"} 1
+garm_pool_info{id="p2",image="say \"hi\"\\now\nthere"} 1
+
+# A comment that is neither HELP nor TYPE.
+garm_health 1 1700000000000
+garm_runner_status{ name = "r1" , status="idle",} 2.5
+`
+	families, err := parseMetrics(strings.NewReader(scrape))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metricFamilies{
+		"garm_pool_info": {
+			{Name: "garm_pool_info", Labels: map[string]string{"id": "p1", "image": "ubuntu:22.04", "tags": "a,b"}, Value: 1},
+			{Name: "garm_pool_info", Labels: map[string]string{"id": "p2", "image": "say \"hi\"\\now\nthere"}, Value: 1},
+		},
+		"garm_health": {
+			{Name: "garm_health", Labels: map[string]string{}, Value: 1},
+		},
+		"garm_runner_status": {
+			{Name: "garm_runner_status", Labels: map[string]string{"name": "r1", "status": "idle"}, Value: 2.5},
+		},
+	}
+	if !reflect.DeepEqual(families, want) {
+		t.Errorf("parseMetrics() = %+v, want %+v", families, want)
+	}
+	if got := families.sum("garm_pool_info", map[string]string{"id": "p1"}); got != 1 {
+		t.Errorf("sum of garm_pool_info{id=p1} = %v, want 1", got)
+	}
+}
+
+func TestParseMetricsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"no value", "garm_health"},
+		{"no name", `{id="p1"} 1`},
+		{"bad value", "garm_health one"},
+		{"too many fields", "garm_health 1 2 3"},
+		{"unquoted label", "garm_pool_info{id=p1} 1"},
+		{"no label name", `garm_pool_info{="p1"} 1`},
+		{"unterminated label", `garm_pool_info{id="p1} 1`},
+		{"escaped closing quote", `garm_pool_info{id="p1\"} 1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scrape := "# TYPE garm_health gauge\n" + tt.line + "\n"
+			if families, err := parseMetrics(strings.NewReader(scrape)); err == nil {
+				t.Errorf("parseMetrics(%q) = %+v, want an error", tt.line, families)
+			} else if !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("parseMetrics(%q) error %q does not name line 2", tt.line, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	apiParams "github.com/cloudbase/garm/apiserver/params"
+	"github.com/cloudbase/garm/params"
+	"github.com/go-openapi/runtime"
+	openapiRuntimeClient "github.com/go-openapi/runtime/client"
+	"github.com/google/uuid"
+)
+
+// expiredToken is a token GARM issued that has expired since. Without it, one
+// is forged from the login token.
+var expiredToken = os.Getenv("GARM_EXPIRED_TOKEN")
+
+// The Error of the APIErrorResponse GARM answers with, by cause.
+const (
+	apiErrorAuthFailed   = "Authentication failed"
+	apiErrorUnauthorized = "Not Authorized"
+	apiErrorNotFound     = "Not Found"
+	apiErrorBadRequest   = "Bad Request"
+	apiErrorConflict     = "Conflict"
+)
+
+// negativeCase is a call GARM has to turn down with the given status and
+// APIErrorResponse.
+type negativeCase struct {
+	name     string
+	call     func() error
+	status   int
+	apiError string
+}
+
+// apiErrorResponse is implemented by the errors the swagger client returns
+// for the statuses the API documents.
+type apiErrorResponse interface {
+	Code() int
+	GetPayload() apiParams.APIErrorResponse
+}
+
+// rawAPIError is an error response to a request made through httpClient.
+type rawAPIError struct {
+	code    int
+	payload apiParams.APIErrorResponse
+}
+
+func (e *rawAPIError) Error() string {
+	return fmt.Sprintf("status %d: %s: %s", e.code, e.payload.Error, e.payload.Details)
+}
+
+func (e *rawAPIError) Code() int {
+	return e.code
+}
+
+func (e *rawAPIError) GetPayload() apiParams.APIErrorResponse {
+	return e.payload
+}
+
+// errorResponse returns the status and APIErrorResponse err carries.
+// Statuses the API does not document for an operation come back as a
+// runtime.APIError, whose body recordingTransport kept readable.
+func errorResponse(err error) (int, apiParams.APIErrorResponse, error) {
+	var apiErr apiErrorResponse
+	if errors.As(err, &apiErr) {
+		return apiErr.Code(), apiErr.GetPayload(), nil
+	}
+	var runtimeErr *runtime.APIError
+	if !errors.As(err, &runtimeErr) {
+		return 0, apiParams.APIErrorResponse{}, fmt.Errorf("not an API error: %w", err)
+	}
+	var payload apiParams.APIErrorResponse
+	resp, ok := runtimeErr.Response.(runtime.ClientResponse)
+	if !ok {
+		return runtimeErr.Code, payload, fmt.Errorf("status %d without a response body", runtimeErr.Code)
+	}
+	body, readErr := io.ReadAll(resp.Body())
+	if readErr != nil {
+		return runtimeErr.Code, payload, fmt.Errorf("reading the response to %s: %w", runtimeErr.OperationName, readErr)
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return runtimeErr.Code, payload, fmt.Errorf("status %d with a body that is no APIErrorResponse: %q", runtimeErr.Code, body)
+	}
+	return runtimeErr.Code, payload, nil
+}
+
+// expectAPIError checks that err is an API error with the given status and
+// Error. Details are left out of 401s, and explain the other errors.
+func expectAPIError(err error, status int, message string) error {
+	if err == nil {
+		return fmt.Errorf("succeeded, expected status %d", status)
+	}
+	code, payload, parseErr := errorResponse(err)
+	if parseErr != nil {
+		return fmt.Errorf("expected status %d: %w", status, parseErr)
+	}
+	switch {
+	case code != status:
+		return fmt.Errorf("got status %d (%s), expected %d", code, payload.Error, status)
+	case payload.Error != message:
+		return fmt.Errorf("got error %q, expected %q", payload.Error, message)
+	case status == http.StatusUnauthorized && payload.Details != "":
+		return fmt.Errorf("got details %q, expected none on a %d", payload.Details, status)
+	case status != http.StatusUnauthorized && payload.Details == "":
+		return fmt.Errorf("got no details, expected some on a %d", status)
+	}
+	return nil
+}
+
+func runNegativeCases(cases []negativeCase) error {
+	var errs []error
+	for _, c := range cases {
+		if err := expectAPIError(c.call(), c.status, c.apiError); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+			continue
+		}
+		log.Printf("%s: %d %s", c.name, c.status, c.apiError)
+	}
+	return errors.Join(errs...)
+}
+
+// withAuthToken runs fn with authToken replaced by auth, so the helpers and
+// entities calling the API with authToken can be reused.
+func withAuthToken(auth runtime.ClientAuthInfoWriter, fn func() error) error {
+	saved := authToken
+	authToken = auth
+	defer func() { authToken = saved }()
+	return fn()
+}
+
+// apiOperations returns a call to every authenticated operation of
+// client.GarmAPI. IDs that do not exist and empty bodies are used: they are
+// meant to be turned down before they get anywhere.
+func apiOperations() []negativeCase {
+	id := uuid.NewString()
+	ops := []negativeCase{
+		{name: "ListCredentials", call: func() error { _, err := listCredentials(cli, authToken); return err }},
+		{name: "ListProviders", call: func() error { _, err := listProviders(cli, authToken); return err }},
+		{name: "ListJobs", call: func() error { _, err := listJobs(cli, authToken); return err }},
+		{name: "GetMetricsToken", call: func() error { _, err := getMetricsToken(cli, authToken); return err }},
+		{name: "ListPools", call: func() error { _, err := listPools(cli, authToken); return err }},
+		{name: "GetPool", call: func() error { _, err := getPool(cli, authToken, id); return err }},
+		{name: "UpdatePool", call: func() error { _, err := updatePool(cli, authToken, id, params.UpdatePoolParams{}); return err }},
+		{name: "DeletePool", call: func() error { return deletePool(cli, authToken, id) }},
+		{name: "ListPoolInstances", call: func() error { _, err := listPoolInstances(cli, authToken, id); return err }},
+		{name: "ListInstances", call: func() error { _, err := listInstances(cli, authToken); return err }},
+		{name: "GetInstance", call: func() error { _, err := getInstance(cli, authToken, id); return err }},
+		{name: "DeleteInstance", call: func() error { return deleteInstance(cli, authToken, id) }},
+	}
+	for _, e := range []Entity{repo, org, enterprise} {
+		e := e
+		t := title(e)
+		ops = append(ops,
+			negativeCase{name: "Create" + t, call: func() error { _, err := e.Create(""); return err }},
+			negativeCase{name: "List" + t + "s", call: func() error { _, err := e.List(); return err }},
+			negativeCase{name: "Get" + t, call: func() error { _, err := e.Get(id); return err }},
+			negativeCase{name: "Update" + t, call: func() error { _, err := e.Update(id, params.UpdateEntityParams{}); return err }},
+			negativeCase{name: "Delete" + t, call: func() error { return e.Delete(id) }},
+			negativeCase{name: "Create" + t + "Pool", call: func() error { _, err := e.CreatePool(id, params.CreatePoolParams{}); return err }},
+			negativeCase{name: "List" + t + "Pools", call: func() error { _, err := e.ListPools(id); return err }},
+			negativeCase{name: "Get" + t + "Pool", call: func() error { _, err := e.GetPool(id, id); return err }},
+			negativeCase{name: "Update" + t + "Pool", call: func() error { _, err := e.UpdatePool(id, id, params.UpdatePoolParams{}); return err }},
+			negativeCase{name: "Delete" + t + "Pool", call: func() error { return e.DeletePool(id, id) }},
+			negativeCase{name: "List" + t + "Instances", call: func() error { _, err := e.ListInstances(id); return err }},
+		)
+	}
+	return ops
+}
+
+// rejectWithAuth expects every operation to be turned down when called with
+// auth, as GARM's auth middleware does.
+func rejectWithAuth(auth runtime.ClientAuthInfoWriter) error {
+	ops := apiOperations()
+	for i := range ops {
+		call := ops[i].call
+		ops[i].call = func() error { return withAuthToken(auth, call) }
+		ops[i].status = http.StatusUnauthorized
+		ops[i].apiError = apiErrorAuthFailed
+	}
+	return runNegativeCases(ops)
+}
+
+// forgeExpiredToken returns token with its expiry moved to the past. Its
+// signature does not match anymore, which GARM has to turn down as well.
+func forgeExpiredToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("the login token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decoding the login token: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("decoding the login token claims: %w", err)
+	}
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if payload, err = json.Marshal(claims); err != nil {
+		return "", err
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, "."), nil
+}
+
+// rawAPICall sends body to an API path through httpClient, with the login
+// token, and returns the error response GARM answered with, if any.
+func rawAPICall(method, path string, body []byte) error {
+	endpoint, err := url.JoinPath(baseURL, "api/v1", path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(runCtx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+loginToken())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	apiErr := &rawAPIError{code: resp.StatusCode}
+	respBody, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(respBody, &apiErr.payload); err != nil {
+		return fmt.Errorf("status %d with a body that is no APIErrorResponse: %q", resp.StatusCode, respBody)
+	}
+	return apiErr
+}
+
+// /////////////////
+// Negative cases //
+// /////////////////
+func RejectMissingToken() error {
+	log.Println(">>> Call every operation without a token")
+	return rejectWithAuth(nil)
+}
+
+func RejectTamperedToken() error {
+	log.Println(">>> Call every operation with a tampered token")
+	return rejectWithAuth(openapiRuntimeClient.BearerToken(tamperToken(loginToken())))
+}
+
+func RejectExpiredToken() error {
+	log.Println(">>> Call every operation with an expired token")
+	token := expiredToken
+	if token == "" {
+		log.Println("no expired token was given, forging one from the login token")
+		forged, err := forgeExpiredToken(loginToken())
+		if err != nil {
+			return err
+		}
+		token = forged
+	}
+	return rejectWithAuth(openapiRuntimeClient.BearerToken(token))
+}
+
+func RejectMissingResources() error {
+	log.Println(">>> Call operations on resources that do not exist")
+	id := uuid.NewString()
+	cases := []negativeCase{
+		{"GetPool", func() error { _, err := getPool(cli, authToken, id); return err }, http.StatusNotFound, apiErrorNotFound},
+		{"UpdatePool", func() error { _, err := updatePool(cli, authToken, id, params.UpdatePoolParams{}); return err }, http.StatusNotFound, apiErrorNotFound},
+		{"GetInstance", func() error { _, err := getInstance(cli, authToken, id); return err }, http.StatusNotFound, apiErrorNotFound},
+		{"DeleteInstance", func() error { return deleteInstance(cli, authToken, id) }, http.StatusNotFound, apiErrorNotFound},
+	}
+	for _, e := range []Entity{repo, org, enterprise} {
+		e := e
+		t := title(e)
+		cases = append(cases,
+			negativeCase{"Get" + t, func() error { _, err := e.Get(id); return err }, http.StatusNotFound, apiErrorNotFound},
+			negativeCase{"Update" + t, func() error {
+				_, err := e.Update(id, params.UpdateEntityParams{CredentialsName: credentialsName})
+				return err
+			}, http.StatusNotFound, apiErrorNotFound},
+			negativeCase{"Delete" + t, func() error { return e.Delete(id) }, http.StatusNotFound, apiErrorNotFound},
+			negativeCase{"Get" + t + "Pool", func() error { _, err := e.GetPool(id, id); return err }, http.StatusNotFound, apiErrorNotFound},
+		)
+	}
+	return runNegativeCases(cases)
+}
+
+func RejectMalformedRequests() error {
+	log.Println(">>> Send malformed requests")
+	repoID := repo.State().id
+	if repoID == "" {
+		return fmt.Errorf("the repo has to be created first")
+	}
+	pool := func(edit func(p *params.CreatePoolParams)) func() error {
+		return func() error {
+			poolParams := defaultPoolParams("ubuntu:22.04")
+			edit(&poolParams)
+			_, err := repo.CreatePool(repoID, poolParams)
+			return err
+		}
+	}
+	unknownCredentials := "garm-test-client-missing-" + uuid.NewString()[:8]
+	cases := []negativeCase{
+		{"CreateRepo with a body that is no JSON", func() error {
+			return rawAPICall(http.MethodPost, "repositories", []byte(`{"owner": `))
+		}, http.StatusBadRequest, apiErrorBadRequest},
+		{"CreateRepoPool with a body that is no JSON", func() error {
+			return rawAPICall(http.MethodPost, "repositories/"+repoID+"/pools", []byte(`[`))
+		}, http.StatusBadRequest, apiErrorBadRequest},
+		{"CreateRepoPool with empty params", func() error {
+			_, err := repo.CreatePool(repoID, params.CreatePoolParams{})
+			return err
+		}, http.StatusBadRequest, apiErrorBadRequest},
+		{"CreateRepoPool with max_runners < min_idle_runners", pool(func(p *params.CreatePoolParams) {
+			p.MaxRunners, p.MinIdleRunners = 1, 2
+		}), http.StatusBadRequest, apiErrorBadRequest},
+		{"CreateRepoPool with an unknown provider", pool(func(p *params.CreatePoolParams) {
+			p.ProviderName = "garm-test-client-missing-provider"
+		}), http.StatusBadRequest, apiErrorBadRequest},
+		{"CreateRepo with unknown credentials", func() error {
+			_, err := repo.Create(unknownCredentials)
+			return err
+		}, http.StatusBadRequest, apiErrorBadRequest},
+		{"UpdateRepo with unknown credentials", func() error {
+			_, err := repo.Update(repoID, params.UpdateEntityParams{CredentialsName: unknownCredentials})
+			return err
+		}, http.StatusBadRequest, apiErrorBadRequest},
+		{"UpdateRepoPool with max_runners < min_idle_runners", func() error {
+			maxRunners, minIdle := uint(1), uint(2)
+			_, err := repo.UpdatePool(repoID, repo.State().poolID, params.UpdatePoolParams{MaxRunners: &maxRunners, MinIdleRunners: &minIdle})
+			return err
+		}, http.StatusBadRequest, apiErrorBadRequest},
+	}
+	return runNegativeCases(cases)
+}
+
+func RejectBadLogin() error {
+	log.Println(">>> Log in with a wrong password and initialize GARM again")
+	cases := []negativeCase{
+		{"Login with a wrong password", func() error {
+			_, err := login(cli, params.PasswordLoginParams{Username: username, Password: password + "-wrong"})
+			return err
+		}, http.StatusUnauthorized, apiErrorUnauthorized},
+		{"FirstRun once initialized", func() error {
+			_, err := firstRun(cli, params.NewUserParams{Username: username, Password: password, FullName: fullName, Email: email})
+			return err
+		}, http.StatusConflict, apiErrorConflict},
+	}
+	return runNegativeCases(cases)
+}
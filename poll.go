@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm/params"
+)
+
+// pollOptions controls how often and for how long poll checks a condition.
+type pollOptions struct {
+	// Timeout is the overall time allowed for the condition to hold.
+	Timeout time.Duration
+	// Interval is the delay before the second check.
+	Interval time.Duration
+	// MaxInterval caps the delay between checks as it backs off.
+	MaxInterval time.Duration
+	// Multiplier grows the delay after every check.
+	Multiplier float64
+	// Jitter randomizes every delay by up to this fraction of it.
+	Jitter float64
+}
+
+// defaultPoll is used by the steps waiting on instances and pools.
+var defaultPoll = pollOptions{
+	Timeout:     20 * time.Minute,
+	Interval:    2 * time.Second,
+	MaxInterval: 15 * time.Second,
+	Multiplier:  1.5,
+	Jitter:      0.2,
+}
+
+// pollTimeoutError is returned when the condition did not hold in time. It
+// carries the last state observed, so hung runs show what they were stuck on.
+type pollTimeoutError[T any] struct {
+	What     string
+	Timeout  time.Duration
+	Attempts int
+	Last     T
+	Cause    error
+}
+
+func (e *pollTimeoutError[T]) Error() string {
+	last, err := json.MarshalIndent(e.Last, "", "  ")
+	if err != nil {
+		last = []byte(fmt.Sprintf("%+v", e.Last))
+	}
+	return fmt.Sprintf("timed out after %s (%d attempts) waiting for %s: %v; last observed state: %s",
+		e.Timeout, e.Attempts, e.What, e.Cause, last)
+}
+
+func (e *pollTimeoutError[T]) Unwrap() error {
+	return e.Cause
+}
+
+// poll calls fetch until done reports true for what it returned, backing off
+// between attempts. It gives up when fetch fails, when ctx is cancelled or
+// when opts.Timeout elapses.
+func poll[T any](ctx context.Context, what string, opts pollOptions, fetch func() (T, error), done func(T) bool) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	var last T
+	interval := opts.Interval
+	for attempt := 1; ; attempt++ {
+		current, err := fetch()
+		if err != nil {
+			return current, err
+		}
+		last = current
+		if done(current) {
+			return current, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return last, fmt.Errorf("interrupted while waiting for %s: %w", what, ctx.Err())
+			}
+			return last, &pollTimeoutError[T]{
+				What:     what,
+				Timeout:  opts.Timeout,
+				Attempts: attempt,
+				Last:     last,
+				Cause:    ctx.Err(),
+			}
+		case <-time.After(jitter(interval, opts.Jitter)):
+		}
+
+		if opts.Multiplier > 1 {
+			interval = time.Duration(float64(interval) * opts.Multiplier)
+		}
+		if opts.MaxInterval > 0 && interval > opts.MaxInterval {
+			interval = opts.MaxInterval
+		}
+	}
+}
+
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * fraction * float64(d)
+	return d + time.Duration(delta)
+}
+
+// waitIdleInstance waits until one of the instances returned by list is
+// running and its runner is idle.
+func waitIdleInstance(ctx context.Context, owner string, list func() (params.Instances, error)) (params.Instance, error) {
+	var idle params.Instance
+	_, err := poll(ctx, "a running, idle instance of "+owner, defaultPoll, list, func(instances params.Instances) bool {
+		for _, instance := range instances {
+			log.Printf("instance %s status: %s", instance.Name, instance.Status)
+			if instance.Status == commonParams.InstanceRunning && instance.RunnerStatus == params.RunnerIdle {
+				idle = instance
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return params.Instance{}, err
+	}
+	return idle, nil
+}
+
+// waitPoolNoInstances waits until the pool returned by get has no instances.
+func waitPoolNoInstances(ctx context.Context, pool string, get func() (*params.Pool, error)) error {
+	_, err := poll(ctx, pool+" to have no instances", defaultPoll, get, func(pool *params.Pool) bool {
+		return len(pool.Instances) == 0
+	})
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoll(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+	opts := pollOptions{Timeout: 50 * time.Millisecond, Interval: time.Millisecond, MaxInterval: 2 * time.Millisecond, Multiplier: 2}
+	tests := []struct {
+		name     string
+		doneAt   int
+		failAt   int
+		cancel   bool
+		want     int
+		wantErr  error
+		timedOut bool
+	}{
+		{name: "done at once", doneAt: 1, want: 1},
+		{name: "done after a few attempts", doneAt: 4, want: 4},
+		{name: "fetch fails", doneAt: 5, failAt: 2, want: 2, wantErr: errFetch},
+		{name: "times out", timedOut: true},
+		{name: "interrupted", cancel: true, want: 1, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			attempts := 0
+			got, err := poll(ctx, "the test", opts, func() (int, error) {
+				attempts++
+				if attempts == tt.failAt {
+					return attempts, errFetch
+				}
+				return attempts, nil
+			}, func(attempt int) bool {
+				return attempt == tt.doneAt
+			})
+
+			var timeout *pollTimeoutError[int]
+			switch {
+			case tt.timedOut:
+				if !errors.As(err, &timeout) {
+					t.Fatalf("poll() error = %v, want a timeout", err)
+				}
+				if timeout.Last != attempts || timeout.Attempts != attempts {
+					t.Errorf("timeout after %d attempts reports %d attempts, last %d", attempts, timeout.Attempts, timeout.Last)
+				}
+				if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "waiting for the test") {
+					t.Errorf("poll() error = %v", err)
+				}
+				return
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) || errors.As(err, &timeout) {
+					t.Fatalf("poll() error = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("poll() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("poll() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		fraction float64
+		min, max time.Duration
+	}{
+		{0, time.Second, time.Second},
+		{-1, time.Second, time.Second},
+		{0.2, 800 * time.Millisecond, 1200 * time.Millisecond},
+		{1, 0, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := jitter(time.Second, tt.fraction); got < tt.min || got > tt.max {
+				t.Fatalf("jitter(1s, %v) = %s, want between %s and %s", tt.fraction, got, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	apiParams "github.com/cloudbase/garm/apiserver/params"
+)
+
+// preflightCheck is one of the things a run needs from the GARM server.
+type preflightCheck struct {
+	name  string
+	check func() error
+	// gate checks are those the following ones need: once one failed, the
+	// following ones are skipped.
+	gate bool
+}
+
+// preflightChecks returns the checks of what the given groups need: GARM
+// answering, the admin logging in, and the credentials and providers the
+// steps of the groups refer to. With initialize, GARM is initialized first
+// when it has to be, as the init group of a run does; otherwise the checks
+// change nothing.
+func preflightChecks(groups []group, initialize bool) []preflightCheck {
+	login := adminLogin
+	if initialize {
+		login = setup
+	}
+	checks := []preflightCheck{
+		{name: fmt.Sprintf("GARM at %s is reachable", baseURL), check: garmReachable, gate: true},
+		{name: fmt.Sprintf("admin %q can log in", username), check: login, gate: true},
+	}
+
+	usedBy := usedCredentials(groups)
+	for _, name := range sortedKeys(usedBy) {
+		name := name
+		checks = append(checks, preflightCheck{
+			name:  fmt.Sprintf("credentials %q exist (%s)", name, strings.Join(usedBy[name], ", ")),
+			check: func() error { return credentialsExist(name) },
+		})
+	}
+	poolsOf := usedProviders(groups)
+	for _, name := range sortedKeys(poolsOf) {
+		name := name
+		checks = append(checks, preflightCheck{
+			name:  fmt.Sprintf("provider %q exists (%s)", name, strings.Join(poolsOf[name], ", ")),
+			check: func() error { return providerExists(name) },
+		})
+	}
+	return checks
+}
+
+// preflight runs the checks of what groups need, even after one failed, then
+// prints them as a table. It fails when any of them did.
+func preflight(groups []group, initialize bool) error {
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+	var failed []string
+	var gateFailed string
+	for _, c := range preflightChecks(groups, initialize) {
+		result, detail := "PASS", ""
+		if gateFailed != "" {
+			result, detail = "SKIP", "needs: "+gateFailed
+		} else if err := c.check(); err != nil {
+			result, detail = "FAIL", err.Error()
+			failed = append(failed, c.name)
+			if c.gate {
+				gateFailed = c.name
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.name, result, oneLine(detail))
+	}
+	w.Flush()
+	log.Printf(">>> Preflight\n%s", table.String())
+	if len(failed) > 0 {
+		return fmt.Errorf("preflight failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// adminLogin logs the admin in, telling an uninitialized GARM apart from
+// wrong credentials.
+func adminLogin() error {
+	err := Login()
+	if err == nil {
+		return nil
+	}
+	code, payload, parseErr := errorResponse(err)
+	if parseErr == nil && code == http.StatusConflict && payload.Error == apiParams.InitializationRequired.Error {
+		return fmt.Errorf("GARM not initialized, the init group of a run initializes it")
+	}
+	return err
+}
+
+// garmReachable checks that something answers at baseURL. The answer does not
+// matter, GARM has nothing to serve there.
+func garmReachable() error {
+	if baseURL == "" {
+		return fmt.Errorf("no GARM base URL given, set --url")
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodGet, baseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// usedCredentials maps the credentials the steps of groups create and update
+// entities with to the steps using them.
+func usedCredentials(groups []group) map[string][]string {
+	used := map[string][]string{}
+	for _, e := range groupEntities(groups) {
+		used[e.CredentialsName()] = append(used[e.CredentialsName()], "Create"+title(e))
+		update := updateCredentialsName(e)
+		used[update] = append(used[update], "Update"+title(e))
+	}
+	return used
+}
+
+// usedProviders maps the providers of the pools the steps of groups create to
+// the steps creating them.
+func usedProviders(groups []group) map[string][]string {
+	used := map[string][]string{}
+	for _, e := range groupEntities(groups) {
+		provider := entitySpec(e).Pool.ProviderName
+		used[provider] = append(used[provider], "Create"+title(e)+"Pool")
+	}
+	for _, g := range groups {
+		switch g.name {
+		case groupPools:
+			used[scenario.Pool.ProviderName] = append(used[scenario.Pool.ProviderName], "CreatePool")
+		case groupBootstrap:
+			used[bootstrapProvider] = append(used[bootstrapProvider], "CreateBootstrapPool")
+		}
+	}
+	return used
+}
+
+// groupEntities returns the entities created by groups, but those whose
+// steps are skipped.
+func groupEntities(groups []group) []Entity {
+	var entities []Entity
+	for _, g := range groups {
+		kind, ok := entityGroups[g.name]
+		if !ok {
+			continue
+		}
+		if e, _ := entityByKind(kind); entitySkipReason(e) == "" {
+			entities = append(entities, e)
+		}
+	}
+	return entities
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func credentialsExist(name string) error {
+	if name == "" {
+		return fmt.Errorf("no credentials name given, set --credentials")
+	}
+	credentials, err := listCredentials(cli, authToken)
+	if err != nil {
+		return err
+	}
+	for _, c := range credentials {
+		if c.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("not defined in GARM")
+}
+
+func providerExists(name string) error {
+	if name == "" {
+		return fmt.Errorf("no provider name given in the scenario")
+	}
+	providers, err := listProviders(cli, authToken)
+	if err != nil {
+		return err
+	}
+	for _, p := range providers {
+		if p.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("not defined in GARM")
+}
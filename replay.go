@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+)
+
+// Paths of the fixture files a run is recorded to, or replayed from, when set.
+var (
+	recordPath = os.Getenv("GARM_RECORD")
+	replayPath = os.Getenv("GARM_REPLAY")
+)
+
+// replayBaseURL is the base URL runs are replayed against, when none is
+// given. Nothing listens there.
+const replayBaseURL = "http://garm.replay.invalid"
+
+// fixture is a recorded run: the HTTP exchanges of the client with GARM, in
+// order, secrets redacted.
+type fixture struct {
+	RunID string `json:"run_id"`
+	// GarmVersion is the version of the GARM module the client was built
+	// with when recording.
+	GarmVersion string    `json:"garm_version,omitempty"`
+	RecordedAt  time.Time `json:"recorded_at"`
+	// Bootstrap holds the bootstrap params the bootstrap group read, by
+	// instance name.
+	Bootstrap map[string]commonParams.BootstrapInstance `json:"bootstrap,omitempty"`
+	Exchanges []recordedExchange                        `json:"exchanges"`
+}
+
+// recordedExchange is an HTTP call, with the path and query it was made to.
+type recordedExchange struct {
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	Status      int             `json:"status,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Response    string          `json:"response,omitempty"`
+	// Error is the error of calls that got no response.
+	Error string `json:"error,omitempty"`
+}
+
+// /////////////
+// Recording //
+// /////////////
+
+// fixtureRecorder keeps the exchanges of the run, for the fixture file.
+type fixtureRecorder struct {
+	mux     sync.Mutex
+	fixture fixture
+}
+
+var recorder = &fixtureRecorder{}
+
+// add records an exchange. Without a response, err tells why.
+func (r *fixtureRecorder) add(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, err error) {
+	if recordPath == "" {
+		return
+	}
+	ex := recordedExchange{
+		Method: req.Method,
+		Path:   req.URL.RequestURI(),
+	}
+	if len(reqBody) > 0 {
+		ex.Request = json.RawMessage(redactFixtureBody(req.URL.Path, reqBody))
+		if !json.Valid(ex.Request) {
+			quoted, _ := json.Marshal(string(ex.Request))
+			ex.Request = quoted
+		}
+	}
+	if err != nil {
+		ex.Error = err.Error()
+	} else {
+		ex.Status = resp.StatusCode
+		ex.ContentType = resp.Header.Get("Content-Type")
+		ex.Response = redactFixtureBody(req.URL.Path, respBody)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.fixture.Exchanges = append(r.fixture.Exchanges, ex)
+}
+
+func (r *fixtureRecorder) addBootstrap(name string, bootstrap commonParams.BootstrapInstance) {
+	if recordPath == "" {
+		return
+	}
+	bootstrap.InstanceToken = redactToken(bootstrap.InstanceToken)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.fixture.Bootstrap == nil {
+		r.fixture.Bootstrap = map[string]commonParams.BootstrapInstance{}
+	}
+	r.fixture.Bootstrap[name] = bootstrap
+}
+
+// write writes the exchanges recorded so far to path.
+func (r *fixtureRecorder) write(path string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.fixture.RunID = runID
+	r.fixture.GarmVersion = garmVersion()
+	r.fixture.RecordedAt = time.Now().UTC()
+	if r.fixture.Exchanges == nil {
+		r.fixture.Exchanges = []recordedExchange{}
+	}
+	data, err := json.MarshalIndent(r.fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func garmVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/cloudbase/garm" {
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// redactFixtureBody redacts the secrets of body, keeping tokens shaped like
+// tokens: the claims of JWTs are kept, only their signature goes, so the
+// steps decoding them still can when replaying.
+func redactFixtureBody(path string, body []byte) string {
+	if isSecretPath(path) {
+		return "REDACTED"
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return string(body)
+	}
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			for key, field := range value {
+				if !redactedFields[key] {
+					value[key] = walk(field)
+					continue
+				}
+				if token, ok := field.(string); ok && key == "token" {
+					value[key] = redactToken(token)
+					continue
+				}
+				value[key] = "REDACTED"
+			}
+		case []interface{}:
+			for i := range value {
+				value[i] = walk(value[i])
+			}
+		}
+		return v
+	}
+	redacted, err := json.Marshal(walk(doc))
+	if err != nil {
+		return ""
+	}
+	return string(redacted)
+}
+
+// redactToken replaces the signature of a JWT, or the whole of any other
+// token.
+func redactToken(token string) string {
+	if i := strings.LastIndexByte(token, '.'); i > 0 && strings.Count(token, ".") == 2 {
+		return token[:i+1] + "REDACTED"
+	}
+	return "REDACTED"
+}
+
+// ////////////
+// Replaying //
+// ////////////
+
+// replayTransport answers the calls of the client with the exchanges of a
+// fixture, in order, without a server. A call has to match the next recorded
+// exchange, loosely: values that change from run to run, eg: IDs, timestamps
+// and tokens, may differ. The recorded value of such a field is then replaced
+// with the value of the run in the responses that follow, so a job ID the run
+// picked is found in the jobs GARM lists.
+type replayTransport struct {
+	mux      sync.Mutex
+	fixture  *fixture
+	next     int
+	substs   map[string]string
+	replacer *strings.Replacer
+}
+
+var replayer *replayTransport
+
+func loadFixture(path string) (*fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// startReplay loads the fixture at path and sets the client up to replay it:
+// the run takes the run ID of the recorded one, and waiting steps stop
+// waiting between polls.
+func startReplay(path string) error {
+	f, err := loadFixture(path)
+	if err != nil {
+		return err
+	}
+	replayer = &replayTransport{fixture: f, substs: map[string]string{}, replacer: strings.NewReplacer()}
+	runID = f.RunID
+	runIDGenerated = false
+	if baseURL == "" {
+		baseURL = replayBaseURL
+	}
+	bootstrapSource = replayer.bootstrapParams
+	for _, opts := range []*pollOptions{&defaultPoll, &metricsPoll} {
+		opts.Interval = time.Millisecond
+		opts.MaxInterval = time.Millisecond
+	}
+	disabledPoll = time.Millisecond
+	return nil
+}
+
+// apiTransport returns the transport the calls to GARM go through: next, or
+// the replayed fixture, recorded for the reports.
+func apiTransport(next http.RoundTripper) http.RoundTripper {
+	if replayer != nil {
+		next = replayer
+	}
+	return &recordingTransport{next: next}
+}
+
+// checkReplayed fails when the run did not make every recorded call.
+func checkReplayed() error {
+	if replayer == nil {
+		return nil
+	}
+	replayer.mux.Lock()
+	defer replayer.mux.Unlock()
+	if left := len(replayer.fixture.Exchanges) - replayer.next; left > 0 {
+		ex := replayer.fixture.Exchanges[replayer.next]
+		return fmt.Errorf("replay: %d recorded exchanges left, starting with %s %s", left, ex.Method, ex.Path)
+	}
+	return nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.next >= len(t.fixture.Exchanges) {
+		return nil, fmt.Errorf("replay: %s %s was not recorded, the run made more calls", req.Method, req.URL.RequestURI())
+	}
+	rec := t.fixture.Exchanges[t.next]
+	if err := t.match(rec, req, body); err != nil {
+		return nil, fmt.Errorf("replay: exchange %d: %w", t.next, err)
+	}
+	t.next++
+	if rec.Error != "" {
+		return nil, fmt.Errorf("%s", rec.Error)
+	}
+
+	respBody := t.replacer.Replace(rec.Response)
+	header := http.Header{}
+	if rec.ContentType != "" {
+		header.Set("Content-Type", rec.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+// match checks that req, sent with body, is the recorded call, learning the
+// values of the run that differ from the recorded ones.
+func (t *replayTransport) match(rec recordedExchange, req *http.Request, body []byte) error {
+	if req.Method != rec.Method {
+		return fmt.Errorf("expected %s %s, got %s %s", rec.Method, rec.Path, req.Method, req.URL.RequestURI())
+	}
+	learned := map[string]string{}
+	recorded := strings.Split(rec.Path, "/")
+	actual := strings.Split(req.URL.RequestURI(), "/")
+	if len(recorded) != len(actual) {
+		return fmt.Errorf("expected %s %s, got %s %s", rec.Method, rec.Path, req.Method, req.URL.RequestURI())
+	}
+	for i := range recorded {
+		if err := t.matchValue(recorded[i], actual[i], volatileString(recorded[i]), learned); err != nil {
+			return fmt.Errorf("expected %s %s, got %s %s", rec.Method, rec.Path, req.Method, req.URL.RequestURI())
+		}
+	}
+
+	switch {
+	case len(rec.Request) == 0 && len(body) == 0:
+	case len(rec.Request) == 0 || len(body) == 0:
+		return fmt.Errorf("%s %s: expected a body %s, got %q", rec.Method, rec.Path, rec.Request, body)
+	default:
+		var want, got interface{}
+		if err := json.Unmarshal(rec.Request, &want); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			// Recorded bodies that are no JSON are kept as strings.
+			got = string(body)
+		}
+		if err := t.matchJSON("", want, got, learned); err != nil {
+			return fmt.Errorf("%s %s: request body: %w", rec.Method, rec.Path, err)
+		}
+	}
+
+	if len(learned) > 0 {
+		for old, value := range learned {
+			t.substs[old] = value
+		}
+		t.buildReplacer()
+	}
+	return nil
+}
+
+func (t *replayTransport) matchJSON(at string, want, got interface{}, learned map[string]string) error {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %v", jsonPath(at), got)
+		}
+		for key := range g {
+			if _, ok := w[key]; !ok {
+				return fmt.Errorf("%s: unexpected field", jsonPath(at+"."+key))
+			}
+		}
+		for key, value := range w {
+			field, ok := g[key]
+			if !ok {
+				return fmt.Errorf("%s: missing field", jsonPath(at+"."+key))
+			}
+			if redactedFields[key] {
+				continue
+			}
+			if n, ok := value.(float64); ok && volatileNumberFields[key] {
+				if _, ok := field.(float64); !ok {
+					return fmt.Errorf("%s: expected a number, got %v", jsonPath(at+"."+key), field)
+				}
+				if err := t.matchValue(formatNumber(n), formatNumber(field.(float64)), true, learned); err != nil {
+					return fmt.Errorf("%s: %w", jsonPath(at+"."+key), err)
+				}
+				continue
+			}
+			if err := t.matchJSON(at+"."+key, value, field, learned); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return fmt.Errorf("%s: expected %d items, got %v", jsonPath(at), len(w), got)
+		}
+		for i := range w {
+			if err := t.matchJSON(fmt.Sprintf("%s[%d]", at, i), w[i], g[i], learned); err != nil {
+				return err
+			}
+		}
+	case string:
+		g, ok := got.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %v", jsonPath(at), got)
+		}
+		if err := t.matchValue(w, g, volatileString(w), learned); err != nil {
+			return fmt.Errorf("%s: %w", jsonPath(at), err)
+		}
+	default:
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			return fmt.Errorf("%s: expected %v, got %v", jsonPath(at), want, got)
+		}
+	}
+	return nil
+}
+
+// matchValue checks that got is the recorded value want, or the value it
+// was already replaced with. Volatile values may differ, the first time
+// they do, got replaces want for the rest of the run.
+func (t *replayTransport) matchValue(want, got string, volatile bool, learned map[string]string) error {
+	if want == got {
+		return nil
+	}
+	if substituted, ok := t.substs[want]; ok && substituted == got {
+		return nil
+	}
+	if !volatile {
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	// Only values long enough to be told apart in responses are replaced.
+	if len(want) >= 8 {
+		learned[want] = got
+	}
+	return nil
+}
+
+func (t *replayTransport) buildReplacer() {
+	olds := make([]string, 0, len(t.substs))
+	for old := range t.substs {
+		olds = append(olds, old)
+	}
+	// Longer values first, so none is replaced within another.
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+	pairs := make([]string, 0, 2*len(olds))
+	for _, old := range olds {
+		pairs = append(pairs, old, t.substs[old])
+	}
+	t.replacer = strings.NewReplacer(pairs...)
+}
+
+func (t *replayTransport) bootstrapParams(name string) (commonParams.BootstrapInstance, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	bootstrap, ok := t.fixture.Bootstrap[name]
+	if !ok {
+		return commonParams.BootstrapInstance{}, fmt.Errorf("replay: the bootstrap params of %s were not recorded", name)
+	}
+	return bootstrap, nil
+}
+
+// volatileNumberFields are the numeric fields that change from run to run.
+var volatileNumberFields = map[string]bool{
+	"id":        true,
+	"run_id":    true,
+	"runner_id": true,
+	"agent_id":  true,
+}
+
+var volatilePatterns = []*regexp.Regexp{
+	// IDs.
+	regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`),
+	// Timestamps.
+	regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}`),
+	// JWTs.
+	regexp.MustCompile(`^eyJ[\w-]*\.[\w-]*\.[\w-]*$`),
+	// Unix times, job IDs and the URLs holding them.
+	regexp.MustCompile(`\d{9,}`),
+	// Names with a random suffix.
+	regexp.MustCompile(`-[0-9a-f]{8}$`),
+}
+
+// volatileString reports whether s holds a value that changes from run to
+// run.
+func volatileString(s string) bool {
+	for _, pattern := range volatilePatterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+func jsonPath(at string) string {
+	if at == "" {
+		return "body"
+	}
+	return "body" + at
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step statuses, as written to the reports.
+const (
+	statusPassed  = "passed"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// maxExchanges caps the API calls kept for a single step. Waiting steps poll
+// the API for as long as they run, only their last calls are kept.
+const maxExchanges = 50
+
+// stepRecord is the outcome of a step, as written to the JSON report.
+type stepRecord struct {
+	Group           string    `json:"group"`
+	Name            string    `json:"name"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	// SkipReason tells why a skipped step did not run.
+	SkipReason string     `json:"skip_reason,omitempty"`
+	Exchanges  []exchange `json:"exchanges,omitempty"`
+	// DroppedExchanges counts the calls left out over maxExchanges.
+	DroppedExchanges int `json:"dropped_exchanges,omitempty"`
+}
+
+// exchange is an API call made by a step.
+type exchange struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// DurationSeconds is the time the call took, until the response body
+	// was read.
+	DurationSeconds float64         `json:"duration_seconds"`
+	Request         json.RawMessage `json:"request,omitempty"`
+	Response        json.RawMessage `json:"response,omitempty"`
+}
+
+// runReport collects the records of all the steps of a run.
+type runReport struct {
+	mux     sync.Mutex
+	Name    string        `json:"name"`
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+	Status  string        `json:"status"`
+	Steps   []*stepRecord `json:"steps"`
+	current *stepRecord
+}
+
+var report = &runReport{Start: time.Now()}
+
+// Paths the reports are written to, when set.
+var (
+	junitReportPath = os.Getenv("GARM_JUNIT_REPORT")
+	jsonReportPath  = os.Getenv("GARM_JSON_REPORT")
+)
+
+// record runs a step and keeps its outcome, along with the API calls it made.
+func (r *runReport) record(groupName string, s step) error {
+	rec := &stepRecord{Group: groupName, Name: s.name, Start: time.Now()}
+	r.mux.Lock()
+	r.Steps = append(r.Steps, rec)
+	r.current = rec
+	r.mux.Unlock()
+
+	err := s.run()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.current = nil
+	rec.End = time.Now()
+	rec.DurationSeconds = rec.End.Sub(rec.Start).Seconds()
+	rec.Status = statusPassed
+	if err != nil {
+		rec.Status = statusFailed
+		rec.Error = err.Error()
+	}
+	return err
+}
+
+// skip keeps a step that did not run, for reason.
+func (r *runReport) skip(groupName string, s step, reason string) {
+	now := time.Now()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.Steps = append(r.Steps, &stepRecord{
+		Group:      groupName,
+		Name:       s.name,
+		Start:      now,
+		End:        now,
+		Status:     statusSkipped,
+		SkipReason: reason,
+	})
+}
+
+// currentStep returns the name of the step that is running, if any.
+func (r *runReport) currentStep() string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.current == nil {
+		return ""
+	}
+	return r.current.Name
+}
+
+func (r *runReport) addExchange(ex exchange) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.current == nil {
+		return
+	}
+	r.current.Exchanges = append(r.current.Exchanges, ex)
+	if len(r.current.Exchanges) > maxExchanges {
+		r.current.Exchanges = r.current.Exchanges[1:]
+		r.current.DroppedExchanges++
+	}
+}
+
+// write finishes the report and writes it to the configured paths.
+func (r *runReport) write() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.Name = scenario.Name
+	r.End = time.Now()
+	r.Status = statusPassed
+	for _, s := range r.Steps {
+		if s.Status == statusFailed {
+			r.Status = statusFailed
+		}
+	}
+
+	if jsonReportPath != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(jsonReportPath, data, 0o644); err != nil {
+			return err
+		}
+	}
+	if junitReportPath != "" {
+		data, err := xml.MarshalIndent(r.junit(), "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append([]byte(xml.Header), data...)
+		if err := os.WriteFile(junitReportPath, data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReports writes the reports, the HAR file and the fixture, if any were
+// asked for.
+func writeReports() {
+	if err := report.write(); err != nil {
+		log.Printf("failed to write reports: %v", err)
+	}
+	if harPath != "" {
+		if err := traffic.write(harPath); err != nil {
+			log.Printf("failed to write %s: %v", harPath, err)
+		}
+	}
+	if recordPath != "" {
+		if err := recorder.write(recordPath); err != nil {
+			log.Printf("failed to write %s: %v", recordPath, err)
+		}
+	}
+}
+
+// ////////
+// JUnit //
+// ////////
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func junitSeconds(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// junit groups the steps in one test suite per group, in the order the
+// groups first ran.
+func (r *runReport) junit() junitTestSuites {
+	suites := junitTestSuites{
+		Name: "garm-test-client " + r.Name,
+		Time: junitSeconds(r.End.Sub(r.Start).Seconds()),
+	}
+	index := map[string]int{}
+	for _, s := range r.Steps {
+		i, ok := index[s.Group]
+		if !ok {
+			i = len(suites.Suites)
+			index[s.Group] = i
+			suites.Suites = append(suites.Suites, junitTestSuite{
+				Name:      s.Group,
+				Timestamp: s.Start.UTC().Format("2006-01-02T15:04:05"),
+			})
+		}
+		suite := &suites.Suites[i]
+		testCase := junitTestCase{
+			Name:      s.Name,
+			Classname: "garm-test-client." + s.Group,
+			Time:      junitSeconds(s.DurationSeconds),
+			SystemOut: formatExchanges(s),
+		}
+		if s.Status == statusFailed {
+			testCase.Failure = &junitFailure{Message: firstLine(s.Error), Body: s.Error}
+			suite.Failures++
+			suites.Failures++
+		}
+		if s.Status == statusSkipped {
+			testCase.Skipped = &junitSkipped{Message: s.SkipReason}
+			suite.Skipped++
+			suites.Skipped++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Tests++
+		suites.Tests++
+	}
+	for i := range suites.Suites {
+		var total float64
+		for _, s := range r.Steps {
+			if s.Group == suites.Suites[i].Name {
+				total += s.DurationSeconds
+			}
+		}
+		suites.Suites[i].Time = junitSeconds(total)
+	}
+	return suites
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+func formatExchanges(s *stepRecord) string {
+	var b strings.Builder
+	if s.DroppedExchanges > 0 {
+		fmt.Fprintf(&b, "(%d earlier API calls left out)\n", s.DroppedExchanges)
+	}
+	for _, ex := range s.Exchanges {
+		if ex.Error != "" {
+			fmt.Fprintf(&b, "%s %s -> %s\n", ex.Method, ex.URL, ex.Error)
+		} else {
+			fmt.Fprintf(&b, "%s %s -> %d\n", ex.Method, ex.URL, ex.Status)
+		}
+		if len(ex.Request) > 0 {
+			fmt.Fprintf(&b, "request: %s\n", ex.Request)
+		}
+		if len(ex.Response) > 0 {
+			fmt.Fprintf(&b, "response: %s\n", ex.Response)
+		}
+	}
+	return b.String()
+}
+
+// ////////////////////
+// Recording the API //
+// ////////////////////
+
+// redactedFields are the JSON fields holding secrets, which never make it to
+// the reports.
+var redactedFields = map[string]bool{
+	"password":       true,
+	"token":          true,
+	"webhook_secret": true,
+	"oauth2_token":   true,
+}
+
+// recordingTransport adds the API calls going through it to the step that is
+// running and, when asked for, to the HAR file and the fixture of the run.
+type recordingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ex := exchange{Method: req.Method, URL: req.URL.String()}
+	var reqBody []byte
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		reqBody = body
+		ex.Request = redactJSON(body)
+	}
+
+	step := report.currentStep()
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		elapsed := time.Since(start)
+		ex.Error = err.Error()
+		ex.DurationSeconds = elapsed.Seconds()
+		report.addExchange(ex)
+		traffic.add(step, req, reqBody, nil, nil, start, elapsed, err)
+		recorder.add(req, reqBody, nil, nil, err)
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	ex.Status = resp.StatusCode
+	ex.DurationSeconds = elapsed.Seconds()
+	if isSecretPath(req.URL.Path) {
+		ex.Response = json.RawMessage(`"REDACTED"`)
+	} else {
+		ex.Response = redactJSON(body)
+	}
+	report.addExchange(ex)
+	traffic.add(step, req, reqBody, resp, body, start, elapsed, nil)
+	recorder.add(req, reqBody, resp, body, nil)
+	return resp, nil
+}
+
+// redactJSON returns body with the values of the secret fields replaced. A
+// body that is not JSON is kept as a JSON string.
+func redactJSON(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		quoted, _ := json.Marshal(string(body))
+		return quoted
+	}
+	redacted, err := json.Marshal(redact(doc))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redact(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if redactedFields[key] {
+				value[key] = "REDACTED"
+				continue
+			}
+			value[key] = redact(field)
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redact(value[i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm/params"
+)
+
+// scalingBaseline holds the min idle and max runners settings the pools had
+// before the scaling steps changed them, by entity kind.
+var scalingBaseline = map[string]poolLimits{}
+
+type poolLimits struct {
+	minIdle    uint
+	maxRunners uint
+}
+
+// poolCounts sorts the instances of a pool by what they are up to.
+type poolCounts struct {
+	idle    uint
+	pending uint
+	// deleting instances are on their way out, they do not count against
+	// the max runners of the pool anymore.
+	deleting uint
+	// total counts the instances that are not being deleted.
+	total uint
+}
+
+func countInstances(instances params.Instances) poolCounts {
+	var counts poolCounts
+	for _, instance := range instances {
+		switch {
+		case instance.Status == commonParams.InstancePendingDelete || instance.Status == commonParams.InstanceDeleting:
+			counts.deleting++
+			continue
+		case instance.Status == commonParams.InstanceRunning && instance.RunnerStatus == params.RunnerIdle:
+			counts.idle++
+		case instance.RunnerStatus == params.RunnerPending || instance.RunnerStatus == params.RunnerInstalling:
+			counts.pending++
+		}
+		counts.total++
+	}
+	return counts
+}
+
+func (c poolCounts) String() string {
+	return fmt.Sprintf("%d instances: %d idle, %d pending, %d being deleted", c.total+c.deleting, c.idle, c.pending, c.deleting)
+}
+
+// baselineLimits returns the settings the pool of e had before scaling,
+// reading them from GARM when no scaling step ran yet.
+func baselineLimits(e Entity) (poolLimits, error) {
+	if limits, ok := scalingBaseline[e.Kind()]; ok {
+		return limits, nil
+	}
+	state := e.State()
+	pool, err := e.GetPool(state.id, state.poolID)
+	if err != nil {
+		return poolLimits{}, err
+	}
+	limits := poolLimits{minIdle: pool.MinIdleRunners, maxRunners: pool.MaxRunners}
+	scalingBaseline[e.Kind()] = limits
+	return limits, nil
+}
+
+func setPoolLimits(e Entity, limits poolLimits) error {
+	state := e.State()
+	_, err := e.UpdatePool(state.id, state.poolID, params.UpdatePoolParams{
+		MinIdleRunners: &limits.minIdle,
+		MaxRunners:     &limits.maxRunners,
+	})
+	return err
+}
+
+// waitPoolCounts waits until the instances of the pool of e are as done
+// wants them to be.
+func waitPoolCounts(e Entity, what string, done func(poolCounts) bool) (poolCounts, error) {
+	state := e.State()
+	instances, err := poll(runCtx, fmt.Sprintf("%s pool %s to have %s", e.Kind(), state.poolID, what), defaultPoll,
+		func() (params.Instances, error) {
+			return listPoolInstances(cli, authToken, state.poolID)
+		}, func(instances params.Instances) bool {
+			return done(countInstances(instances))
+		})
+	return countInstances(instances), err
+}
+
+// waitScaledDown waits until the pool of e is back to limits: its min idle
+// runners, none pending and the extra ones gone.
+func waitScaledDown(e Entity, limits poolLimits) error {
+	counts, err := waitPoolCounts(e, fmt.Sprintf("%d idle runners and no extra ones", limits.minIdle), func(c poolCounts) bool {
+		return c.idle == limits.minIdle && c.pending == 0 && c.deleting == 0
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s pool has %s", e.Kind(), counts)
+	return nil
+}
+
+// queueJobs sends count queued jobs labelled for the pool of e, and returns
+// their IDs.
+func queueJobs(e Entity, count uint) ([]int64, error) {
+	labels, err := poolLabels(e)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for i := uint(0); i < count; i++ {
+		jobID := newJobID()
+		job, target := workflowJobEvent(e, "queued", jobID, labels, "")
+		if err := sendWebhook(target, e.State().webhookSecret, job); err != nil {
+			return ids, err
+		}
+		ids = append(ids, jobID)
+	}
+	return ids, nil
+}
+
+// cancelJobs tells GARM the queued jobs of e were cancelled, the way GitHub
+// completes jobs no runner picked up.
+func cancelJobs(e Entity, ids []int64) error {
+	labels, err := poolLabels(e)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, jobID := range ids {
+		job, target := workflowJobEvent(e, "completed", jobID, labels, "")
+		job.WorkflowJob.Conclusion = "cancelled"
+		if err := sendWebhook(target, e.State().webhookSecret, job); err != nil {
+			errs = append(errs, fmt.Errorf("cancelling job %d: %w", jobID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// otherPoolsRoom returns the max runners of the other enabled pools of e. The
+// jobs queued for the pool of e may go to them as well, when they have the
+// labels of the jobs.
+func otherPoolsRoom(e Entity) (uint, error) {
+	state := e.State()
+	pools, err := e.ListPools(state.id)
+	if err != nil {
+		return 0, err
+	}
+	var room uint
+	for _, pool := range pools {
+		if pool.ID != state.poolID && pool.Enabled {
+			room += pool.MaxRunners
+		}
+	}
+	return room, nil
+}
+
+// //////////
+// Scaling //
+// //////////
+func ScaleUpEntityPool(e Entity) error {
+	limits, err := baselineLimits(e)
+	if err != nil {
+		return err
+	}
+	scaled := poolLimits{minIdle: scenario.Scaling.IdleRunners, maxRunners: limits.maxRunners}
+	if scaled.maxRunners < scaled.minIdle {
+		scaled.maxRunners = scaled.minIdle
+	}
+	log.Printf(">>> Scale %s pool up to %d idle runners", e.Kind(), scaled.minIdle)
+	if err := setPoolLimits(e, scaled); err != nil {
+		return err
+	}
+	counts, err := waitPoolCounts(e, fmt.Sprintf("%d idle runners", scaled.minIdle), func(c poolCounts) bool {
+		return c.idle >= scaled.minIdle
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s pool has %s", e.Kind(), counts)
+	return nil
+}
+
+func ScaleDownEntityPool(e Entity) error {
+	limits, err := baselineLimits(e)
+	if err != nil {
+		return err
+	}
+	log.Printf(">>> Scale %s pool back down to %d idle runners", e.Kind(), limits.minIdle)
+	if err := setPoolLimits(e, limits); err != nil {
+		return err
+	}
+	return waitScaledDown(e, limits)
+}
+
+func CapEntityPoolMaxRunners(e Entity) error {
+	limits, err := baselineLimits(e)
+	if err != nil {
+		return err
+	}
+	capped := poolLimits{minIdle: limits.minIdle, maxRunners: scenario.Scaling.MaxRunners}
+	if capped.maxRunners < capped.minIdle {
+		return fmt.Errorf("the scaling max runners (%d) are below the min idle runners of the %s pool (%d)",
+			capped.maxRunners, e.Kind(), capped.minIdle)
+	}
+	room, err := otherPoolsRoom(e)
+	if err != nil {
+		return err
+	}
+	// Enough jobs to fill the other pools they could go to and to go over
+	// the cap of this one.
+	jobs := capped.maxRunners + room + 1
+	log.Printf(">>> Queue %d jobs for the %s pool, capped at %d runners", jobs, e.Kind(), capped.maxRunners)
+	if err := setPoolLimits(e, capped); err != nil {
+		return err
+	}
+	ids, err := queueJobs(e, jobs)
+	if err == nil {
+		err = checkPoolCap(e, capped.maxRunners)
+	}
+	if cancelErr := cancelJobs(e, ids); cancelErr != nil {
+		err = errors.Join(err, cancelErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf(">>> Lift the cap of the %s pool", e.Kind())
+	if err := setPoolLimits(e, limits); err != nil {
+		return err
+	}
+	return waitScaledDown(e, limits)
+}
+
+// checkPoolCap waits for the pool of e to reach maxRunners instances, then
+// checks it stays there for disabledWindow.
+func checkPoolCap(e Entity, maxRunners uint) error {
+	var over error
+	check := func(c poolCounts) bool {
+		if c.total > maxRunners {
+			over = fmt.Errorf("%s pool went over its %d max runners: %s", e.Kind(), maxRunners, c)
+		}
+		return over != nil || c.total == maxRunners
+	}
+	counts, err := waitPoolCounts(e, fmt.Sprintf("%d runners", maxRunners), check)
+	if err != nil || over != nil {
+		return errors.Join(err, over)
+	}
+	log.Printf("%s pool reached its cap: %s", e.Kind(), counts)
+
+	_, err = watchPoolInstances(e, func(instances []params.Instance) error {
+		check(countInstances(instances))
+		return over
+	})
+	return err
+}
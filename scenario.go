@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm/params"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes a run: the entities and pools it creates, the payloads
+// they are updated with and the steps to run. Scenario files are YAML, the
+// API payloads in them use the same field names as the GARM API, eg:
+//
+//	name: lxd-local
+//	entities:
+//	  repo:
+//	    owner: test-garm-org
+//	    name: test-garm-repo
+//	    update:
+//	      credentials_name: ${CREDENTIALS_NAME}-clone
+//	    pool:
+//	      provider_name: lxd_local
+//	      max_runners: 2
+//	      image: ubuntu:22.04
+//	      flavor: garm
+//	      os_type: linux
+//	      os_arch: amd64
+//	      tags: [ubuntu, simple-runner]
+//	      enabled: true
+//	steps:
+//	  - run: repositories
+//	  - run: WaitRepoInstance
+//	    timeout: 10m
+//	    assert:
+//	      - pool: repo
+//	        instances: 1
+//	  - run: cleanup
+//
+// Environment variables in the file are expanded before it is parsed.
+type Scenario struct {
+	Name     string           `json:"name"`
+	Entities ScenarioEntities `json:"entities"`
+	// Pool is the pool created by the pools group, through the pools API.
+	Pool       params.CreatePoolParams `json:"pool"`
+	PoolUpdate params.UpdatePoolParams `json:"pool_update"`
+	// Scaling tells how far the scaling group scales the repository pool.
+	Scaling ScalingSpec `json:"scaling"`
+	// Steps are run in order. Without steps, every group of the suite runs.
+	Steps []ScenarioStep `json:"steps"`
+}
+
+// ScenarioEntities holds the entities of a scenario, one of each kind.
+type ScenarioEntities struct {
+	Repo       EntitySpec `json:"repo"`
+	Org        EntitySpec `json:"org"`
+	Enterprise EntitySpec `json:"enterprise"`
+}
+
+// EntitySpec describes an entity, its pool and how both of them are updated.
+type EntitySpec struct {
+	// Owner is only used by repositories.
+	Owner string `json:"owner,omitempty"`
+	Name  string `json:"name"`
+	// Update defaults to switching to the "<CREDENTIALS_NAME>-clone"
+	// credentials when it does not name any.
+	Update     params.UpdateEntityParams `json:"update"`
+	Pool       params.CreatePoolParams   `json:"pool"`
+	PoolUpdate params.UpdatePoolParams   `json:"pool_update"`
+}
+
+// ScalingSpec describes the scaling checks of a pool.
+type ScalingSpec struct {
+	// IdleRunners is the number of idle runners the pool is scaled up to.
+	IdleRunners uint `json:"idle_runners"`
+	// MaxRunners is the cap the pool is given while more jobs than it
+	// allows are queued for it.
+	MaxRunners uint `json:"max_runners"`
+}
+
+// ScenarioStep runs a step of the suite, or all the steps of a group, then
+// checks the assertions.
+type ScenarioStep struct {
+	// Run is the name of a step, eg: CreateRepoPool, or of a group, eg: pools.
+	Run string `json:"run"`
+	// Timeout overrides how long the waits of the step may take, eg: 10m.
+	Timeout string      `json:"timeout,omitempty"`
+	Assert  []Assertion `json:"assert,omitempty"`
+
+	timeout time.Duration
+	group   string
+	steps   []step
+}
+
+// Assertion checks a pool or an entity, as returned by the API. Exactly one of
+// Pool and Entity must be set.
+type Assertion struct {
+	// Pool is the pool of an entity (repo, org or enterprise) or "pool" for the
+	// pool created by the pools group.
+	Pool string `json:"pool,omitempty"`
+	// Entity is one of repo, org or enterprise.
+	Entity string `json:"entity,omitempty"`
+	// Instances is the number of instances the pool must have.
+	Instances *int `json:"instances,omitempty"`
+	// Expect holds fields the resource must have. Nested objects only need to
+	// have the fields listed.
+	Expect map[string]interface{} `json:"expect,omitempty"`
+}
+
+// scenario is the scenario being run. It defaults to the one the client has
+// always run, built again once the run ID its entities are named after is
+// known.
+var scenario = defaultScenario()
+
+func defaultPoolParams(image string) params.CreatePoolParams {
+	return params.CreatePoolParams{
+		MaxRunners:     2,
+		MinIdleRunners: 0,
+		Flavor:         "garm",
+		Image:          image,
+		OSType:         commonParams.Linux,
+		OSArch:         commonParams.Amd64,
+		ProviderName:   "lxd_local",
+		Tags:           []string{"ubuntu", "simple-runner"},
+		Enabled:        true,
+	}
+}
+
+func defaultScenario() Scenario {
+	var maxRunners uint = 5
+	var entityIdleRunners uint = 1
+	var poolIdleRunners uint = 0
+	entityPoolUpdate := params.UpdatePoolParams{
+		MinIdleRunners: &entityIdleRunners,
+		MaxRunners:     &maxRunners,
+	}
+	return Scenario{
+		Name: "default",
+		// The entities are named after the run, so runs sharing a GARM do
+		// not share them: GARM allows a single pool per provider, image and
+		// flavor on an entity.
+		Entities: ScenarioEntities{
+			Repo: EntitySpec{
+				Owner:      runName("test-garm-org"),
+				Name:       runName("test-garm-repo"),
+				Pool:       defaultPoolParams("ubuntu:22.04"),
+				PoolUpdate: entityPoolUpdate,
+			},
+			Org: EntitySpec{
+				Name:       runName("test-garm-org"),
+				Pool:       defaultPoolParams("ubuntu:22.04"),
+				PoolUpdate: entityPoolUpdate,
+			},
+			Enterprise: EntitySpec{
+				Name:       runName("cloudbase-solutions"),
+				Pool:       defaultPoolParams("ubuntu:22.04"),
+				PoolUpdate: entityPoolUpdate,
+			},
+		},
+		// The extra pool is told apart from the entity pools by its image.
+		Pool: defaultPoolParams("ubuntu:20.04"),
+		PoolUpdate: params.UpdatePoolParams{
+			MinIdleRunners: &poolIdleRunners,
+			MaxRunners:     &maxRunners,
+		},
+		Scaling: ScalingSpec{IdleRunners: 3, MaxRunners: 3},
+	}
+}
+
+// loadScenario reads a scenario file. Anything the file leaves out is taken
+// from the default scenario.
+func loadScenario(path string) (Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), &doc); err != nil {
+		return Scenario{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	// The API payloads only carry json tags, so the document goes through
+	// JSON to fill them in.
+	asJSON, err := json.Marshal(doc)
+	if err != nil {
+		return Scenario{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	s := defaultScenario()
+	if err := json.Unmarshal(asJSON, &s); err != nil {
+		return Scenario{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return Scenario{}, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Scenario) validate() error {
+	pools := map[string]*params.CreatePoolParams{
+		"pool":            &s.Pool,
+		"repo pool":       &s.Entities.Repo.Pool,
+		"org pool":        &s.Entities.Org.Pool,
+		"enterprise pool": &s.Entities.Enterprise.Pool,
+	}
+	for name, pool := range pools {
+		if err := pool.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	steps := map[string][]step{}
+	groups := map[string]string{}
+	for _, g := range suite() {
+		steps[g.name] = g.steps
+		groups[g.name] = g.name
+		for _, groupStep := range g.steps {
+			steps[groupStep.name] = []step{groupStep}
+			groups[groupStep.name] = g.name
+		}
+	}
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		found, ok := steps[st.Run]
+		if !ok {
+			return fmt.Errorf("step %d: no step or group named %q", i+1, st.Run)
+		}
+		st.steps = found
+		st.group = groups[st.Run]
+		if st.Timeout != "" {
+			timeout, err := time.ParseDuration(st.Timeout)
+			if err != nil {
+				return fmt.Errorf("step %d (%s): %w", i+1, st.Run, err)
+			}
+			st.timeout = timeout
+		}
+		for _, a := range st.Assert {
+			if err := a.validate(); err != nil {
+				return fmt.Errorf("step %d (%s): %w", i+1, st.Run, err)
+			}
+		}
+	}
+	return nil
+}
+
+// groups returns the groups of the suite the steps of the scenario belong to.
+func (s *Scenario) groups() []group {
+	used := map[string]bool{}
+	for _, st := range s.Steps {
+		used[st.group] = true
+	}
+	var groups []group
+	for _, g := range suite() {
+		if used[g.name] {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// entitySpec returns the part of the scenario describing e.
+func entitySpec(e Entity) *EntitySpec {
+	switch e.Kind() {
+	case "repo":
+		return &scenario.Entities.Repo
+	case "org":
+		return &scenario.Entities.Org
+	default:
+		return &scenario.Entities.Enterprise
+	}
+}
+
+// entityByKind returns the entity of the given kind.
+func entityByKind(kind string) (Entity, bool) {
+	for _, e := range []Entity{repo, org, enterprise} {
+		if e.Kind() == kind {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// runScenario runs the steps of the scenario, or the given groups when it
+// does not list any.
+func runScenario(groups []group) {
+	if len(scenario.Steps) == 0 {
+		for _, g := range groups {
+			for _, s := range g.steps {
+				runStep(g.name, s)
+			}
+		}
+		return
+	}
+
+	log.Printf(">>> Running scenario %s", scenario.Name)
+	for _, st := range scenario.Steps {
+		restore := defaultPoll
+		if st.timeout > 0 {
+			defaultPoll.Timeout = st.timeout
+		}
+		for _, s := range st.steps {
+			runStep(st.group, s)
+		}
+		defaultPoll = restore
+		for i, a := range st.Assert {
+			runStep(st.group, step{name: fmt.Sprintf("%s/assert-%d", st.Run, i+1), run: a.check})
+		}
+	}
+}
+
+func runStep(groupName string, s step) {
+	if err := runCtx.Err(); err != nil {
+		handleError(fmt.Errorf("run interrupted: %w", err))
+	}
+	if reason := s.skipReason(); reason != "" {
+		log.Printf(">>> Skip %s: %s", s.name, reason)
+		report.skip(groupName, s, reason)
+		return
+	}
+	handleError(report.record(groupName, s))
+}
+
+func (a Assertion) validate() error {
+	switch {
+	case a.Pool != "" && a.Entity != "":
+		return fmt.Errorf("an assertion checks either a pool or an entity, not both")
+	case a.Pool != "":
+		if _, ok := entityByKind(a.Pool); !ok && a.Pool != "pool" {
+			return fmt.Errorf("unknown pool %q", a.Pool)
+		}
+	case a.Entity != "":
+		if _, ok := entityByKind(a.Entity); !ok {
+			return fmt.Errorf("unknown entity %q", a.Entity)
+		}
+		if a.Instances != nil {
+			return fmt.Errorf("instances can only be checked on pools")
+		}
+	default:
+		return fmt.Errorf("an assertion needs a pool or an entity")
+	}
+	return nil
+}
+
+// check fetches the resource the assertion is about and compares it with
+// what is expected.
+func (a Assertion) check() error {
+	var what string
+	var resource interface{}
+	if a.Pool != "" {
+		what = "pool"
+		var pool *params.Pool
+		var err error
+		if e, ok := entityByKind(a.Pool); ok {
+			what = e.Kind() + " pool"
+			state := e.State()
+			pool, err = e.GetPool(state.id, state.poolID)
+		} else {
+			pool, err = getPool(cli, authToken, poolID)
+		}
+		if err != nil {
+			return err
+		}
+		if a.Instances != nil && len(pool.Instances) != *a.Instances {
+			return fmt.Errorf("assertion failed: %s has %d instances, expected %d", what, len(pool.Instances), *a.Instances)
+		}
+		resource = pool
+	} else {
+		what = a.Entity
+		e, _ := entityByKind(a.Entity)
+		info, err := e.Get(e.State().id)
+		if err != nil {
+			return err
+		}
+		resource = info.Payload
+	}
+
+	actual, err := toGeneric(resource)
+	if err != nil {
+		return err
+	}
+	expected, err := toGeneric(a.Expect)
+	if err != nil {
+		return err
+	}
+	fields, _ := expected.(map[string]interface{})
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		got := actual.(map[string]interface{})[key]
+		if !matches(fields[key], got) {
+			return fmt.Errorf("assertion failed: %s has %s=%v, expected %v", what, key, got, fields[key])
+		}
+	}
+	log.Printf("assertions on %s passed", what)
+	return nil
+}
+
+// toGeneric turns v into what decoding its JSON form into an interface{}
+// gives, so values from the API and from YAML can be compared.
+func toGeneric(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+// matches reports whether actual has the expected value. Objects match when
+// actual has all the expected fields, any other value has to be equal.
+func matches(expected, actual interface{}) bool {
+	expectedMap, ok := expected.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(expected, actual)
+	}
+	actualMap, ok := actual.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for key, value := range expectedMap {
+		if !matches(value, actualMap[key]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadScenario(t *testing.T) {
+	t.Setenv("SCENARIO_TEST_IMAGE", "ubuntu:23.04")
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+		check   func(t *testing.T, s Scenario)
+	}{
+		{
+			name: "defaults",
+			doc:  "name: empty\n",
+			check: func(t *testing.T, s Scenario) {
+				if s.Name != "empty" || s.Entities.Repo.Name != defaultScenario().Entities.Repo.Name || len(s.Steps) != 0 {
+					t.Errorf("scenario %+v does not keep the defaults", s)
+				}
+			},
+		},
+		{
+			name: "pool and steps",
+			doc: `
+entities:
+  repo:
+    pool:
+      provider_name: lxd_local
+      max_runners: 3
+      min_idle_runners: 1
+      image: ${SCENARIO_TEST_IMAGE}
+      flavor: small
+      tags: [ubuntu]
+steps:
+  - run: repositories
+  - run: WaitRepoInstance
+    timeout: 10m
+    assert:
+      - pool: repo
+        instances: 1
+      - entity: repo
+        expect:
+          name: test-garm-repo
+`,
+			check: func(t *testing.T, s Scenario) {
+				pool := s.Entities.Repo.Pool
+				if pool.Image != "ubuntu:23.04" || pool.MaxRunners != 3 || pool.MinIdleRunners != 1 {
+					t.Errorf("repo pool = %+v", pool)
+				}
+				if len(s.Steps) != 2 || len(s.Steps[0].steps) < 2 || len(s.Steps[1].steps) != 1 {
+					t.Fatalf("steps = %+v", s.Steps)
+				}
+				if s.Steps[1].timeout != 10*time.Minute || len(s.Steps[1].Assert) != 2 {
+					t.Errorf("step 2 = %+v", s.Steps[1])
+				}
+			},
+		},
+		{
+			name:    "bad YAML",
+			doc:     "steps: [",
+			wantErr: "parsing",
+		},
+		{
+			name:    "wrong type",
+			doc:     "steps: run",
+			wantErr: "parsing",
+		},
+		{
+			name:    "invalid pool",
+			doc:     "pool:\n  max_runners: 0\n",
+			wantErr: "pool: max_runners cannot be 0",
+		},
+		{
+			name:    "unknown step",
+			doc:     "steps:\n  - run: DoesNotExist\n",
+			wantErr: `step 1: no step or group named "DoesNotExist"`,
+		},
+		{
+			name:    "bad timeout",
+			doc:     "steps:\n  - run: repositories\n    timeout: soon\n",
+			wantErr: "step 1 (repositories)",
+		},
+		{
+			name:    "pool and entity",
+			doc:     "steps:\n  - run: repositories\n    assert:\n      - pool: repo\n        entity: repo\n",
+			wantErr: "either a pool or an entity",
+		},
+		{
+			name:    "no pool nor entity",
+			doc:     "steps:\n  - run: repositories\n    assert:\n      - instances: 1\n",
+			wantErr: "needs a pool or an entity",
+		},
+		{
+			name:    "unknown pool",
+			doc:     "steps:\n  - run: repositories\n    assert:\n      - pool: runner\n",
+			wantErr: `unknown pool "runner"`,
+		},
+		{
+			name:    "instances of an entity",
+			doc:     "steps:\n  - run: repositories\n    assert:\n      - entity: org\n        instances: 1\n",
+			wantErr: "instances can only be checked on pools",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "scenario.yaml")
+			if err := os.WriteFile(path, []byte(tt.doc), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := loadScenario(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadScenario() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, s)
+		})
+	}
+}
+
+func TestLoadScenarioFiles(t *testing.T) {
+	files, err := filepath.Glob("scenarios/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if _, err := loadScenario(file); err != nil {
+			t.Errorf("loadScenario(%s): %v", file, err)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected interface{}
+		actual   interface{}
+		want     bool
+	}{
+		{"same string", "garm", "garm", true},
+		{"other string", "garm", "lxd", false},
+		{"same number", 2.0, 2.0, true},
+		{"other type", "2", 2.0, false},
+		{"missing", "garm", nil, false},
+		{"same list", []interface{}{"a", "b"}, []interface{}{"a", "b"}, true},
+		{"list order", []interface{}{"a", "b"}, []interface{}{"b", "a"}, false},
+		{"fields subset", map[string]interface{}{"name": "r"}, map[string]interface{}{"name": "r", "id": "1"}, true},
+		{"nested fields", map[string]interface{}{"endpoint": map[string]interface{}{"name": "github"}},
+			map[string]interface{}{"endpoint": map[string]interface{}{"name": "github", "url": "u"}}, true},
+		{"missing field", map[string]interface{}{"name": "r"}, map[string]interface{}{"id": "1"}, false},
+		{"object against value", map[string]interface{}{"name": "r"}, "r", false},
+	}
+	for _, tt := range tests {
+		if got := matches(tt.expected, tt.actual); got != tt.want {
+			t.Errorf("%s: matches(%v, %v) = %v, want %v", tt.name, tt.expected, tt.actual, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import "fmt"
+
+// Names of the step groups making up the suite.
+const (
+	groupInit          = "init"
+	groupController    = "controller"
+	groupRepositories  = "repositories"
+	groupOrganizations = "organizations"
+	groupInstances     = "instances"
+	groupWebhooks      = "webhooks"
+	groupMetrics       = "metrics"
+	groupPools         = "pools"
+	groupNegative      = "negative"
+	groupScaling       = "scaling"
+	groupDisabled      = "disabled"
+	groupCredentials   = "credentials"
+	groupEnterprises   = "enterprises"
+	groupBootstrap     = "bootstrap"
+	groupCleanup       = "cleanup"
+)
+
+// step is a single named action of the suite.
+type step struct {
+	name string
+	run  func() error
+	// entity is the entity the step works on, if any. The step is left out
+	// of runs that do not create it.
+	entity Entity
+	// changesEntity is set on the steps updating or deleting entity, which
+	// are skipped when the run did not create it.
+	changesEntity bool
+}
+
+// skipReason tells why the step cannot run, if it cannot.
+func (s step) skipReason() string {
+	if s.entity == nil {
+		return ""
+	}
+	if reason := entitySkipReason(s.entity); reason != "" {
+		return reason
+	}
+	if s.changesEntity && s.entity.State().id != "" && !s.entity.State().owned {
+		return fmt.Sprintf("the %s was not created by this run, other runs may be using it", s.entity.Kind())
+	}
+	return ""
+}
+
+// group is an ordered set of steps exercising one resource group.
+type group struct {
+	name string
+	// requires lists the groups creating the resources this group relies on.
+	requires []string
+	steps    []step
+}
+
+// suite returns every group of the suite, in the order they need to run.
+func suite() []group {
+	return []group{
+		{
+			name: groupInit,
+			steps: []step{
+				{name: "FirstRun", run: FirstRun},
+				{name: "Login", run: Login},
+			},
+		},
+		{
+			name: groupController,
+			steps: []step{
+				{name: "ListCredentials", run: ListCredentials},
+				{name: "ListProviders", run: ListProviders},
+				{name: "ListJobs", run: ListJobs},
+				{name: "GetMetricsToken", run: GetMetricsToken},
+			},
+		},
+		{
+			name:  groupRepositories,
+			steps: entitySteps(repo),
+		},
+		{
+			name:  groupOrganizations,
+			steps: entitySteps(org),
+		},
+		{
+			name:     groupInstances,
+			requires: []string{groupRepositories, groupOrganizations},
+			steps: []step{
+				entityStep("Wait%sInstance", repo, WaitEntityInstance),
+				entityStep("List%sInstances", repo, ListEntityInstances),
+				entityStep("Wait%sInstance", org, WaitEntityInstance),
+				entityStep("List%sInstances", org, ListEntityInstances),
+				{name: "ListInstances", run: ListInstances},
+				{name: "GetInstance", run: GetInstance},
+			},
+		},
+		{
+			name:     groupWebhooks,
+			requires: []string{groupInstances},
+			steps: []step{
+				entityStep("Send%sJobBadSignature", repo, SendEntityJobBadSignature),
+				entityStep("Send%sJobQueued", repo, SendEntityJobQueued),
+				entityStep("Send%sJobInProgress", repo, SendEntityJobInProgress),
+				entityStep("Send%sJobCompleted", repo, SendEntityJobCompleted),
+			},
+		},
+		{
+			name:     groupMetrics,
+			requires: []string{groupInstances},
+			steps: []step{
+				{name: "ScrapeMetrics", run: ScrapeMetrics},
+				{name: "MetricsRejectBadTokens", run: MetricsRejectBadTokens},
+			},
+		},
+		{
+			name:     groupPools,
+			requires: []string{groupRepositories},
+			steps: onEntity(repo, []step{
+				{name: "CreatePool", run: CreatePool},
+				{name: "ListPools", run: ListPools},
+				{name: "UpdatePool", run: UpdatePool},
+				{name: "GetPool", run: GetPool},
+				{name: "ListPoolInstances", run: ListPoolInstances},
+			}),
+		},
+		{
+			name:     groupNegative,
+			requires: []string{groupRepositories},
+			steps: onEntity(repo, []step{
+				{name: "RejectMissingToken", run: RejectMissingToken},
+				{name: "RejectTamperedToken", run: RejectTamperedToken},
+				{name: "RejectExpiredToken", run: RejectExpiredToken},
+				{name: "RejectMissingResources", run: RejectMissingResources},
+				{name: "RejectMalformedRequests", run: RejectMalformedRequests},
+				{name: "RejectBadLogin", run: RejectBadLogin},
+			}),
+		},
+		{
+			name:     groupScaling,
+			requires: []string{groupRepositories},
+			steps: []step{
+				entityStep("ScaleUp%sPool", repo, ScaleUpEntityPool),
+				entityStep("ScaleDown%sPool", repo, ScaleDownEntityPool),
+				entityStep("Cap%sPoolMaxRunners", repo, CapEntityPoolMaxRunners),
+			},
+		},
+		{
+			name:     groupDisabled,
+			requires: []string{groupRepositories},
+			steps: []step{
+				entityStep("Disable%sPoolNoReplacement", repo, DisableEntityPoolNoReplacement),
+				entityStep("Queue%sJobDisabledPool", repo, QueueEntityJobDisabledPool),
+				entityStep("Enable%sPoolPickUpJob", repo, EnableEntityPoolPickUpJob),
+			},
+		},
+		{
+			name:     groupCredentials,
+			requires: []string{groupRepositories, groupOrganizations},
+			steps:    concatSteps(credentialSteps(repo), credentialSteps(org)),
+		},
+		{
+			name: groupEnterprises,
+			steps: concatSteps(
+				entitySteps(enterprise),
+				[]step{
+					entityStep("Wait%sInstance", enterprise, WaitEntityInstance),
+					entityStep("List%sInstances", enterprise, ListEntityInstances),
+				},
+				credentialSteps(enterprise),
+				[]step{
+					entityStep("Disable%sPool", enterprise, DisableEntityPool),
+					entityStep("Delete%sInstance", enterprise, DeleteEntityInstance),
+					entityStep("Wait%sPoolNoInstances", enterprise, WaitEntityPoolNoInstances),
+					entityStep("Delete%sPool", enterprise, DeleteEntityPool),
+					ownerStep("Delete%s", enterprise, DeleteEntity),
+				},
+			),
+		},
+		{
+			name:     groupBootstrap,
+			requires: []string{groupRepositories},
+			steps: onEntity(repo, []step{
+				{name: "CreateBootstrapPool", run: CreateBootstrapPool},
+				{name: "BootstrapRunnerIdle", run: BootstrapRunnerIdle},
+				{name: "BootstrapRunnerFailed", run: BootstrapRunnerFailed},
+				{name: "BootstrapRejectBadTokens", run: BootstrapRejectBadTokens},
+			}),
+		},
+		{
+			name: groupCleanup,
+			steps: []step{
+				{name: "DeleteBootstrapPool", run: DeleteBootstrapPool},
+				entityStep("Disable%sPool", repo, DisableEntityPool),
+				entityStep("Disable%sPool", org, DisableEntityPool),
+				entityStep("Delete%sInstance", repo, DeleteEntityInstance),
+				entityStep("Delete%sInstance", org, DeleteEntityInstance),
+				entityStep("Wait%sPoolNoInstances", repo, WaitEntityPoolNoInstances),
+				entityStep("Wait%sPoolNoInstances", org, WaitEntityPoolNoInstances),
+				entityStep("Delete%sPool", repo, DeleteEntityPool),
+				entityStep("Delete%sPool", org, DeleteEntityPool),
+				{name: "DeletePool", run: DeletePool},
+				ownerStep("Delete%s", repo, DeleteEntity),
+				ownerStep("Delete%s", org, DeleteEntity),
+			},
+		},
+	}
+}
+
+// filterEntities returns groups without the steps working on entities that
+// are not in entities, and without the groups that have no steps left.
+func filterEntities(groups []group, entities map[string]bool) []group {
+	var filtered []group
+	for _, g := range groups {
+		if kind, ok := entityGroups[g.name]; ok && !entities[kind] {
+			continue
+		}
+		steps := make([]step, 0, len(g.steps))
+		for _, s := range g.steps {
+			if s.entity == nil || entities[s.entity.Kind()] {
+				steps = append(steps, s)
+			}
+		}
+		if len(steps) == 0 && len(g.steps) > 0 {
+			continue
+		}
+		g.steps = steps
+		filtered = append(filtered, g)
+	}
+	return filtered
+}
+
+// entitySteps returns the steps creating an entity and a pool for it, then
+// reading them back and updating them.
+func entitySteps(e Entity) []step {
+	return []step{
+		entityStep("Create%s", e, CreateEntity),
+		entityStep("List%ss", e, ListEntities),
+		ownerStep("Update%s", e, UpdateEntity),
+		entityStep("Get%s", e, GetEntity),
+		entityStep("Create%sPool", e, CreateEntityPool),
+		entityStep("List%sPools", e, ListEntityPools),
+		entityStep("Get%sPool", e, GetEntityPool),
+		entityStep("Update%sPool", e, UpdateEntityPool),
+	}
+}
+
+// credentialSteps returns the steps rotating the credentials of an entity,
+// checking its pool keeps working, then switching them back.
+func credentialSteps(e Entity) []step {
+	return []step{
+		ownerStep("Rotate%sCredentials", e, RotateEntityCredentials),
+		ownerStep("Replace%sInstanceAfterRotation", e, ReplaceEntityInstanceAfterRotation),
+		ownerStep("Reject%sUnknownCredentials", e, RejectEntityUnknownCredentials),
+		ownerStep("Restore%sCredentials", e, RestoreEntityCredentials),
+	}
+}
+
+// entityStep returns a step running fn against e. The step is named after
+// format, with the kind of e filled in, eg: Create%sPool gives CreateRepoPool.
+func entityStep(format string, e Entity, fn func(Entity) error) step {
+	return step{
+		name:   fmt.Sprintf(format, title(e)),
+		run:    func() error { return fn(e) },
+		entity: e,
+	}
+}
+
+// ownerStep is an entityStep updating or deleting e, skipped when the run did
+// not create e.
+func ownerStep(format string, e Entity, fn func(Entity) error) step {
+	s := entityStep(format, e, fn)
+	s.changesEntity = true
+	return s
+}
+
+// concatSteps returns the steps of every list, in order.
+func concatSteps(lists ...[]step) []step {
+	var steps []step
+	for _, list := range lists {
+		steps = append(steps, list...)
+	}
+	return steps
+}
+
+// onEntity marks steps as working on e.
+func onEntity(e Entity, steps []step) []step {
+	for i := range steps {
+		steps[i].entity = e
+	}
+	return steps
+}
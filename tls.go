@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	openapiRuntimeClient "github.com/go-openapi/runtime/client"
+)
+
+var (
+	// caBundle is a PEM file of the CAs the certificate of GARM is checked
+	// against, in place of the CAs of the system.
+	caBundle = os.Getenv("GARM_CA_BUNDLE")
+	// clientCert and clientKey are the PEM files of the certificate the client
+	// authenticates to GARM with, when GARM sits behind mutual TLS.
+	clientCert = os.Getenv("GARM_CLIENT_CERT")
+	clientKey  = os.Getenv("GARM_CLIENT_KEY")
+	// insecureSkipVerify accepts any certificate from GARM.
+	insecureSkipVerify, _ = strconv.ParseBool(os.Getenv("GARM_TLS_INSECURE"))
+)
+
+// tlsClientOptions returns the TLS options the connections to GARM are made
+// with.
+func tlsClientOptions() (openapiRuntimeClient.TLSClientOptions, error) {
+	opts := openapiRuntimeClient.TLSClientOptions{
+		Certificate:        clientCert,
+		Key:                clientKey,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return opts, fmt.Errorf("the client certificate and key go together, set both --client-cert and --client-key")
+	}
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return opts, fmt.Errorf("reading the CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return opts, fmt.Errorf("no PEM certificate found in the CA bundle %s", caBundle)
+		}
+		opts.LoadedCAPool = pool
+	}
+	return opts, nil
+}
+
+// tlsTransport returns the transport the connections to GARM are made with:
+// the default one, with the TLS options set.
+func tlsTransport() (http.RoundTripper, error) {
+	if caBundle == "" && clientCert == "" && clientKey == "" && !insecureSkipVerify {
+		return http.DefaultTransport, nil
+	}
+	opts, err := tlsClientOptions()
+	if err != nil {
+		return nil, err
+	}
+	if insecureSkipVerify {
+		log.Println("WARNING: the certificate of GARM is not verified")
+	}
+	tlsConfig, err := openapiRuntimeClient.TLSClientAuth(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
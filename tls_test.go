@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir, "client")
+	otherCert, _ := writeCertificate(t, dir, "other")
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		caBundle string
+		cert     string
+		key      string
+		wantErr  string
+	}{
+		{name: "nothing"},
+		{name: "CA bundle", caBundle: cert},
+		{name: "client certificate", cert: cert, key: key},
+		{name: "certificate without key", cert: cert, wantErr: "go together"},
+		{name: "key without certificate", key: key, wantErr: "go together"},
+		{name: "missing CA bundle", caBundle: filepath.Join(dir, "missing.pem"), wantErr: "reading the CA bundle"},
+		{name: "CA bundle without certificates", caBundle: notPEM, wantErr: "no PEM certificate"},
+		{name: "key of another certificate", cert: otherCert, key: key, wantErr: "private key does not match"},
+	}
+	saved := []string{caBundle, clientCert, clientKey}
+	t.Cleanup(func() {
+		caBundle, clientCert, clientKey = saved[0], saved[1], saved[2]
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caBundle, clientCert, clientKey = tt.caBundle, tt.cert, tt.key
+			opts, err := tlsClientOptions()
+			if err == nil {
+				// Loading the pair only happens when the transport is built.
+				_, err = tlsTransport()
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (opts.LoadedCAPool != nil) != (tt.caBundle != "") {
+				t.Errorf("tlsClientOptions() CA pool = %v, want one: %v", opts.LoadedCAPool, tt.caBundle != "")
+			}
+			if opts.Certificate != tt.cert || opts.Key != tt.key {
+				t.Errorf("tlsClientOptions() certificate = %s, key = %s", opts.Certificate, opts.Key)
+			}
+		})
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key to dir, and
+// returns their paths.
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cloudbase/garm/params"
+)
+
+// webhookURL is where the simulated GitHub webhooks are sent. It defaults to
+// the webhooks endpoint of the GARM server at baseURL.
+var webhookURL = os.Getenv("GARM_WEBHOOK_URL")
+
+func webhookEndpoint() (string, error) {
+	if webhookURL != "" {
+		return webhookURL, nil
+	}
+	return url.JoinPath(baseURL, "webhooks")
+}
+
+// workflowJobEvent builds the workflow_job payload GitHub sends for a job of
+// e. Jobs that are not queued anymore are assigned to runnerName.
+func workflowJobEvent(e Entity, action string, jobID int64, labels []string, runnerName string) (params.WorkflowJob, string) {
+	var job params.WorkflowJob
+	target := e.WebhookTarget(&job)
+	now := time.Now().UTC()
+	repoURL := "https://github.com/" + job.Repository.FullName
+	if job.Repository.FullName == "" {
+		repoURL = "https://github.com/" + orgOrEnterprise(job)
+	}
+
+	job.Action = action
+	job.WorkflowJob.ID = jobID
+	job.WorkflowJob.RunID = jobID / 10
+	job.WorkflowJob.RunAttempt = 1
+	job.WorkflowJob.Name = "garm-test-client"
+	job.WorkflowJob.HeadSha = fmt.Sprintf("%040x", jobID)
+	job.WorkflowJob.URL = fmt.Sprintf("https://api.github.com/repos/%s/actions/jobs/%d", job.Repository.FullName, jobID)
+	job.WorkflowJob.HTMLURL = fmt.Sprintf("%s/actions/runs/%d/job/%d", repoURL, job.WorkflowJob.RunID, jobID)
+	job.WorkflowJob.RunURL = fmt.Sprintf("https://api.github.com/repos/%s/actions/runs/%d", job.Repository.FullName, job.WorkflowJob.RunID)
+	job.WorkflowJob.Labels = labels
+	job.WorkflowJob.Status = action
+	job.WorkflowJob.StartedAt = now
+	if action != "queued" {
+		job.WorkflowJob.RunnerID = jobID % 100000
+		job.WorkflowJob.RunnerName = runnerName
+		job.WorkflowJob.RunnerGroupID = 1
+		job.WorkflowJob.RunnerGroupName = "Default"
+	}
+	if action == "completed" {
+		job.WorkflowJob.Conclusion = "success"
+		job.WorkflowJob.CompletedAt = now
+	}
+	return job, target
+}
+
+func orgOrEnterprise(job params.WorkflowJob) string {
+	if job.Organization.Login != "" {
+		return job.Organization.Login
+	}
+	return "enterprises/" + job.Enterprise.Slug
+}
+
+// signPayload computes the X-Hub-Signature-256 header of a payload.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts a workflow_job event to GARM, signed with secret.
+func sendWebhook(target, secret string, job params.WorkflowJob) error {
+	endpoint, err := webhookEndpoint()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GitHub-Hookshot/garm-test-client")
+	req.Header.Set("X-Github-Event", "workflow_job")
+	req.Header.Set("X-Github-Delivery", fmt.Sprintf("%d-%s", job.WorkflowJob.ID, job.Action))
+	req.Header.Set("X-Github-Hook-Installation-Target-Type", target)
+	req.Header.Set("X-Hub-Signature-256", signPayload(secret, body))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{What: "webhook", StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return nil
+}
+
+// poolLabels returns the labels a job needs to run on the pool of e.
+func poolLabels(e Entity) ([]string, error) {
+	state := e.State()
+	pool, err := e.GetPool(state.id, state.poolID)
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0, len(pool.Tags))
+	for _, tag := range pool.Tags {
+		labels = append(labels, tag.Name)
+	}
+	return labels, nil
+}
+
+// sendJob sends a workflow_job event of the current job of e.
+func sendJob(e Entity, action string) error {
+	state := e.State()
+	labels, err := poolLabels(e)
+	if err != nil {
+		return err
+	}
+	job, target := workflowJobEvent(e, action, state.jobID, labels, state.instanceName)
+	log.Printf(">>> Send %s webhook for job %d to %s", action, state.jobID, e.Kind())
+	return sendWebhook(target, state.webhookSecret, job)
+}
+
+// waitJob waits until GARM lists the job with the given status.
+func waitJob(jobID int64, status string) error {
+	_, err := poll(runCtx, fmt.Sprintf("job %d to be %s", jobID, status), defaultPoll, func() (params.Jobs, error) {
+		return listJobs(cli, authToken)
+	}, func(jobs params.Jobs) bool {
+		for _, job := range jobs {
+			if job.ID == jobID {
+				return job.Status == status
+			}
+		}
+		return false
+	})
+	return err
+}
+
+func newJobID() int64 {
+	return 1_000_000_000 + rand.Int63n(1_000_000_000)
+}
+
+// ///////////
+// Webhooks //
+// ///////////
+func SendEntityJobBadSignature(e Entity) error {
+	state := e.State()
+	labels, err := poolLabels(e)
+	if err != nil {
+		return err
+	}
+	jobID := newJobID()
+	job, target := workflowJobEvent(e, "queued", jobID, labels, "")
+	log.Printf(">>> Send queued webhook for job %d to %s, with a bad signature", jobID, e.Kind())
+	err = sendWebhook(target, "not-"+state.webhookSecret, job)
+	if statusErr, ok := err.(*statusError); !ok || statusErr.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("expected the webhook to be rejected with status 401, got: %v", err)
+	}
+	jobs, err := listJobs(cli, authToken)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if j.ID == jobID {
+			return fmt.Errorf("job %d was recorded despite its bad signature", jobID)
+		}
+	}
+	return nil
+}
+
+func SendEntityJobQueued(e Entity) error {
+	state := e.State()
+	state.jobID = newJobID()
+	if err := sendJob(e, "queued"); err != nil {
+		return err
+	}
+	return waitJob(state.jobID, "queued")
+}
+
+func SendEntityJobInProgress(e Entity) error {
+	state := e.State()
+	if state.instanceName == "" {
+		return fmt.Errorf("no idle %s runner to pick up job %d", e.Kind(), state.jobID)
+	}
+	if err := sendJob(e, "in_progress"); err != nil {
+		return err
+	}
+	if err := waitJob(state.jobID, "in_progress"); err != nil {
+		return err
+	}
+	log.Printf(">>> Wait until runner %s is active", state.instanceName)
+	_, err := poll(runCtx, "runner "+state.instanceName+" to be active", defaultPoll, func() (*params.Instance, error) {
+		return getInstance(cli, authToken, state.instanceName)
+	}, func(instance *params.Instance) bool {
+		return instance.RunnerStatus == params.RunnerActive
+	})
+	return err
+}
+
+func SendEntityJobCompleted(e Entity) error {
+	state := e.State()
+	if err := sendJob(e, "completed"); err != nil {
+		return err
+	}
+	if err := waitJob(state.jobID, "completed"); err != nil {
+		return err
+	}
+	// The runner is removed once its job is done, and the pool replaces it
+	// with an idle one.
+	log.Printf(">>> Wait until runner %s is removed", state.instanceName)
+	consumed := state.instanceName
+	if _, err := poll(runCtx, "runner "+consumed+" to be removed", defaultPoll, func() (*params.Instance, error) {
+		instance, err := getInstance(cli, authToken, consumed)
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return instance, err
+	}, func(instance *params.Instance) bool {
+		return instance == nil
+	}); err != nil {
+		return err
+	}
+	return WaitEntityInstance(e)
+}
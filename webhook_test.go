@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cloudbase/garm/params"
+)
+
+func TestSignPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		want   string
+	}{
+		{
+			// The example of the GitHub webhook documentation.
+			name:   "documented",
+			secret: "It's a Secret to Everybody",
+			body:   "Hello, World!",
+			want:   "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+		},
+		{
+			name:   "empty body",
+			secret: "secret",
+			body:   "",
+			want:   "sha256=f9e66e179b6747ae54108f82f8ade8b3c25d76fd30afde6c395822c530196169",
+		},
+		{
+			name:   "empty secret",
+			secret: "",
+			body:   "{}",
+			want:   "sha256=22f8eea909400af98adf3681a9f31923ef6b7fcba4abb553d92823a3e9d5c25e",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signPayload(tt.secret, []byte(tt.body)); got != tt.want {
+				t.Errorf("signPayload() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"accepted", http.StatusOK, false},
+		{"no content", http.StatusNoContent, false},
+		{"rejected", http.StatusUnauthorized, true},
+		{"failed", http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var job params.WorkflowJob
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				switch {
+				case r.Header.Get("X-Hub-Signature-256") != signPayload("hook-secret", body):
+					t.Errorf("signature %s does not match the body", r.Header.Get("X-Hub-Signature-256"))
+				case r.Header.Get("X-Github-Event") != "workflow_job":
+					t.Errorf("event = %s", r.Header.Get("X-Github-Event"))
+				case r.Header.Get("X-Github-Hook-Installation-Target-Type") != "repository":
+					t.Errorf("target = %s", r.Header.Get("X-Github-Hook-Installation-Target-Type"))
+				}
+				if err := json.Unmarshal(body, &job); err != nil {
+					t.Error(err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			// The suite may have pointed httpClient at a recorded fixture.
+			savedURL, savedClient := webhookURL, httpClient
+			webhookURL, httpClient = srv.URL, srv.Client()
+			defer func() { webhookURL, httpClient = savedURL, savedClient }()
+
+			sent := params.WorkflowJob{Action: "queued"}
+			sent.WorkflowJob.ID = 42
+			err := sendWebhook("repository", "hook-secret", sent)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("sendWebhook() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), strconv.Itoa(tt.status)) {
+				t.Errorf("sendWebhook() error = %v, want status %d", err, tt.status)
+			}
+			if job.Action != "queued" || job.WorkflowJob.ID != 42 {
+				t.Errorf("GARM got %+v", job)
+			}
+		})
+	}
+}